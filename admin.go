@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sweetspeak/consts"
+	"time"
+)
+
+var (
+	adminAddr = flag.String("addr", consts.AdminAddr, "address of the server's admin interface")
+	tokenFile = flag.String("token-file", consts.AdminTokenFile, "file holding the admin token the server wrote")
+
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+const usage = `usage: sweetspeak-admin [-addr host:port] [-token-file path] <command> [args]
+
+commands:
+  clients               list connected clients
+  chats                 list chats and their members
+  bans                  list banned users
+  kick <user>           disconnect a user
+  ban <user>            ban and disconnect a user
+  unban <user>          lift a ban
+  broadcast <text...>   send an announcement to every client
+  loglevel [level]      show or set the server log level (info, warn, error, debug)
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var (
+		body string
+		err  error
+	)
+
+	switch cmd, rest := args[0], args[1:]; cmd {
+	case "clients", "chats", "bans":
+		body, err = get("/" + cmd)
+	case "kick", "ban", "unban":
+		if len(rest) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		body, err = post("/"+cmd, url.Values{"user": {rest[0]}}, "")
+	case "broadcast":
+		if len(rest) == 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		body, err = post("/broadcast", nil, strings.Join(rest, " "))
+	case "loglevel":
+		if len(rest) == 0 {
+			body, err = get("/loglevel")
+		} else {
+			body, err = post("/loglevel", url.Values{"level": {rest[0]}}, "")
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sweetspeak-admin: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Print(body)
+}
+
+func get(path string) (string, error) {
+	return do(http.MethodGet, fmt.Sprintf("http://%s%s", *adminAddr, path), "")
+}
+
+func post(path string, query url.Values, body string) (string, error) {
+	u := fmt.Sprintf("http://%s%s", *adminAddr, path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	return do(http.MethodPost, u, body)
+}
+
+// do sends a request with the admin token the server left in tokenFile.
+func do(method string, u string, body string) (string, error) {
+	token, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("admin token: %v", err)
+	}
+
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	return readResponse(resp)
+}
+
+func readResponse(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sweetspeak/bot"
+	"sweetspeak/client"
+	"sweetspeak/consts"
+	log "sweetspeak/logging"
+	"sweetspeak/user"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/google/uuid"
+)
+
+var (
+	botName = flag.String("name", "sweetbot", "user name the bot connects as")
+	botAddr = flag.String("addr", consts.Addr, "server address")
+	botWith = flag.String("with", "", "comma separated users to open a chat with on start")
+
+	// MaxReminder keeps reminders from piling up forever.
+	MaxReminder = 24 * time.Hour
+)
+
+// sweetspeak-bot is a sample bot: it echoes, greets and reminds.
+func main() {
+	flag.Parse()
+
+	log.SetGlobalFile(fmt.Sprintf("sweetspeak-bot-%s.log", *botName))
+	log.SetConsoleOutput(false)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := client.New(uuid.NewString(), user.New(*botName, lipgloss.Color("213"))).WithAddr(*botAddr)
+	b := bot.New(c)
+
+	b.Use(bot.Recover(), bot.Logger())
+
+	b.Command("help", "list commands", func(bc *bot.Context) error {
+		return bc.Reply(b.Help())
+	})
+
+	b.Command("echo", "<text> says text back", func(bc *bot.Context) error {
+		if len(bc.Args) == 0 {
+			return bc.Reply("usage: /echo <text>")
+		}
+		return bc.Reply(strings.Join(bc.Args, " "))
+	})
+
+	b.Command("remind", "<duration> <text> reminds this chat, e.g. /remind 10m tea", remind)
+
+	b.Command("reminders", "shows how many reminders are pending here", func(bc *bot.Context) error {
+		n, _ := bc.State().Get("reminders")
+		count, _ := n.(int)
+		return bc.Replyf("%d reminder(s) pending", count)
+	})
+
+	b.Match(`(?i)^(hi|hello|hey)\b`, func(bc *bot.Context) error {
+		return bc.Replyf("hello %s! try /help", bc.Message.From.Name)
+	})
+
+	if *botWith != "" {
+		c.OnConnection(func(connected bool) {
+			if !connected {
+				return
+			}
+
+			for _, to := range strings.Split(*botWith, ",") {
+				if _, err := c.OpenChat(ctx, to); err != nil {
+					log.Error("bot: chat with %s: %v", to, err)
+				}
+			}
+		})
+	}
+
+	fmt.Printf("%s running against %s, ctrl+c to stop\n", *botName, *botAddr)
+
+	if err := b.Run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func remind(bc *bot.Context) error {
+	if len(bc.Args) < 2 {
+		return bc.Reply("usage: /remind <duration> <text>")
+	}
+
+	after, err := time.ParseDuration(bc.Args[0])
+	if err != nil || after <= 0 || after > MaxReminder {
+		return bc.Replyf("%q is not a duration up to %s, try 90s or 10m", bc.Args[0], MaxReminder)
+	}
+
+	var (
+		text  = strings.Join(bc.Args[1:], " ")
+		from  = bc.Message.From.Name
+		state = bc.State()
+	)
+
+	adjust := func(delta int) {
+		state.Update("reminders", func(v interface{}, _ bool) interface{} {
+			n, _ := v.(int)
+			return n + delta
+		})
+	}
+
+	adjust(1)
+	time.AfterFunc(after, func() {
+		adjust(-1)
+		if err := bc.Replyf("%s, reminder: %s", from, text); err != nil {
+			log.Error("bot: reminder: %v", err)
+		}
+	})
+
+	return bc.Replyf("ok, I'll remind you in %s", after)
+}
@@ -0,0 +1,180 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sweetspeak/chat"
+	"sweetspeak/client"
+	log "sweetspeak/logging"
+	"sweetspeak/message"
+	"sync"
+)
+
+var (
+	// QueueSize bounds the messages waiting for the bot's handlers.
+	QueueSize = 256
+)
+
+type (
+	// Bot answers chat messages on behalf of a client. Messages are
+	// handled one at a time, in the order they arrive.
+	Bot struct {
+		*Router
+		client *client.Client
+
+		statesMu sync.Mutex
+		states   map[string]*State
+	}
+
+	// Context is what a handler gets for one message.
+	Context struct {
+		context.Context
+		Bot     *Bot
+		Message message.TextMessage
+		// Command and Args are set when the message is a slash command,
+		// e.g. "/remind 5m tea" has Command "remind" and Args
+		// ["5m", "tea"].
+		Command string
+		Args    []string
+		// Matches holds the submatches of the pattern that picked the
+		// handler, if any.
+		Matches []string
+	}
+
+	// State is per-chat storage that lives as long as the bot does.
+	State struct {
+		sync.Mutex
+		values map[string]interface{}
+	}
+)
+
+func New(c *client.Client) *Bot {
+	return &Bot{
+		Router: NewRouter(),
+		client: c,
+		states: make(map[string]*State),
+	}
+}
+
+func (b *Bot) Client() *client.Client {
+	return b.client
+}
+
+// Run connects the bot and handles messages until ctx is done or the
+// connection is lost.
+func (b *Bot) Run(ctx context.Context) error {
+	queue := make(chan message.TextMessage, QueueSize)
+
+	b.client.OnMessage(func(tm message.TextMessage) {
+		// Never answer ourselves.
+		if tm.From.Name == b.client.Self().Name {
+			return
+		}
+
+		select {
+		case queue <- tm:
+		default:
+			log.Warn("bot: queue full, dropping message in chat %s", tm.ChatID)
+		}
+	})
+
+	if err := b.client.Connect(ctx); err != nil {
+		return fmt.Errorf("bot: connect: %v", err)
+	}
+	defer b.client.Close()
+
+	log.Info("bot: %s is running", b.client.Self().Name)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-b.client.Done():
+			return fmt.Errorf("bot: connection lost")
+		case tm := <-queue:
+			b.handle(ctx, tm)
+		}
+	}
+}
+
+func (b *Bot) handle(ctx context.Context, tm message.TextMessage) {
+	c := &Context{
+		Context: ctx,
+		Bot:     b,
+		Message: tm,
+	}
+
+	if err := b.Router.Serve(c); err != nil {
+		log.Error("bot: chat %s: %v", tm.ChatID, err)
+	}
+}
+
+// State returns the state for chatID, creating it if needed.
+func (b *Bot) State(chatID string) *State {
+	b.statesMu.Lock()
+	defer b.statesMu.Unlock()
+
+	st, ok := b.states[chatID]
+	if !ok {
+		st = &State{values: make(map[string]interface{})}
+		b.states[chatID] = st
+	}
+
+	return st
+}
+
+// Send posts content to chatID.
+func (b *Bot) Send(chatID string, content string) error {
+	return b.client.Send(chatID, content)
+}
+
+// Reply answers in the chat the message came from.
+func (c *Context) Reply(content string) error {
+	return c.Bot.Send(c.Message.ChatID, content)
+}
+
+func (c *Context) Replyf(format string, args ...interface{}) error {
+	return c.Reply(fmt.Sprintf(format, args...))
+}
+
+// State is the state of the chat the message came from.
+func (c *Context) State() *State {
+	return c.Bot.State(c.Message.ChatID)
+}
+
+// Chat is the chat the message came from.
+func (c *Context) Chat() *chat.Chat {
+	return c.Bot.client.Chat(c.Message.ChatID)
+}
+
+func (s *State) Get(key string) (interface{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *State) Set(key string, value interface{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.values[key] = value
+}
+
+func (s *State) Delete(key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.values, key)
+}
+
+// Update calls fn with the current value of key and stores what it
+// returns, all under the state's lock.
+func (s *State) Update(key string, fn func(value interface{}, ok bool) interface{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	v, ok := s.values[key]
+	s.values[key] = fn(v, ok)
+}
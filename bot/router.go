@@ -0,0 +1,182 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	log "sweetspeak/logging"
+	"time"
+)
+
+type (
+	HandlerFunc func(c *Context) error
+
+	// Middleware wraps every handler the router picks, e.g. for logging
+	// or access control.
+	Middleware func(next HandlerFunc) HandlerFunc
+
+	// Router picks a handler for each message: a registered command for
+	// "/name args...", else the first pattern that matches the content,
+	// else the fallback.
+	Router struct {
+		commands   map[string]command
+		patterns   []pattern
+		fallback   HandlerFunc
+		middleware []Middleware
+	}
+
+	command struct {
+		help    string
+		handler HandlerFunc
+	}
+
+	pattern struct {
+		re      *regexp.Regexp
+		handler HandlerFunc
+	}
+)
+
+func NewRouter() *Router {
+	return &Router{
+		commands: make(map[string]command),
+	}
+}
+
+// Use adds middleware. The first added runs outermost.
+func (r *Router) Use(mw ...Middleware) *Router {
+	r.middleware = append(r.middleware, mw...)
+	return r
+}
+
+// Command handles "/name ...". help is shown by /help.
+func (r *Router) Command(name string, help string, handler HandlerFunc) *Router {
+	r.commands[strings.TrimPrefix(name, "/")] = command{help: help, handler: handler}
+	return r
+}
+
+// Match handles messages whose content matches expr.
+func (r *Router) Match(expr string, handler HandlerFunc) *Router {
+	r.patterns = append(r.patterns, pattern{re: regexp.MustCompile(expr), handler: handler})
+	return r
+}
+
+// Fallback handles messages nothing else picked up.
+func (r *Router) Fallback(handler HandlerFunc) *Router {
+	r.fallback = handler
+	return r
+}
+
+// Help lists the registered commands, one per line.
+func (r *Router) Help() string {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "/%s %s\n", name, r.commands[name].help)
+	}
+
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// Serve routes c to its handler through the middleware.
+func (r *Router) Serve(c *Context) error {
+	handler := r.route(c)
+	if handler == nil {
+		return nil
+	}
+
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+
+	return handler(c)
+}
+
+func (r *Router) route(c *Context) HandlerFunc {
+	content := strings.TrimSpace(c.Message.Content)
+
+	if name, args, ok := ParseCommand(content); ok {
+		if cmd, ok := r.commands[name]; ok {
+			c.Command = name
+			c.Args = args
+			return cmd.handler
+		}
+	}
+
+	for _, p := range r.patterns {
+		if m := p.re.FindStringSubmatch(content); m != nil {
+			c.Matches = m
+			return p.handler
+		}
+	}
+
+	return r.fallback
+}
+
+// ParseCommand splits "/name arg1 arg2" into its name and arguments.
+func ParseCommand(content string) (string, []string, bool) {
+	if !strings.HasPrefix(content, "/") {
+		return "", nil, false
+	}
+
+	fields := strings.Fields(content[1:])
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+
+	return strings.ToLower(fields[0]), fields[1:], true
+}
+
+// Logger logs every handled message and how long it took.
+func Logger() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			start := time.Now()
+			err := next(c)
+			log.Info("bot: %s in chat %s: %q handled in %s (err=%v)",
+				c.Message.From.Name, c.Message.ChatID, c.Message.Content, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Recover turns a panicking handler into an error, so one bad message
+// doesn't take the bot down.
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					log.Error("bot: handler panic: %v\n%s", p, debug.Stack())
+					err = fmt.Errorf("handler panic: %v", p)
+				}
+			}()
+			return next(c)
+		}
+	}
+}
+
+// OnlyUsers ignores messages from anyone not named in names. It relies
+// on the server, which sets From to the connection that sent the
+// message; users of other domains are named name@domain.
+func OnlyUsers(names ...string) Middleware {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if !allowed[c.Message.From.Name] {
+				return nil
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"sweetspeak/message"
+	"sweetspeak/user"
+)
+
+var (
+	// EventBufferSize bounds the events a node has received but not yet
+	// handled.
+	EventBufferSize = 1024
+
+	ErrUnknownNode = errors.New("bus: unknown node")
+	ErrClosed      = errors.New("bus: closed")
+)
+
+type EventKind int
+
+const (
+	// PeerUpEvent and PeerDownEvent are raised by the bus itself when a
+	// link to another node comes up or goes away. They are never sent.
+	PeerUpEvent EventKind = iota
+	PeerDownEvent
+	// PresenceSyncEvent replaces everything known about the sender's
+	// connected users with Users.
+	PresenceSyncEvent
+	PresenceJoinEvent
+	PresenceLeaveEvent
+	// ChatEvent announces a chat opened on the sender.
+	ChatEvent
+	// DeliverEvent asks the receiver to pass Message on to its local
+	// clients named in To.
+	DeliverEvent
+	// ChatRequestEvent asks the receiver to open Chat with its user
+	// named in To. It answers with ChatAcceptEvent or ChatRejectEvent
+	// for the same chat ID.
+	ChatRequestEvent
+	ChatAcceptEvent
+	ChatRejectEvent
+)
+
+var eventKindNames = map[EventKind]string{
+	PeerUpEvent:        "peer_up",
+	PeerDownEvent:      "peer_down",
+	PresenceSyncEvent:  "presence_sync",
+	PresenceJoinEvent:  "presence_join",
+	PresenceLeaveEvent: "presence_leave",
+	ChatEvent:          "chat",
+	DeliverEvent:       "deliver",
+	ChatRequestEvent:   "chat_request",
+	ChatAcceptEvent:    "chat_accept",
+	ChatRejectEvent:    "chat_reject",
+}
+
+func (k EventKind) String() string {
+	if name, ok := eventKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(k))
+}
+
+type (
+	// Bus connects the server processes of one deployment so they can
+	// share presence and route messages to clients connected elsewhere.
+	Bus interface {
+		NodeID() string
+		// Broadcast sends ev to every other node.
+		Broadcast(ev Event) error
+		// Send sends ev to a single node.
+		Send(nodeID string, ev Event) error
+		// Events delivers events from other nodes, with From set to the
+		// sending node.
+		Events() <-chan Event
+		Close() error
+	}
+
+	Event struct {
+		Kind    EventKind          `yaml:"kind"`
+		From    string             `yaml:"from"`
+		Users   []user.User        `yaml:"users,omitempty"`
+		Chat    *ChatInfo          `yaml:"chat,omitempty"`
+		To      []string           `yaml:"to,omitempty"`
+		Message *message.WSMessage `yaml:"message,omitempty"`
+	}
+
+	ChatInfo struct {
+		ID    string      `yaml:"id"`
+		Name  string      `yaml:"name"`
+		Users []user.User `yaml:"users"`
+	}
+)
@@ -0,0 +1,202 @@
+package bus
+
+import (
+	"net"
+	"sweetspeak/message"
+	"sweetspeak/user"
+	"testing"
+	"time"
+)
+
+// waitFor returns the first event of kind from events, failing the test
+// if none comes within a few seconds.
+func waitFor(t *testing.T, events <-chan Event, kind EventKind) Event {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Kind == kind {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", kind)
+			return Event{}
+		}
+	}
+}
+
+// expectNone fails the test if an event of kind arrives within d.
+func expectNone(t *testing.T, events <-chan Event, kind EventKind, d time.Duration) {
+	t.Helper()
+
+	timeout := time.After(d)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Kind == kind {
+				t.Fatalf("unexpected %s event from %s", kind, ev.From)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	a := hub.Join("a")
+	b := hub.Join("b")
+
+	if up := waitFor(t, a.Events(), PeerUpEvent); up.From != "b" {
+		t.Fatalf("a saw %s come up, want b", up.From)
+	}
+	if up := waitFor(t, b.Events(), PeerUpEvent); up.From != "a" {
+		t.Fatalf("b saw %s come up, want a", up.From)
+	}
+
+	alice := *user.New("alice", "1")
+	if err := a.Broadcast(Event{Kind: PresenceJoinEvent, Users: []user.User{alice}}); err != nil {
+		t.Fatal(err)
+	}
+	join := waitFor(t, b.Events(), PresenceJoinEvent)
+	if join.From != "a" || len(join.Users) != 1 || join.Users[0].Name != "alice" {
+		t.Fatalf("b got %+v", join)
+	}
+
+	if err := a.Send("c", Event{Kind: DeliverEvent}); err != ErrUnknownNode {
+		t.Fatalf("send to a missing node: %v, want ErrUnknownNode", err)
+	}
+	if err := a.Send("a", Event{Kind: DeliverEvent}); err != ErrUnknownNode {
+		t.Fatalf("send to self: %v, want ErrUnknownNode", err)
+	}
+
+	b.Close()
+	if down := waitFor(t, a.Events(), PeerDownEvent); down.From != "b" {
+		t.Fatalf("a saw %s go down, want b", down.From)
+	}
+}
+
+// freeAddrs returns n local addresses that were free a moment ago.
+func freeAddrs(t *testing.T, n int) []string {
+	t.Helper()
+
+	addrs := make([]string, n)
+	for i := range addrs {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = ln.Addr().String()
+		ln.Close()
+	}
+	return addrs
+}
+
+// startMeshes starts two linked meshes, a and b, on localhost.
+func startMeshes(t *testing.T, secretA, secretB map[string]string) (*Mesh, *Mesh) {
+	t.Helper()
+
+	retry := DialRetryInterval
+	DialRetryInterval = 50 * time.Millisecond
+	t.Cleanup(func() { DialRetryInterval = retry })
+
+	addrs := freeAddrs(t, 2)
+	a := NewMesh("a", addrs[0], []string{addrs[1]})
+	b := NewMesh("b", addrs[1], []string{addrs[0]})
+	if secretA != nil {
+		a.WithAuth(secretA)
+	}
+	if secretB != nil {
+		b.WithAuth(secretB)
+	}
+
+	for _, m := range []*Mesh{a, b} {
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { m.Close() })
+	}
+
+	return a, b
+}
+
+func TestMeshPresenceAndRouting(t *testing.T) {
+	secrets := map[string]string{"a": "s3cret", "b": "s3cret"}
+	a, b := startMeshes(t, secrets, secrets)
+
+	waitFor(t, a.Events(), PeerUpEvent)
+	waitFor(t, b.Events(), PeerUpEvent)
+
+	alice := *user.New("alice", "1")
+	if err := a.Broadcast(Event{Kind: PresenceSyncEvent, Users: []user.User{alice}}); err != nil {
+		t.Fatal(err)
+	}
+	sync := waitFor(t, b.Events(), PresenceSyncEvent)
+	if sync.From != "a" || len(sync.Users) != 1 || sync.Users[0].Name != "alice" {
+		t.Fatalf("b got presence %+v", sync)
+	}
+
+	tm := message.NewTextMessage("chat-1", *user.New("bob", "2"), "hello alice")
+	if err := b.Send("a", Event{Kind: DeliverEvent, To: []string{"alice"}, Message: &tm}); err != nil {
+		t.Fatal(err)
+	}
+	deliver := waitFor(t, a.Events(), DeliverEvent)
+	if deliver.From != "b" || len(deliver.To) != 1 || deliver.To[0] != "alice" || deliver.Message == nil {
+		t.Fatalf("a got delivery %+v", deliver)
+	}
+	got, err := deliver.Message.ToTextMessage()
+	if err != nil || got.Content != "hello alice" || got.ChatID != "chat-1" {
+		t.Fatalf("a got message %+v (%v)", got, err)
+	}
+
+	if err := a.Send("c", Event{Kind: DeliverEvent}); err != ErrUnknownNode {
+		t.Fatalf("send to a missing node: %v, want ErrUnknownNode", err)
+	}
+
+	b.Close()
+	if down := waitFor(t, a.Events(), PeerDownEvent); down.From != "b" {
+		t.Fatalf("a saw %s go down, want b", down.From)
+	}
+}
+
+func TestMeshRejectsWrongSecret(t *testing.T) {
+	a, b := startMeshes(t,
+		map[string]string{"b": "right"},
+		map[string]string{"a": "wrong"},
+	)
+
+	expectNone(t, a.Events(), PeerUpEvent, 500*time.Millisecond)
+	expectNone(t, b.Events(), PeerUpEvent, 100*time.Millisecond)
+}
+
+func TestMeshRejectsOutOfSequenceFrames(t *testing.T) {
+	secrets := map[string]string{"a": "s3cret", "b": "s3cret"}
+	a, b := startMeshes(t, secrets, secrets)
+
+	waitFor(t, a.Events(), PeerUpEvent)
+	waitFor(t, b.Events(), PeerUpEvent)
+
+	if err := a.Send("b", Event{Kind: PresenceSyncEvent}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, b.Events(), PresenceSyncEvent)
+
+	// Sign the next frame as if it were the last one again, the way a
+	// replayed frame would be.
+	a.linksMu.Lock()
+	l := a.links["b"]
+	a.linksMu.Unlock()
+	l.Lock()
+	l.seq--
+	l.Unlock()
+
+	if err := a.Send("b", Event{Kind: PresenceSyncEvent}); err != nil {
+		t.Fatal(err)
+	}
+	if down := waitFor(t, a.Events(), PeerDownEvent); down.From != "b" {
+		t.Fatalf("a saw %s go down, want b", down.From)
+	}
+	expectNone(t, b.Events(), PresenceSyncEvent, 100*time.Millisecond)
+}
@@ -0,0 +1,122 @@
+package bus
+
+import (
+	"sync"
+)
+
+type (
+	// Hub joins several servers running in the same process, e.g. for
+	// tests and load tests.
+	Hub struct {
+		sync.Mutex
+		nodes map[string]*LocalBus
+	}
+
+	LocalBus struct {
+		hub    *Hub
+		id     string
+		events chan Event
+		done   chan struct{}
+		once   sync.Once
+	}
+)
+
+func NewHub() *Hub {
+	return &Hub{
+		nodes: make(map[string]*LocalBus),
+	}
+}
+
+// Join adds a node to the hub. Every node already on the hub sees a
+// PeerUpEvent for it, and it sees one for each of them.
+func (h *Hub) Join(nodeID string) *LocalBus {
+	b := &LocalBus{
+		hub:    h,
+		id:     nodeID,
+		events: make(chan Event, EventBufferSize),
+		done:   make(chan struct{}),
+	}
+
+	h.Lock()
+	peers := h.peersOf(nodeID)
+	h.nodes[nodeID] = b
+	h.Unlock()
+
+	for _, peer := range peers {
+		peer.deliver(Event{Kind: PeerUpEvent, From: nodeID})
+		b.deliver(Event{Kind: PeerUpEvent, From: peer.id})
+	}
+
+	return b
+}
+
+// peersOf must be called with h locked.
+func (h *Hub) peersOf(nodeID string) []*LocalBus {
+	peers := make([]*LocalBus, 0, len(h.nodes))
+	for id, node := range h.nodes {
+		if id != nodeID {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+func (b *LocalBus) NodeID() string {
+	return b.id
+}
+
+func (b *LocalBus) Broadcast(ev Event) error {
+	b.hub.Lock()
+	peers := b.hub.peersOf(b.id)
+	b.hub.Unlock()
+
+	ev.From = b.id
+	for _, peer := range peers {
+		peer.deliver(ev)
+	}
+
+	return nil
+}
+
+func (b *LocalBus) Send(nodeID string, ev Event) error {
+	b.hub.Lock()
+	peer, ok := b.hub.nodes[nodeID]
+	b.hub.Unlock()
+
+	if !ok || nodeID == b.id {
+		return ErrUnknownNode
+	}
+
+	ev.From = b.id
+	peer.deliver(ev)
+
+	return nil
+}
+
+func (b *LocalBus) Events() <-chan Event {
+	return b.events
+}
+
+func (b *LocalBus) Close() error {
+	b.once.Do(func() {
+		b.hub.Lock()
+		delete(b.hub.nodes, b.id)
+		peers := b.hub.peersOf(b.id)
+		b.hub.Unlock()
+
+		close(b.done)
+
+		for _, peer := range peers {
+			peer.deliver(Event{Kind: PeerDownEvent, From: b.id})
+		}
+	})
+
+	return nil
+}
+
+func (b *LocalBus) deliver(ev Event) {
+	select {
+	case b.events <- ev:
+	case <-b.done:
+	}
+}
@@ -0,0 +1,480 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	log "sweetspeak/logging"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	DialRetryInterval = 2 * time.Second
+	HandshakeTimeout  = 5 * time.Second
+	SendTimeout       = 5 * time.Second
+
+	// MaxFrameSize caps a single event on the wire.
+	MaxFrameSize = 1 << 20
+)
+
+type (
+	// Mesh is a Bus over TCP. Every node listens on its own address and
+	// dials every peer; events are sent over the dialed link and read
+	// from the accepted one. Each node must list all the others.
+	Mesh struct {
+		id         string
+		listenAddr string
+		peers      []string
+
+		listener net.Listener
+		events   chan Event
+		ctx      context.Context
+		cancel   context.CancelFunc
+		wg       sync.WaitGroup
+
+		linksMu sync.Mutex
+		links   map[string]*link
+
+		// secrets, if set, holds the shared secret for every node allowed
+		// to connect; see WithAuth.
+		secrets map[string][]byte
+	}
+
+	// link is the outbound connection to one peer.
+	link struct {
+		sync.Mutex
+		nodeID string
+		conn   net.Conn
+		writer *bufio.Writer
+		// With auth on, every frame carries a MAC keyed with key over
+		// seq and the frame itself; see frameMAC.
+		key []byte
+		seq uint64
+	}
+
+	hello struct {
+		Node  string `yaml:"node"`
+		Nonce string `yaml:"nonce"`
+	}
+
+	proof struct {
+		MAC string `yaml:"mac"`
+	}
+)
+
+func NewMesh(nodeID string, listenAddr string, peers []string) *Mesh {
+	m := &Mesh{
+		id:         nodeID,
+		listenAddr: listenAddr,
+		peers:      peers,
+		events:     make(chan Event, EventBufferSize),
+		links:      make(map[string]*link),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	return m
+}
+
+// WithAuth makes both ends of every link prove they know the secret
+// shared between them before any event is exchanged, and authenticates
+// every event after that, so a frame can't be forged, altered, replayed
+// or dropped without the link failing. Events are not encrypted; run the
+// mesh over a private network if their contents matter. Nodes missing
+// from secrets are turned away. It must be called before Start.
+func (m *Mesh) WithAuth(secrets map[string]string) *Mesh {
+	m.secrets = make(map[string][]byte, len(secrets))
+	for node, secret := range secrets {
+		m.secrets[node] = []byte(secret)
+	}
+	return m
+}
+
+// Start listens for peers and starts dialing them in the background.
+func (m *Mesh) Start() error {
+	ln, err := net.Listen("tcp", m.listenAddr)
+	if err != nil {
+		return fmt.Errorf("bus: listen %s: %v", m.listenAddr, err)
+	}
+	m.listener = ln
+
+	log.Info("bus: node %s listening on %s", m.id, ln.Addr())
+
+	m.wg.Add(1)
+	go m.acceptLoop()
+
+	for _, addr := range m.peers {
+		m.wg.Add(1)
+		go m.dialLoop(addr)
+	}
+
+	return nil
+}
+
+func (m *Mesh) NodeID() string {
+	return m.id
+}
+
+func (m *Mesh) Broadcast(ev Event) error {
+	m.linksMu.Lock()
+	links := make([]*link, 0, len(m.links))
+	for _, l := range m.links {
+		links = append(links, l)
+	}
+	m.linksMu.Unlock()
+
+	var errs []error
+	for _, l := range links {
+		if err := m.send(l, ev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m *Mesh) Send(nodeID string, ev Event) error {
+	m.linksMu.Lock()
+	l, ok := m.links[nodeID]
+	m.linksMu.Unlock()
+
+	if !ok {
+		return ErrUnknownNode
+	}
+
+	return m.send(l, ev)
+}
+
+func (m *Mesh) Events() <-chan Event {
+	return m.events
+}
+
+func (m *Mesh) Close() error {
+	m.cancel()
+
+	var err error
+	if m.listener != nil {
+		err = m.listener.Close()
+	}
+
+	m.wg.Wait()
+
+	return err
+}
+
+func (m *Mesh) send(l *link, ev Event) error {
+	ev.From = m.id
+
+	data, err := yaml.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("bus: encode %s: %v", ev.Kind, err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.key != nil {
+		data = append(data, frameMAC(l.key, l.seq, data)...)
+		l.seq++
+	}
+
+	l.conn.SetWriteDeadline(time.Now().Add(SendTimeout))
+	if err := writeFrame(l.writer, data); err != nil {
+		// The dial loop notices the broken link and reconnects.
+		l.conn.Close()
+		return fmt.Errorf("bus: send to %s: %v", l.nodeID, err)
+	}
+
+	return nil
+}
+
+// dialLoop keeps a link to the peer at addr open until the mesh closes.
+func (m *Mesh) dialLoop(addr string) {
+	defer m.wg.Done()
+
+	for m.ctx.Err() == nil {
+		if err := m.dial(addr); err != nil {
+			log.Debug("bus: peer %s: %v", addr, err)
+		}
+
+		select {
+		case <-m.ctx.Done():
+		case <-time.After(DialRetryInterval):
+		}
+	}
+}
+
+func (m *Mesh) dial(addr string) error {
+	dialer := net.Dialer{Timeout: HandshakeTimeout}
+	conn, err := dialer.DialContext(m.ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(m.ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	peer, key, err := m.handshake(reader, writer, true)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if peer.Node == m.id {
+		return fmt.Errorf("dialed ourselves")
+	}
+
+	l := &link{nodeID: peer.Node, conn: conn, writer: writer, key: key}
+
+	m.linksMu.Lock()
+	if old, ok := m.links[peer.Node]; ok {
+		old.conn.Close()
+	}
+	m.links[peer.Node] = l
+	m.linksMu.Unlock()
+
+	log.Info("bus: linked to node %s (%s)", peer.Node, addr)
+	m.emit(Event{Kind: PeerUpEvent, From: peer.Node})
+
+	// Nothing is sent back on this connection; reading only tells us
+	// when it goes away.
+	io.Copy(io.Discard, reader)
+
+	m.linksMu.Lock()
+	if m.links[peer.Node] == l {
+		delete(m.links, peer.Node)
+	}
+	m.linksMu.Unlock()
+
+	log.Warn("bus: lost link to node %s (%s)", peer.Node, addr)
+	m.emit(Event{Kind: PeerDownEvent, From: peer.Node})
+
+	return nil
+}
+
+func (m *Mesh) acceptLoop() {
+	defer m.wg.Done()
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			if m.ctx.Err() == nil {
+				log.Error("bus: accept: %v", err)
+			}
+			return
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			if err := m.serve(conn); err != nil {
+				log.Warn("bus: %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// serve reads events from a peer that dialed us.
+func (m *Mesh) serve(conn net.Conn) error {
+	defer conn.Close()
+
+	stop := context.AfterFunc(m.ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	peer, key, err := m.handshake(reader, writer, false)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	for seq := uint64(0); ; seq++ {
+		data, err := readFrame(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || m.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if key != nil {
+			if len(data) < sha256.Size {
+				return fmt.Errorf("frame %d from %s is missing its MAC", seq, peer.Node)
+			}
+			var mac []byte
+			data, mac = data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+			if !hmac.Equal(mac, frameMAC(key, seq, data)) {
+				return fmt.Errorf("frame %d from %s failed authentication", seq, peer.Node)
+			}
+		}
+
+		var ev Event
+		if err := yaml.Unmarshal(data, &ev); err != nil {
+			return fmt.Errorf("decode event from %s: %v", peer.Node, err)
+		}
+		ev.From = peer.Node
+
+		m.emit(ev)
+	}
+}
+
+func (m *Mesh) emit(ev Event) {
+	select {
+	case m.events <- ev:
+	case <-m.ctx.Done():
+	}
+}
+
+// handshake swaps node IDs with the other end of a new connection. With
+// auth on, each end then sends an HMAC of the other's nonce and its own
+// node ID, keyed with their shared secret. Both ends run the same steps,
+// so it doesn't matter who dialed, and both come away with the key for
+// the frames the dialer sends.
+func (m *Mesh) handshake(reader *bufio.Reader, writer *bufio.Writer, dialed bool) (hello, []byte, error) {
+	var peer hello
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return peer, nil, err
+	}
+	ours := hello{Node: m.id, Nonce: hex.EncodeToString(nonce)}
+
+	if err := writeYAMLFrame(writer, ours); err != nil {
+		return peer, nil, fmt.Errorf("handshake: %v", err)
+	}
+
+	if err := readYAMLFrame(reader, &peer); err != nil || peer.Node == "" {
+		return peer, nil, fmt.Errorf("handshake: bad hello")
+	}
+
+	if m.secrets == nil {
+		return peer, nil, nil
+	}
+
+	secret, ok := m.secrets[peer.Node]
+	if !ok {
+		return peer, nil, fmt.Errorf("handshake: unknown node %s", peer.Node)
+	}
+
+	if err := writeYAMLFrame(writer, proof{MAC: sign(secret, peer.Nonce, m.id)}); err != nil {
+		return peer, nil, fmt.Errorf("handshake: %v", err)
+	}
+
+	var theirs proof
+	if err := readYAMLFrame(reader, &theirs); err != nil {
+		return peer, nil, fmt.Errorf("handshake: bad proof from %s", peer.Node)
+	}
+
+	expected := sign(secret, ours.Nonce, peer.Node)
+	if !hmac.Equal([]byte(theirs.MAC), []byte(expected)) {
+		return peer, nil, fmt.Errorf("handshake: %s failed authentication", peer.Node)
+	}
+
+	if dialed {
+		return peer, frameKey(secret, ours.Nonce, peer.Nonce), nil
+	}
+	return peer, frameKey(secret, peer.Nonce, ours.Nonce), nil
+}
+
+func sign(secret []byte, nonce string, nodeID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{0})
+	mac.Write([]byte(nodeID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// frameKey derives the key for one connection's frames from both of its
+// nonces, so frames recorded on one connection are no good on another.
+func frameKey(secret []byte, dialerNonce string, listenerNonce string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("frames"))
+	mac.Write([]byte{0})
+	mac.Write([]byte(dialerNonce))
+	mac.Write([]byte{0})
+	mac.Write([]byte(listenerNonce))
+	return mac.Sum(nil)
+}
+
+// frameMAC authenticates the seq'th frame sent on a connection. The
+// sequence number is never sent; the reader counts frames itself.
+func frameMAC(key []byte, seq uint64, data []byte) []byte {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], seq)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(n[:])
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func writeYAMLFrame(writer *bufio.Writer, v interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFrame(writer, data)
+}
+
+func readYAMLFrame(reader *bufio.Reader, v interface{}) error {
+	data, err := readFrame(reader)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+// Frames are a 4 byte big endian length followed by a YAML document.
+func writeFrame(writer *bufio.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+
+	if _, err := writer.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(reader, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if int(n) > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes is too big", n)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
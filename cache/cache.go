@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sweetspeak/message"
+	"sweetspeak/user"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// The key is derived from the passphrase with Argon2id, taking
+	// KeyTime passes over KeyMemory KiB on KeyThreads threads (the
+	// second recommended option of RFC 9106).
+	KeyTime    uint32 = 3
+	KeyMemory  uint32 = 64 * 1024
+	KeyThreads uint8  = 4
+	// MaxMessages is how many of each chat's latest messages are kept.
+	MaxMessages = 5000
+
+	ErrBadPassphrase = errors.New("cache: wrong passphrase or corrupted cache")
+)
+
+const (
+	// The version in magic changes with the file format or the KDF.
+	magic    = "SWSC2"
+	saltSize = 16
+	keySize  = 32
+)
+
+type (
+	// Cache keeps one user's chats on disk between runs, encrypted with
+	// AES-256-GCM under a key derived from their passphrase.
+	//
+	// The file is magic, salt, nonce, then the sealed YAML snapshot; it
+	// is rewritten whole on every save.
+	Cache struct {
+		path string
+		salt []byte
+		key  []byte
+	}
+
+	Snapshot struct {
+		User    user.User `yaml:"user"`
+		SavedAt time.Time `yaml:"saved_at"`
+		Chats   []Chat    `yaml:"chats"`
+		// Left lists chats the user left, whose messages are ignored.
+		Left []string `yaml:"left,omitempty"`
+	}
+
+	Chat struct {
+		ID       string                `yaml:"id"`
+		Name     string                `yaml:"name"`
+		Users    []user.User           `yaml:"users"`
+		Messages []message.TextMessage `yaml:"messages"`
+		LastRead string                `yaml:"last_read,omitempty"`
+		Muted    bool                  `yaml:"muted,omitempty"`
+	}
+)
+
+// DefaultPath is where userName's cache lives: the user cache directory,
+// or the working directory if there is none.
+func DefaultPath(userName string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = "."
+	}
+
+	return filepath.Join(dir, "sweetspeak", userName+".cache")
+}
+
+// Open prepares the cache at path. An existing cache keeps its salt, so
+// the same passphrase opens it again; Load tells if it was the wrong one.
+func Open(path string, passphrase string) (*Cache, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("cache: empty passphrase")
+	}
+
+	c := &Cache{path: path}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		c.salt = make([]byte, saltSize)
+		if _, err := rand.Read(c.salt); err != nil {
+			return nil, fmt.Errorf("cache: salt: %v", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("cache: %v", err)
+	case len(data) < len(magic)+saltSize || string(data[:len(magic)]) != magic:
+		return nil, fmt.Errorf("cache: %s is not a sweetspeak cache", path)
+	default:
+		c.salt = data[len(magic) : len(magic)+saltSize]
+	}
+
+	c.key = argon2.IDKey([]byte(passphrase), c.salt, KeyTime, KeyMemory, KeyThreads, keySize)
+
+	return c, nil
+}
+
+func (c *Cache) Path() string {
+	return c.path
+}
+
+// Load reads the snapshot back. A cache that was never saved loads as
+// nil.
+func (c *Cache) Load() (*Snapshot, error) {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cache: %v", err)
+	}
+
+	gcm, err := c.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	header := len(magic) + saltSize
+	if len(data) < header+gcm.NonceSize() {
+		return nil, ErrBadPassphrase
+	}
+
+	nonce := data[header : header+gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[header+gcm.NonceSize():], data[:header])
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	var snap Snapshot
+	if err := yaml.Unmarshal(plain, &snap); err != nil {
+		return nil, fmt.Errorf("cache: decoding %s: %v", c.path, err)
+	}
+
+	return &snap, nil
+}
+
+// Save seals snap and replaces the cache file with it.
+func (c *Cache) Save(snap *Snapshot) error {
+	for i := range snap.Chats {
+		if n := len(snap.Chats[i].Messages); n > MaxMessages {
+			snap.Chats[i].Messages = snap.Chats[i].Messages[n-MaxMessages:]
+		}
+	}
+	snap.SavedAt = time.Now()
+
+	plain, err := yaml.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("cache: encoding: %v", err)
+	}
+
+	gcm, err := c.aead()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("cache: nonce: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.Write(c.salt)
+	header := buf.Len()
+	buf.Write(nonce)
+	sealed := gcm.Seal(buf.Bytes(), nonce, plain, buf.Bytes()[:header])
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return fmt.Errorf("cache: %v", err)
+	}
+
+	if err := writeAtomic(c.path, sealed); err != nil {
+		return fmt.Errorf("cache: %v", err)
+	}
+
+	return nil
+}
+
+// writeAtomic replaces path with data through a temporary file next to
+// it, synced before the rename, so neither a crash nor another client
+// saving at the same time leaves half a cache.
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *Cache) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sweetspeak/message"
+	"testing"
+)
+
+func init() {
+	// The real work factor is far too slow for tests.
+	KeyTime, KeyMemory, KeyThreads = 1, 64, 1
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alice.cache")
+
+	c, err := Open(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := &Snapshot{
+		Chats: []Chat{{ID: "chat", Name: "general", Messages: []message.TextMessage{{ID: "1", ChatID: "chat"}}}},
+		Left:  []string{"old"},
+	}
+	if err := c.Save(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Chats) != 1 || got.Chats[0].Name != "general" || len(got.Chats[0].Messages) != 1 {
+		t.Errorf("chats = %+v", got.Chats)
+	}
+	if len(got.Left) != 1 || got.Left[0] != "old" {
+		t.Errorf("left = %v", got.Left)
+	}
+
+	c, err = Open(path, "wrong horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Load(); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("load with the wrong passphrase: %v", err)
+	}
+}
+
+func TestSaveLeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alice.cache")
+
+	c, err := Open(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := c.Save(&Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "alice.cache" {
+		t.Errorf("directory holds %v", entries)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("mode = %v", mode)
+	}
+}
@@ -1,11 +1,10 @@
 package chat
 
 import (
+	"slices"
 	"sweetspeak/message"
 	"sweetspeak/user"
 	"sync"
-
-	"github.com/charmbracelet/lipgloss"
 )
 
 type (
@@ -33,6 +32,36 @@ func (c *Chat) AddMessage(tm message.TextMessage) {
 	c.Messages = append(c.Messages, tm)
 }
 
+// Merge adds the messages the chat doesn't have yet, by ID, keeping
+// Messages in time order. It returns the ones it added.
+func (c *Chat) Merge(msgs ...message.TextMessage) []message.TextMessage {
+	c.Lock()
+	defer c.Unlock()
+
+	have := make(map[string]bool, len(c.Messages))
+	for _, m := range c.Messages {
+		have[m.ID] = true
+	}
+
+	var added []message.TextMessage
+	for _, m := range msgs {
+		if m.ID != "" && have[m.ID] {
+			continue
+		}
+		have[m.ID] = true
+		added = append(added, m)
+
+		// Almost always the newest, so look from the end.
+		i := len(c.Messages)
+		for i > 0 && c.Messages[i-1].Timestamp.After(m.Timestamp) {
+			i--
+		}
+		c.Messages = slices.Insert(c.Messages, i, m)
+	}
+
+	return added
+}
+
 func (c *Chat) GetMessages() []string {
 	c.Lock()
 	defer c.Unlock()
@@ -50,12 +79,13 @@ func (c *Chat) GetWithFormat() []string {
 	c.Lock()
 	defer c.Unlock()
 
-	var allMsg []string
+	var (
+		allMsg []string
+		r      = NewRenderer(TimeAbsolute, 0)
+	)
 
 	for _, m := range c.Messages {
-		content := m.Content
-		content = lipgloss.NewStyle().Foreground(m.From.Color).Render(m.From.Name+":") + " " + content + "\n"
-		allMsg = append(allMsg, content)
+		allMsg = append(allMsg, r.Render(m))
 	}
 
 	return allMsg
@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"sweetspeak/markdown"
+	"sweetspeak/message"
+	"sweetspeak/theme"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	// TimeAbsolute shows the clock time a message was sent, e.g. 15:04.
+	TimeAbsolute TimeFormat = iota
+	// TimeRelative shows how long ago, e.g. 5m.
+	TimeRelative
+	TimeOff
+)
+
+var (
+	// GroupWindow is how close together messages from one author must be
+	// to share a header.
+	GroupWindow = 5 * time.Minute
+
+	timeStyle      = lipgloss.NewStyle()
+	separatorStyle = lipgloss.NewStyle()
+)
+
+func init() {
+	theme.OnChange(func(t theme.Theme) {
+		timeStyle = timeStyle.Foreground(t.Meta)
+		separatorStyle = separatorStyle.Foreground(t.Rule)
+	})
+}
+
+type (
+	TimeFormat int
+
+	// Renderer renders messages one after another as a chat log: a day
+	// separator when the date changes, and one header for a run of
+	// messages from the same author.
+	Renderer struct {
+		Times TimeFormat
+		Width int
+		// Self is the reader's name, whose mentions are highlighted.
+		Self string
+		// Now is what relative times are relative to.
+		Now func() time.Time
+
+		last    *message.TextMessage
+		grouped bool
+	}
+)
+
+func NewRenderer(times TimeFormat, width int) *Renderer {
+	return &Renderer{
+		Times: times,
+		Width: width,
+		Now:   time.Now,
+	}
+}
+
+// ParseTimeFormat parses "absolute", "relative" or "off".
+func ParseTimeFormat(s string) (TimeFormat, error) {
+	switch strings.ToLower(s) {
+	case "absolute", "":
+		return TimeAbsolute, nil
+	case "relative":
+		return TimeRelative, nil
+	case "off", "none":
+		return TimeOff, nil
+	}
+
+	return TimeAbsolute, fmt.Errorf("unknown time format %q, want absolute, relative or off", s)
+}
+
+func (t TimeFormat) String() string {
+	switch t {
+	case TimeRelative:
+		return "relative"
+	case TimeOff:
+		return "off"
+	}
+	return "absolute"
+}
+
+// Render renders m after the messages rendered before it.
+func (r *Renderer) Render(m message.TextMessage) string {
+	var sb strings.Builder
+
+	newDay := r.last == nil || !sameDay(r.last.Timestamp, m.Timestamp)
+	if newDay && !m.Timestamp.IsZero() {
+		sb.WriteString(r.separator(m.Timestamp))
+		sb.WriteString("\n")
+	}
+
+	header := r.header(m)
+	if r.grouped && !newDay && r.last.From.Name == m.From.Name &&
+		m.Timestamp.Sub(r.last.Timestamp) < GroupWindow {
+		// Same author, moments later: line up under their header.
+		header = strings.Repeat(" ", lipgloss.Width(header))
+	}
+
+	sb.WriteString(markdown.Hang(header, m.Content, markdown.Options{Width: r.Width, Self: r.Self}))
+	sb.WriteString("\n")
+
+	r.last = &m
+	r.grouped = true
+
+	return sb.String()
+}
+
+// Break starts a new group, e.g. after a line that isn't a message.
+func (r *Renderer) Break() {
+	r.grouped = false
+}
+
+func (r *Renderer) header(m message.TextMessage) string {
+	name := lipgloss.NewStyle().Foreground(m.From.Color).Render(m.From.Name+":") + " "
+
+	if r.Times == TimeOff || m.Timestamp.IsZero() {
+		return name
+	}
+	return timeStyle.Render(fmt.Sprintf("%5s", r.timestamp(m.Timestamp))) + " " + name
+}
+
+func (r *Renderer) timestamp(t time.Time) string {
+	if r.Times == TimeAbsolute {
+		return t.Local().Format("15:04")
+	}
+
+	switch ago := r.Now().Sub(t); {
+	case ago < time.Minute:
+		return "now"
+	case ago < time.Hour:
+		return fmt.Sprintf("%dm", int(ago.Minutes()))
+	case ago < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(ago.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(ago.Hours()/24))
+	}
+}
+
+func (r *Renderer) separator(t time.Time) string {
+	label := " " + r.day(t) + " "
+	if r.Width <= lipgloss.Width(label)+4 {
+		return separatorStyle.Render("──" + label + "──")
+	}
+
+	left := (r.Width - lipgloss.Width(label)) / 2
+	right := r.Width - lipgloss.Width(label) - left
+	return separatorStyle.Render(strings.Repeat("─", left) + label + strings.Repeat("─", right))
+}
+
+func (r *Renderer) day(t time.Time) string {
+	now := r.Now().Local()
+	t = t.Local()
+
+	switch {
+	case sameDay(t, now):
+		return "Today"
+	case sameDay(t, now.AddDate(0, 0, -1)):
+		return "Yesterday"
+	case t.Year() == now.Year():
+		return t.Format("Monday, January 2")
+	}
+	return t.Format("Monday, January 2 2006")
+}
+
+func sameDay(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return true
+	}
+
+	a, b = a.Local(), b.Local()
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
@@ -1,7 +1,16 @@
 package chatpanel
 
 import (
-	"github.com/charmbracelet/bubbles/textinput"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sweetspeak/chat"
+	"sweetspeak/message"
+	"sweetspeak/theme"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -10,39 +19,86 @@ import (
 var (
 	titleStyle = lipgloss.NewStyle().
 			Bold(true).
-			Align(lipgloss.Center).
-			Foreground(lipgloss.Color("#FAFAFA"))
-	chatStyle = lipgloss.NewStyle().Align(lipgloss.Bottom)
+			Align(lipgloss.Center)
+	chatStyle   = lipgloss.NewStyle().Align(lipgloss.Bottom)
+	systemStyle = lipgloss.NewStyle()
+	hintStyle   = lipgloss.NewStyle().Italic(true)
+
+	// MaxComposerHeight is how tall the composer grows before it scrolls.
+	MaxComposerHeight = 8
+	// MaxComposerLength keeps a message well inside the server's frame
+	// limit.
+	MaxComposerLength = 32 * 1024
+
+	sendKey    = key.NewBinding(key.WithKeys("enter"))
+	newlineKey = key.NewBinding(key.WithKeys("alt+enter", "shift+enter", "ctrl+j"))
+	editorKey  = key.NewBinding(key.WithKeys("ctrl+o"))
 )
 
+func init() {
+	theme.OnChange(func(t theme.Theme) {
+		titleStyle = titleStyle.Foreground(t.Title)
+		systemStyle = systemStyle.Foreground(t.Subtle)
+		hintStyle = hintStyle.Foreground(t.Subtle)
+	})
+}
+
 type (
 	Model struct {
-		titleText   string
-		chatText    string
-		viewport    viewport.Model
-		chatInput   textinput.Model
-		height      int
-		width       int
-		focused     bool
-		chatInputCh chan string
+		titleText string
+		// entries are what the viewport shows; chatText is them rendered
+		// at the current width.
+		entries  []entry
+		chatText string
+		// offsets is the line each entry starts on; lines is the total.
+		offsets   []int
+		lines     int
+		times     chat.TimeFormat
+		self      string
+		log       *chat.Renderer
+		viewport  viewport.Model
+		chatInput textarea.Model
+		height    int
+		width     int
+		focused   bool
+		// completer tab completes the input; hint shows the candidates
+		// when the completion is ambiguous.
+		completer CompleteFunc
+		hint      string
+	}
+
+	// entry is a chat message or, when message is nil, a line of text.
+	entry struct {
+		message *message.TextMessage
+		text    string
+		system  bool
 	}
+
+	// CompleteFunc returns the completed input and, if still ambiguous,
+	// the candidates.
+	CompleteFunc func(input string) (string, []string)
 )
 
-func New(title string, width, height int, chatInputCh chan string) Model {
+func New(title string, width, height int) Model {
 	m := Model{
 		titleText: title,
-		chatText:  "Hello world...",
 		viewport:  viewport.New(width, height),
-		chatInput: textinput.New(),
+		chatInput: textarea.New(),
 		height:    height,
 		width:     width,
-		chatInputCh: chatInputCh,
 	}
 
-	m.viewport.SetContent(m.chatText)
+	m.reset(entry{text: "Hello world..."})
 
-	m.chatInput.Placeholder = "Say hello..."
+	m.chatInput.Placeholder = "Say hello... (alt+enter for a new line, ctrl+o for $EDITOR)"
 	m.chatInput.Cursor.Blink = false
+	m.chatInput.Prompt = ""
+	m.chatInput.ShowLineNumbers = false
+	m.chatInput.CharLimit = MaxComposerLength
+	m.chatInput.MaxHeight = 0
+	m.chatInput.KeyMap.InsertNewline = newlineKey
+	m.chatInput.FocusedStyle.CursorLine = lipgloss.NewStyle()
+	m.chatInput.SetHeight(1)
 
 	return m
 }
@@ -52,6 +108,27 @@ func (m *Model) SetTitle(title string) *Model {
 	return m
 }
 
+func (m *Model) WithCompleter(completer CompleteFunc) *Model {
+	m.completer = completer
+	return m
+}
+
+// WithTimeFormat sets how message times are shown.
+func (m *Model) WithTimeFormat(times chat.TimeFormat) *Model {
+	m.times = times
+	m.reset(m.entries...)
+	return m
+}
+
+// WithSelf sets the reader's name, so mentions of them stand out.
+func (m *Model) WithSelf(name string) *Model {
+	if name != m.self {
+		m.self = name
+		m.reset(m.entries...)
+	}
+	return m
+}
+
 func (m *Model) SetHeight(height int) *Model {
 	m.height = height
 	return m
@@ -88,32 +165,76 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
-		switch msg.Type {
-		case tea.KeyEsc:
+		m.hint = ""
+
+		switch {
+		case msg.Type == tea.KeyTab:
+			if m.chatInput.Focused() && m.completer != nil {
+				value, options := m.completer(m.chatInput.Value())
+				m.chatInput.SetValue(value)
+				m.chatInput.CursorEnd()
+				m.hint = strings.Join(options, "  ")
+				m.resize()
+			}
+			// The input has no use for a tab.
+			return m, nil
+		case msg.Type == tea.KeyEsc:
 			m.chatInput.Blur()
-		case tea.KeyEnter:
+		case key.Matches(msg, sendKey):
 			if !m.chatInput.Focused() {
 				m.chatInput.Focus()
-			} else {
-				msgText := m.chatInput.Value()
-				// Send the text on a message channel I suppose
-				m.chatInputCh <- msgText
+			} else if msgText := strings.TrimRight(m.chatInput.Value(), " \n"); msgText != "" {
+				cmds = append(cmds, sendCmd(msgText))
 				m.chatInput.Reset()
+				m.resize()
 			}
+			// Enter never reaches the composer, it has its own newline
+			// keys.
+			return m, tea.Batch(cmds...)
+		case key.Matches(msg, editorKey) && m.chatInput.Focused():
+			return m, m.openEditor()
 		}
+	case EditorMsg:
+		m.chatInput.Focus()
+		m.chatInput.SetValue(msg.Content)
+		m.resize()
 	case tea.WindowSizeMsg:
 		m.viewport = viewport.New(m.width, m.height-1)
-		m.viewport.SetContent(m.chatText)
-
-		m.chatInput.Width = m.width - 5
+		m.chatInput.SetWidth(m.width)
+		m.resize()
+		// Messages wrap to the panel, so a new width means rendering
+		// them all again.
+		m.reset(m.entries...)
 
 		titleStyle = titleStyle.Width(m.width)
 	case ChatTextMsg:
 		if msg.String() == "" {
 			break
 		}
-		m.chatText = msg.String()
-		m.viewport.SetContent(m.chatText)
+		m.reset(entry{text: msg.String()})
+	case ChatOpenedMsg:
+		m.reset()
+	case ChatMessageMsg:
+		m.add(entry{message: &msg.Message})
+	case ShowChatMsg:
+		m.titleText = msg.Title
+
+		entries := make([]entry, len(msg.Messages))
+		for i := range msg.Messages {
+			entries[i] = entry{message: &msg.Messages[i]}
+		}
+		m.reset(entries...)
+	case SystemMsg:
+		m.add(entry{text: msg.Text, system: true})
+	case ClearMsg:
+		m.reset()
+	case JumpMsg:
+		if !m.jump(msg.MessageID) {
+			m.add(entry{text: "that message isn't in this chat's history yet", system: true})
+		}
+	case RefreshMsg:
+		// Relative times and "Today" go stale.
+		m.reset(m.entries...)
 	}
 
 	m.viewport, cmd = m.viewport.Update(msg)
@@ -123,18 +244,154 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 		var cmd tea.Cmd
 		m.chatInput, cmd = m.chatInput.Update(msg)
 		cmds = append(cmds, cmd)
+
+		if _, ok := msg.(tea.KeyMsg); ok {
+			m.resize()
+		}
 	}
 
 	return m, tea.Batch(cmds...)
 }
 
+// resize grows the composer with its content, up to MaxComposerHeight,
+// and gives the rest of the panel to the viewport.
+func (m *Model) resize() {
+	width := max(m.chatInput.Width(), 1)
+
+	rows := 0
+	for _, line := range strings.Split(m.chatInput.Value(), "\n") {
+		rows += 1 + lipgloss.Width(line)/width
+	}
+	rows = min(max(rows, 1), MaxComposerHeight)
+	m.chatInput.SetHeight(rows)
+
+	height := m.height - rows
+	if m.hint != "" {
+		height--
+	}
+
+	atBottom := m.viewport.AtBottom()
+	m.viewport.Height = max(height, 1)
+	if atBottom {
+		m.viewport.GotoBottom()
+	}
+}
+
+// openEditor hands the composer's text to $VISUAL or $EDITOR and puts
+// what comes back into the composer, ready to send.
+func (m Model) openEditor() tea.Cmd {
+	f, err := os.CreateTemp("", "sweetspeak-*.md")
+	if err != nil {
+		return systemCmd(fmt.Sprintf("editor: %v", err))
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(m.chatInput.Value()); err != nil {
+		os.Remove(f.Name())
+		return systemCmd(fmt.Sprintf("editor: %v", err))
+	}
+
+	editor := strings.Fields(os.Getenv("VISUAL"))
+	if len(editor) == 0 {
+		editor = strings.Fields(os.Getenv("EDITOR"))
+	}
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+
+	name := f.Name()
+	c := exec.Command(editor[0], append(editor[1:], name)...)
+
+	return tea.ExecProcess(c, func(err error) tea.Msg {
+		defer os.Remove(name)
+
+		if err != nil {
+			return SystemMsg{Text: fmt.Sprintf("editor: %v", err)}
+		}
+
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return SystemMsg{Text: fmt.Sprintf("editor: %v", err)}
+		}
+
+		return EditorMsg{Content: strings.TrimRight(string(content), "\n")}
+	})
+}
+
+// add renders e onto the end of the chat.
+func (m *Model) add(e entry) {
+	m.entries = append(m.entries, e)
+	m.write(e)
+
+	m.viewport.SetContent(m.chatText)
+	m.viewport.GotoBottom()
+}
+
+// reset replaces the chat with entries.
+func (m *Model) reset(entries ...entry) {
+	m.entries = entries
+	m.log = chat.NewRenderer(m.times, m.width)
+	m.log.Self = m.self
+	m.chatText = ""
+	m.offsets, m.lines = nil, 0
+	for _, e := range entries {
+		m.write(e)
+	}
+
+	m.viewport.SetContent(m.chatText)
+	m.viewport.GotoBottom()
+}
+
+// write renders e onto chatText, remembering where it starts.
+func (m *Model) write(e entry) {
+	text := m.render(e)
+
+	m.offsets = append(m.offsets, m.lines)
+	m.chatText += text
+	m.lines += strings.Count(text, "\n")
+}
+
+// jump scrolls to the message with messageID, reporting whether it is
+// in the chat.
+func (m *Model) jump(messageID string) bool {
+	for i, e := range m.entries {
+		if e.message != nil && e.message.ID == messageID {
+			m.viewport.SetYOffset(m.offsets[i])
+			return true
+		}
+	}
+	return false
+}
+
+func (m Model) render(e entry) string {
+	switch {
+	case e.message != nil:
+		return m.log.Render(*e.message)
+	case e.system:
+		m.log.Break()
+		return systemStyle.Render(e.text) + "\n"
+	}
+
+	// Every entry ends its last line, or the next one would start on it
+	// and the offsets after it would be off by one.
+	m.log.Break()
+	if !strings.HasSuffix(e.text, "\n") {
+		return e.text + "\n"
+	}
+	return e.text
+}
+
 func (m Model) View() string {
-	return lipgloss.JoinVertical(
-		lipgloss.Top,
+	views := []string{
 		titleStyle.Render(m.titleText),
 		m.viewport.View(),
 		chatStyle.Render(m.chatInput.View()),
-	)
+	}
+	if m.hint != "" {
+		views = append(views, hintStyle.Render(m.hint))
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Top, views...)
 }
 
 type (
@@ -142,6 +399,45 @@ type (
 		Content string
 	}
 
+	ChatOpenedMsg struct {
+		ChatID string
+	}
+
+	ChatMessageMsg struct {
+		Message message.TextMessage
+	}
+
+	// ShowChatMsg replaces the view with another chat's history.
+	ShowChatMsg struct {
+		Title    string
+		Messages []message.TextMessage
+	}
+
+	// SystemMsg is a line from the client itself, not from a chat.
+	SystemMsg struct {
+		Text string
+	}
+
+	ClearMsg struct{}
+
+	// JumpMsg scrolls the chat to a message.
+	JumpMsg struct {
+		MessageID string
+	}
+
+	// RefreshMsg re-renders the chat, keeping times current.
+	RefreshMsg struct{}
+
+	// EditorMsg carries the text back from the external editor.
+	EditorMsg struct {
+		Content string
+	}
+
+	// SendMsg asks the parent model to send what the user typed.
+	SendMsg struct {
+		Content string
+	}
+
 	ErrMsg struct {
 		err error
 	}
@@ -153,6 +449,18 @@ func NewChatTextMsg(content string) ChatTextMsg {
 	}
 }
 
+func sendCmd(content string) tea.Cmd {
+	return func() tea.Msg {
+		return SendMsg{Content: content}
+	}
+}
+
+func systemCmd(text string) tea.Cmd {
+	return func() tea.Msg {
+		return SystemMsg{Text: text}
+	}
+}
+
 func (c ChatTextMsg) String() string {
 	return c.Content
 }
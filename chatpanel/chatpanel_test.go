@@ -0,0 +1,36 @@
+package chatpanel
+
+import (
+	"fmt"
+	"strings"
+	"sweetspeak/message"
+	"sweetspeak/user"
+	"testing"
+)
+
+func TestJumpAfterPlainText(t *testing.T) {
+	m := New("chat", 40, 2)
+	m, _ = m.Update(ChatTextMsg{Content: "welcome\nto the chat"})
+
+	var ids []string
+	for i := range 5 {
+		tm := message.TextMessage{
+			ID:      fmt.Sprintf("msg-%d", i),
+			From:    *user.New("alice", "1"),
+			Content: fmt.Sprintf("message %d", i),
+		}
+		ids = append(ids, tm.ID)
+		m, _ = m.Update(ChatMessageMsg{Message: tm})
+	}
+
+	lines := strings.Split(m.chatText, "\n")
+	for i, id := range ids {
+		m, _ = m.Update(JumpMsg{MessageID: id})
+
+		// The message starts a line of its own.
+		top := lines[m.viewport.YOffset]
+		if !strings.Contains(top, fmt.Sprintf("message %d", i)) || strings.Contains(top, "to the chat") {
+			t.Fatalf("jump to %s shows %q at the top", id, top)
+		}
+	}
+}
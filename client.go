@@ -1,16 +1,29 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sweetspeak/cache"
+	"sweetspeak/chat"
 	"sweetspeak/chatpanel"
 	"sweetspeak/client"
+	"sweetspeak/commands"
 	log "sweetspeak/logging"
+	"sweetspeak/message"
+	"sweetspeak/notify"
+	"sweetspeak/searchpanel"
+	"sweetspeak/theme"
 	"sweetspeak/user"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/term"
 	"github.com/google/uuid"
 )
 
@@ -22,37 +35,80 @@ const (
 )
 
 var (
+	chatWith  = flag.String("with", "", "open a chat with this user once connected")
+	chatTimes = flag.String("times", "absolute", "message times: absolute, relative or off")
+	notifyBy  = flag.String("notify", "bell,osc9", "how to announce messages in other chats: bell, osc9, osc777, off")
+	cacheDir  = flag.String("cache-dir", "", "where to keep the encrypted message cache (default: the user cache directory)")
+	noCache   = flag.Bool("no-cache", false, "don't keep chats between runs")
+	themeName = flag.String("theme", "dark", "color theme: dark, light, high-contrast or a YAML theme file")
+	domain    = flag.String("domain", "", "your server's federation domain, so @you@domain mentions are recognized")
+
+	// passphraseEnv, if set, unlocks the cache without a prompt.
+	passphraseEnv = "SWEETSPEAK_PASSPHRASE"
+
 	mainUpdatePeriod = 10 * time.Millisecond
+	// chatRefreshPeriod keeps relative times in the chat current.
+	chatRefreshPeriod = time.Minute
 
-	focusColor   = lipgloss.Color("69")
-	unfocusColor = lipgloss.Color("241")
+	// Colors come from the theme, see setTheme.
+	focusColor   lipgloss.Color
+	unfocusColor lipgloss.Color
 
 	sidePanelStyle = lipgloss.NewStyle().
 			Align(lipgloss.Center, lipgloss.Center).
-			BorderStyle(lipgloss.ThickBorder()).
-			BorderForeground(lipgloss.Color("#FAFAFA"))
+			BorderStyle(lipgloss.ThickBorder())
 	chatPanelStyle = lipgloss.NewStyle().
 			Align(lipgloss.Center, lipgloss.Center).
-			BorderStyle(lipgloss.ThickBorder()).
-			BorderForeground(lipgloss.Color("#FAFAFA"))
+			BorderStyle(lipgloss.ThickBorder())
 
-	helpStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+	helpStyle   = lipgloss.NewStyle()
 	statusStyle = lipgloss.NewStyle().
 			Align(lipgloss.Left)
 
-	serverStatusConnected = statusStyle.Foreground(lipgloss.Color("10")).Render("CONNECTED\n")
-	serverStatusPending   = statusStyle.Foreground(lipgloss.Color("8")).Render("PENDING - connecting to server\n")
+	serverStatusConnected = statusStyle
+	serverStatusPending   string
+	serverNoticeStyle     = statusStyle
+
+	activeChatStyle   = lipgloss.NewStyle().Bold(true)
+	mutedChatStyle    = lipgloss.NewStyle().Faint(true)
+	unreadStyle       = lipgloss.NewStyle().Bold(true)
+	mentionBadgeStyle = lipgloss.NewStyle().Bold(true)
 )
 
+func init() {
+	theme.OnChange(setTheme)
+}
+
+func setTheme(t theme.Theme) {
+	focusColor, unfocusColor = t.Accent, t.Unfocused
+
+	helpStyle = helpStyle.Foreground(t.Subtle)
+
+	serverStatusConnected = serverStatusConnected.Foreground(t.Success)
+	serverStatusPending = statusStyle.Foreground(t.Dim).Render("PENDING - connecting to server\n")
+	serverNoticeStyle = serverNoticeStyle.Foreground(t.Warning)
+
+	activeChatStyle = activeChatStyle.Foreground(t.Accent)
+	unreadStyle = unreadStyle.Foreground(t.BadgeText).Background(t.Badge)
+	mentionBadgeStyle = mentionBadgeStyle.Foreground(t.HighlightText).Background(t.Highlight)
+}
+
 type (
 	MainDisplay struct {
 		state            sessionState
-		sideText         string
 		index            int
 		ready            bool
 		ChatPanel        chatpanel.Model
+		search           searchpanel.Model
+		searching        bool
 		client           *client.Client
+		commands         *commands.Registry
+		notifier         *notify.Notifier
+		activeChat       string
 		serverStatusView string
+		noticeView       string
+		// windowFocused is false while the terminal is in the background.
+		windowFocused bool
 	}
 
 	SideDisplay struct {
@@ -65,29 +121,178 @@ type (
 	}
 )
 
-func newMainDisplay(clientUser *user.User) MainDisplay {
-	var (
-		chatInputCh = make(chan string)
-		m           = MainDisplay{
-			sideText: "this is the side view :P",
-			ChatPanel: chatpanel.New(
-				fmt.Sprintf("%s's Chat", clientUser.Name),
-				chatPanelStyle.GetWidth(),
-				chatPanelStyle.GetHeight(),
-				chatInputCh,
-			),
-			client: client.New(
-				uuid.NewString(),
-				clientUser,
-				nil,
-				chatInputCh,
-			),
+func newMainDisplay(clientUser *user.User, times chat.TimeFormat, notifier *notify.Notifier, store *cache.Cache) (MainDisplay, error) {
+	c := client.New(uuid.NewString(), clientUser).WithDomain(*domain)
+	if store != nil {
+		if err := c.WithCache(store).LoadCache(); err != nil {
+			return MainDisplay{}, err
 		}
-	)
+	}
+
+	m := MainDisplay{
+		ChatPanel: chatpanel.New(
+			fmt.Sprintf("%s's Chat", clientUser.Name),
+			chatPanelStyle.GetWidth(),
+			chatPanelStyle.GetHeight(),
+		),
+		client:        c,
+		commands:      commands.Builtins(c),
+		notifier:      notifier,
+		windowFocused: true,
+	}
+
+	m.ChatPanel.WithTimeFormat(times)
+	m.search = searchpanel.New(m.searchHits)
+
+	m.ChatPanel.WithSelf(c.Address())
+	m.ChatPanel.WithCompleter(func(input string) (string, []string) {
+		return m.commands.Complete(input, m.knownUsers())
+	})
+
+	go m.connect()
+
+	return m, nil
+}
+
+func (m MainDisplay) connect() {
+	if err := m.client.Start(); err != nil {
+		log.Error("giving up on the server: %v", err)
+		return
+	}
+
+	if *chatWith != "" {
+		log.Info("connection succeeded, sending chat request to %s", *chatWith)
+		if _, err := m.client.OpenChat(context.Background(), *chatWith); err != nil {
+			log.Error("chat with %s: %v", *chatWith, err)
+		}
+	}
+}
+
+// sendCmd sends what the user typed to the active chat off the update
+// loop.
+func (m MainDisplay) sendCmd(content string) tea.Cmd {
+	chatID := m.activeChat
+	return func() tea.Msg {
+		if chatID == "" {
+			return client.NoticeEvent{Notice: message.NoticeMessage{Text: "no chat open yet"}}
+		}
+
+		if err := m.client.Send(chatID, content); err != nil {
+			log.Error("send: %v", err)
+			return client.NoticeEvent{Notice: message.NoticeMessage{Text: err.Error()}}
+		}
+		return nil
+	}
+}
+
+// knownUsers are the other users in the focused chat, or in all our
+// chats when none is, for tab completion.
+func (m MainDisplay) knownUsers() []string {
+	self := m.client.Self().Name
+	seen := make(map[string]bool)
 
-	go m.client.Start()
+	chats := m.client.Chats()
+	if ch := m.client.Chat(m.client.Focused()); ch != nil {
+		chats = []*chat.Chat{ch}
+	}
+
+	for _, ch := range chats {
+		ch.Lock()
+		for _, u := range ch.Users {
+			if u.Name != self {
+				seen[u.Name] = true
+			}
+		}
+		ch.Unlock()
+	}
+
+	users := make([]string, 0, len(seen))
+	for name := range seen {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+
+	return users
+}
+
+// searchHits searches our chats here and on the server for the search
+// panel.
+func (m MainDisplay) searchHits(query string) ([]searchpanel.Hit, error) {
+	found, err := m.client.SearchAll(context.Background(), query, "")
+
+	hits := make([]searchpanel.Hit, 0, len(found))
+	for _, tm := range found {
+		name := "chat " + tm.ChatID
+		if ch := m.client.Chat(tm.ChatID); ch != nil {
+			name = ch.Name
+		}
+		hits = append(hits, searchpanel.Hit{Message: tm, Chat: name})
+	}
+
+	return hits, err
+}
+
+// notifyCmd tells the user about tm, which arrived somewhere they
+// aren't looking.
+func (m MainDisplay) notifyCmd(ev client.TextMessageEvent) tea.Cmd {
+	tm := ev.Message
+
+	title := "sweetspeak"
+	if ch := m.client.Chat(tm.ChatID); ch != nil {
+		title = ch.Name
+	}
+	if ev.Mention {
+		title = tm.From.Name + " mentioned you in " + title
+	}
+	body := tm.From.Name + ": " + tm.Content
+
+	return func() tea.Msg {
+		if err := m.notifier.Notify(title, body); err != nil {
+			log.Error("notify: %v", err)
+		}
+		return nil
+	}
+}
+
+// showMentions shows the mentions inbox: every message naming us, from
+// every chat, labelled with the chat it was in.
+func (m MainDisplay) showMentions(cmds []tea.Cmd) (MainDisplay, []tea.Cmd) {
+	m.activeChat = ""
+	m.client.Focus("")
+
+	mentions := m.client.Mentions()
+	for i, tm := range mentions {
+		if ch := m.client.Chat(tm.ChatID); ch != nil {
+			mentions[i].Content = "_in " + ch.Name + "_\n" + tm.Content
+		}
+	}
+
+	m.ChatPanel.WithSelf(m.client.Address())
+	m, cmds = m.UpdateChatPanel(chatpanel.ShowChatMsg{Title: "Mentions", Messages: mentions}, cmds)
+	if len(mentions) == 0 {
+		m, cmds = m.UpdateChatPanel(chatpanel.SystemMsg{Text: "nobody has mentioned you yet"}, cmds)
+	}
+
+	return m, cmds
+}
+
+// showChat makes chatID the active chat and shows its history.
+func (m MainDisplay) showChat(chatID string, cmds []tea.Cmd) (MainDisplay, []tea.Cmd) {
+	m.activeChat = chatID
+	if m.windowFocused {
+		m.client.Focus(chatID)
+	}
+	m.ChatPanel.WithSelf(m.client.Address())
+
+	show := chatpanel.ShowChatMsg{Title: fmt.Sprintf("%s's Chat", m.client.Self().Name)}
+	if ch := m.client.Chat(chatID); ch != nil {
+		ch.Lock()
+		show.Title = ch.Name
+		show.Messages = append(show.Messages, ch.Messages...)
+		ch.Unlock()
+	}
 
-	return m
+	return m.UpdateChatPanel(show, cmds)
 }
 
 func (m MainDisplay) tickEvery() tea.Cmd {
@@ -96,16 +301,31 @@ func (m MainDisplay) tickEvery() tea.Cmd {
 	})
 }
 
-func (m MainDisplay) checkChatUpdateEvery() tea.Cmd {
-	return tea.Every(time.Second, func(t time.Time) tea.Msg {
-		return m.CheckChatText(t)
+// forwardClientEvents hands every client event to the bubbletea program
+// as it happens, so Update never has to poll the client.
+func (m MainDisplay) forwardClientEvents(p *tea.Program) {
+	for ev := range m.client.Events() {
+		p.Send(ev)
+	}
+}
+
+func refreshChatEvery() tea.Cmd {
+	return tea.Every(chatRefreshPeriod, func(time.Time) tea.Msg {
+		return chatpanel.RefreshMsg{}
 	})
 }
 
 func (m MainDisplay) Init() tea.Cmd {
 	cmds := []tea.Cmd{
 		m.tickEvery(),
-		m.checkChatUpdateEvery(),
+		refreshChatEvery(),
+	}
+
+	// Chats from the cache are there before we connect.
+	if chats := m.client.Chats(); len(chats) > 0 {
+		cmds = append(cmds, func() tea.Msg {
+			return commands.ActivateChatMsg{ChatID: chats[0].ID}
+		})
 	}
 
 	return tea.Batch(cmds...)
@@ -115,17 +335,33 @@ func (m MainDisplay) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if m.searching && msg.String() != "ctrl+c" {
+			var cmd tea.Cmd
+			m.search, cmd = m.search.Update(msg)
+			cmds = append(cmds, cmd)
+			break
+		}
+
 		switch msg.String() {
 		case "ctrl+c":
 			return m, tea.Quit
+		case "ctrl+f":
+			var cmd tea.Cmd
+			m.search, cmd = m.search.Open()
+			m.searching = true
+			cmds = append(cmds, cmd)
 		case "q":
 			if !m.ChatPanel.Focused() {
 				return m, tea.Quit
 			}
 		case "tab":
-			if m.state == sideView {
+			switch {
+			case m.state == sideView:
 				m.state = chatView
-			} else if !m.ChatPanel.Focused() {
+			case m.ChatPanel.Focused():
+				// Typing: tab completes commands and users.
+				m, cmds = m.UpdateChatPanel(msg, cmds)
+			default:
 				m.state = sideView
 			}
 		default:
@@ -146,16 +382,90 @@ func (m MainDisplay) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// Update the internal components too
 		m.ChatPanel.SetHeight(chatPanelStyle.GetHeight() - 1)
 		m.ChatPanel.SetWidth(chatPanelStyle.GetWidth())
+		m.search.SetSize(chatPanelStyle.GetWidth(), chatPanelStyle.GetHeight())
 
 		m, cmds = m.UpdateChatPanel(msg, cmds)
 
 		m.ready = true
-	case chatpanel.ChatTextMsg:
+	case chatpanel.SendMsg:
+		switch {
+		case strings.TrimSpace(msg.Content) == "":
+		case commands.IsCommand(msg.Content):
+			cmds = append(cmds, m.commands.Execute(msg.Content, m.activeChat))
+		default:
+			// "//text" sends "/text".
+			cmds = append(cmds, m.sendCmd(strings.TrimPrefix(msg.Content, "/")))
+		}
+	case chatpanel.SystemMsg, chatpanel.EditorMsg:
 		m, cmds = m.UpdateChatPanel(msg, cmds)
-		cmds = append(cmds, m.checkChatUpdateEvery())
+	case searchpanel.QueryMsg, searchpanel.ResultsMsg:
+		var cmd tea.Cmd
+		m.search, cmd = m.search.Update(msg)
+		cmds = append(cmds, cmd)
+	case searchpanel.CloseMsg:
+		m.searching = false
+	case searchpanel.JumpMsg:
+		m.searching = false
+		if m.client.Chat(msg.ChatID) == nil {
+			m, cmds = m.UpdateChatPanel(chatpanel.SystemMsg{Text: "that chat isn't open, /join it first"}, cmds)
+			break
+		}
+		m.state = chatView
+		m, cmds = m.showChat(msg.ChatID, cmds)
+		m, cmds = m.UpdateChatPanel(chatpanel.JumpMsg{MessageID: msg.MessageID}, cmds)
+	case chatpanel.RefreshMsg:
+		m, cmds = m.UpdateChatPanel(msg, cmds)
+		cmds = append(cmds, refreshChatEvery())
+	case commands.OutputMsg:
+		m, cmds = m.UpdateChatPanel(chatpanel.SystemMsg{Text: msg.Text}, cmds)
+	case commands.ActivateChatMsg:
+		m, cmds = m.showChat(msg.ChatID, cmds)
+	case commands.MentionsMsg:
+		m, cmds = m.showMentions(cmds)
+	case commands.ClearMsg:
+		m, cmds = m.UpdateChatPanel(chatpanel.ClearMsg{}, cmds)
+	case commands.ThemeMsg:
+		theme.Use(msg.Theme)
+		// Rendered messages keep the old colors until drawn again.
+		m, cmds = m.UpdateChatPanel(chatpanel.RefreshMsg{}, cmds)
+		m, cmds = m.UpdateChatPanel(chatpanel.SystemMsg{Text: "theme set to " + msg.Theme.Name}, cmds)
+	case client.ChatOpenedEvent:
+		if m.activeChat == "" {
+			m, cmds = m.showChat(msg.ChatID, cmds)
+		} else if ch := m.client.Chat(msg.ChatID); ch != nil {
+			m, cmds = m.UpdateChatPanel(chatpanel.SystemMsg{Text: "chat opened: " + ch.Name + ", /join to switch"}, cmds)
+		}
+	case client.ChatSyncedEvent:
+		if msg.ChatID == m.activeChat {
+			m, cmds = m.showChat(msg.ChatID, cmds)
+			m, cmds = m.UpdateChatPanel(chatpanel.SystemMsg{Text: fmt.Sprintf("%d new messages while you were away", msg.Added)}, cmds)
+		}
+	case client.TextMessageEvent:
+		if msg.Message.ChatID == m.activeChat {
+			m, cmds = m.UpdateChatPanel(chatpanel.ChatMessageMsg{Message: msg.Message}, cmds)
+		}
+		// Mentions get through even in muted chats.
+		if msg.Unread > 0 && (msg.Mention || !m.client.Muted(msg.Message.ChatID)) {
+			cmds = append(cmds, m.notifyCmd(msg))
+		}
+	case tea.FocusMsg:
+		m.windowFocused = true
+		m.client.Focus(m.activeChat)
+	case tea.BlurMsg:
+		// Messages in the active chat count as unread while we're away.
+		m.windowFocused = false
+		m.client.Focus("")
+	case client.NoticeEvent:
+		m.noticeView = serverNoticeStyle.Render(msg.Notice.Text + "\n")
+	case client.ConnectionEvent:
+		if msg.Connected {
+			m.serverStatusView = serverStatusConnected.Render("CONNECTED\n")
+		} else {
+			m.serverStatusView = serverStatusPending
+		}
 	case ServerStatusMsg:
 		if msg.Connected {
-			m.serverStatusView = serverStatusConnected
+			m.serverStatusView = serverStatusConnected.Render(fmt.Sprintf("CONNECTED - %s\n", msg.LatencyString()))
 		} else {
 			m.serverStatusView = serverStatusPending
 		}
@@ -198,49 +508,78 @@ func (m MainDisplay) View() string {
 	s += lipgloss.JoinHorizontal(
 		lipgloss.Top,
 		sidePanelStyle.Render( // Side Display
-			m.sideText,
+			m.sideView(),
 		),
 		chatPanelStyle.Render(
-			m.ChatPanel.View(),
+			m.chatView(),
 		),
 	)
 
 	s += "\n"
 	s += m.serverStatusView
+	s += m.noticeView
 
 	return s
 }
 
-func (m MainDisplay) focusedModel() string {
-	if m.state == sideView {
-		return "side"
+// chatView is the chat panel, or the search over it while searching.
+func (m MainDisplay) chatView() string {
+	if m.searching {
+		return m.search.View()
 	}
-	return "chat"
+	return m.ChatPanel.View()
 }
 
-func (m MainDisplay) CheckClientConnection(t time.Time) tea.Msg {
-	return NewServerStatusMsg(m.client.Connected)
-}
+// sideView lists the open chats, marking the active one.
+func (m MainDisplay) sideView() string {
+	chats := m.client.Chats()
+	if len(chats) == 0 {
+		return helpStyle.Render("no chats yet\n/join <user>")
+	}
+
+	lines := make([]string, 0, len(chats))
+	for _, ch := range chats {
+		var line string
+		switch {
+		case ch.ID == m.activeChat:
+			line = activeChatStyle.Render("> " + ch.Name)
+		case m.client.Muted(ch.ID):
+			line = mutedChatStyle.Render("  " + ch.Name + " (muted)")
+		default:
+			line = "  " + ch.Name
+		}
 
-func (m MainDisplay) CheckChatText(t time.Time) tea.Msg {
-	if m.client == nil {
-		return chatpanel.ChatTextMsg{}
+		if n := m.client.Unread(ch.ID); n > 0 {
+			line += " " + unreadStyle.Render(fmt.Sprintf(" %d ", n))
+		}
+		if n := m.client.UnreadMentions(ch.ID); n > 0 {
+			line += " " + mentionBadgeStyle.Render(fmt.Sprintf(" @%d ", n))
+		}
+		lines = append(lines, line)
 	}
 
-	if m.client.Chat == nil {
-		return chatpanel.ChatTextMsg{}
+	if m.activeChat == "" && len(chats) > 0 {
+		lines = append(lines, "", activeChatStyle.Render("> mentions"))
 	}
 
-	allMsg := m.client.Chat.GetWithFormat()
-	var content string
-	for _, m := range allMsg {
-		content += m
+	return strings.Join(lines, "\n")
+}
+
+func (m MainDisplay) focusedModel() string {
+	if m.state == sideView {
+		return "side"
 	}
-	return chatpanel.ChatTextMsg{Content: content}
+	return "chat"
+}
+
+func (m MainDisplay) CheckClientConnection(t time.Time) tea.Msg {
+	return NewServerStatusMsg(m.client.IsConnected(), m.client.Latency())
 }
 
 func main() {
-	if len(os.Args) < 2 {
+	flag.Parse()
+
+	if flag.NArg() < 1 {
 		log.Warn("need more args! (username)")
 		panic(0)
 	}
@@ -249,26 +588,97 @@ func main() {
 		userColor lipgloss.Color
 	)
 
-	userName = os.Args[1]
+	userName = flag.Arg(0)
 
-	if len(os.Args) < 3 {
+	if flag.NArg() < 2 {
 		userColor = lipgloss.Color("#4287f5")
 	} else {
-		userColor = lipgloss.Color(fmt.Sprintf("#%s", os.Args[2]))
+		userColor = lipgloss.Color(fmt.Sprintf("#%s", flag.Arg(1)))
 	}
 
 	clientUser := user.New(userName, userColor)
 
+	times, err := chat.ParseTimeFormat(*chatTimes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	notifier, err := notify.Parse(*notifyBy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	t, err := theme.Find(*themeName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	theme.Use(t)
+
 	log.SetGlobalFile(fmt.Sprintf("sweetspeak-client-%s.log", userName))
 	log.SetConsoleOutput(false)
 
+	store, err := openCache(userName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v (run with -no-cache to skip it)\n", err)
+		os.Exit(1)
+	}
+
 	log.Info("starting user client...")
-	p := tea.NewProgram(newMainDisplay(clientUser), tea.WithAltScreen())
-	if _, err := p.Run(); err != nil {
+	md, err := newMainDisplay(clientUser, times, notifier, store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v (run with -no-cache to skip it)\n", err)
+		os.Exit(1)
+	}
+
+	p := tea.NewProgram(md, tea.WithAltScreen(), tea.WithReportFocus())
+	go md.forwardClientEvents(p)
+	_, err = p.Run()
+	// Closing saves the cache.
+	md.client.Close()
+	if err != nil {
 		panic(err)
 	}
 }
 
+// openCache opens userName's message cache, asking for its passphrase
+// unless it is in the environment. Without a terminal to ask on, chats
+// are not cached.
+func openCache(userName string) (*cache.Cache, error) {
+	if *noCache {
+		return nil, nil
+	}
+
+	path := cache.DefaultPath(userName)
+	if *cacheDir != "" {
+		path = filepath.Join(*cacheDir, userName+".cache")
+	}
+
+	passphrase := os.Getenv(passphraseEnv)
+	if passphrase == "" {
+		if !term.IsTerminal(os.Stdin.Fd()) {
+			log.Warn("no terminal to ask for the cache passphrase on, and %s is not set: not caching", passphraseEnv)
+			return nil, nil
+		}
+
+		fmt.Fprintf(os.Stderr, "passphrase for %s: ", path)
+		secret, err := term.ReadPassword(os.Stdin.Fd())
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase: %v", err)
+		}
+		passphrase = string(secret)
+	}
+
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+
+	return cache.Open(path, passphrase)
+}
+
 type (
 	ErrMsg struct {
 		err error
@@ -276,6 +686,7 @@ type (
 
 	ServerStatusMsg struct {
 		Connected bool
+		Latency   time.Duration
 	}
 
 	ChatTextMsg struct {
@@ -283,12 +694,21 @@ type (
 	}
 )
 
-func NewServerStatusMsg(connected bool) ServerStatusMsg {
+func NewServerStatusMsg(connected bool, latency time.Duration) ServerStatusMsg {
 	return ServerStatusMsg{
 		Connected: connected,
+		Latency:   latency,
 	}
 }
 
+func (s ServerStatusMsg) LatencyString() string {
+	if s.Latency == 0 {
+		return "latency --"
+	}
+
+	return fmt.Sprintf("latency %s", s.Latency.Round(time.Millisecond))
+}
+
 func (s ServerStatusMsg) String() string {
 	return fmt.Sprintf("%t", s.Connected)
 }
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sweetspeak/cache"
+	"sweetspeak/chat"
+	log "sweetspeak/logging"
+	"sweetspeak/markdown"
+	"sweetspeak/message"
+	"time"
+)
+
+var (
+	// CacheSaveInterval is how often a changed cache is written out.
+	CacheSaveInterval = 5 * time.Second
+)
+
+// WithCache keeps the client's chats in store between runs. Call
+// LoadCache before Start to pick up where the last run left off.
+func (c *Client) WithCache(store *cache.Cache) *Client {
+	c.cache = store
+	return c
+}
+
+// LoadCache restores the chats, messages and read state saved by the
+// last run, then keeps the cache up to date until the client is closed.
+func (c *Client) LoadCache() error {
+	if c.cache == nil {
+		return nil
+	}
+
+	snap, err := c.cache.Load()
+	if err != nil {
+		return err
+	}
+
+	if snap != nil {
+		self, address := c.Self().Name, c.Address()
+
+		for _, cc := range snap.Chats {
+			ch := chat.New(cc.ID, cc.Name, cc.Users)
+			ch.Messages = cc.Messages
+			c.addChat(ch)
+
+			// What came after the last message read is unread. If that
+			// message has aged out of the cache, so has the count.
+			st := &readState{lastRead: cc.LastRead, muted: cc.Muted}
+			read := false
+			for _, tm := range cc.Messages {
+				c.index.Add(tm)
+
+				if read && tm.From.Name != self {
+					st.unread++
+					if markdown.Mentioned(tm.Content, address) {
+						st.mentions++
+					}
+				}
+				read = read || (cc.LastRead != "" && tm.ID == cc.LastRead)
+			}
+
+			c.readsMu.Lock()
+			c.reads[cc.ID] = st
+			c.readsMu.Unlock()
+		}
+
+		c.chatsMu.Lock()
+		for _, chatID := range snap.Left {
+			if _, ok := c.chats[chatID]; !ok {
+				c.left[chatID] = true
+			}
+		}
+		c.chatsMu.Unlock()
+
+		log.Info("client: loaded %d chats from %s", len(snap.Chats), c.cache.Path())
+	}
+
+	go c.saveCacheEvery(CacheSaveInterval)
+
+	return nil
+}
+
+// SaveCache writes the client's chats to its cache now.
+func (c *Client) SaveCache() error {
+	if c.cache == nil {
+		return nil
+	}
+
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.dirty.Store(false)
+
+	snap := &cache.Snapshot{User: c.Self(), Left: c.Left()}
+	for _, ch := range c.Chats() {
+		ch.Lock()
+		cc := cache.Chat{
+			ID:       ch.ID,
+			Name:     ch.Name,
+			Users:    ch.Users,
+			Messages: append([]message.TextMessage(nil), ch.Messages...),
+		}
+		ch.Unlock()
+
+		cc.LastRead, cc.Muted = c.LastRead(ch.ID), c.Muted(ch.ID)
+		snap.Chats = append(snap.Chats, cc)
+	}
+
+	if err := c.cache.Save(snap); err != nil {
+		c.dirty.Store(true)
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) saveCacheEvery(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.dirty.Load() {
+				continue
+			}
+			if err := c.SaveCache(); err != nil {
+				log.Error("client: saving cache: %v", err)
+			}
+		}
+	}
+}
+
+// changed marks the cache as needing a save.
+func (c *Client) changed() {
+	c.dirty.Store(true)
+}
+
+// Sync fetches what was said in our chats while we were away, merging it
+// into each chat after the last message we have. Servers that don't
+// serve history are left alone.
+func (c *Client) Sync(ctx context.Context) error {
+	var errs []error
+	for _, ch := range c.Chats() {
+		err := c.syncChat(ctx, ch)
+		if errors.Is(err, ErrNoHistory) {
+			log.Debug("client: not syncing, %v", err)
+			return nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("client: sync: %v", errs)
+	}
+	return nil
+}
+
+func (c *Client) syncChat(ctx context.Context, ch *chat.Chat) error {
+	ch.Lock()
+	after := ""
+	if n := len(ch.Messages); n > 0 {
+		after = ch.Messages[n-1].ID
+	}
+	ch.Unlock()
+
+	total := 0
+	for {
+		reply, err := c.Request(ctx, message.NewHistoryRequest(ch.ID, after, 0))
+		if err != nil {
+			return fmt.Errorf("%s: %v", ch.Name, err)
+		}
+		if reply.MessageType == message.NoticeMsg {
+			return ErrNoHistory
+		}
+
+		hr, err := reply.ToHistoryResult()
+		if err != nil {
+			return fmt.Errorf("%s: %v", ch.Name, err)
+		}
+
+		if len(hr.Users) > 0 {
+			ch.Lock()
+			ch.Users = hr.Users
+			ch.Unlock()
+		}
+
+		for _, tm := range ch.Merge(hr.Messages...) {
+			c.index.Add(tm)
+			c.track(tm)
+			total++
+		}
+
+		if !hr.More || len(hr.Messages) == 0 {
+			break
+		}
+		after = hr.Messages[len(hr.Messages)-1].ID
+	}
+
+	if total > 0 {
+		c.changed()
+		c.dispatch(ChatSyncedEvent{ChatID: ch.ID, Added: total})
+		log.Debug("client: synced %d messages for chat (%s)", total, ch.ID)
+	}
+
+	return nil
+}
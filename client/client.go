@@ -1,87 +1,175 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sweetspeak/cache"
 	"sweetspeak/chat"
 	"sweetspeak/consts"
 	log "sweetspeak/logging"
 	"sweetspeak/message"
+	"sweetspeak/search"
 	"sweetspeak/user"
 	"sweetspeak/websockets"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/charmbracelet/lipgloss"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 var (
 	ClientConnectRetryPeriod = 5 * time.Second
+	ClientConnectAttempts    = 5
+	RequestTimeout           = 10 * time.Second
+
+	ErrNotConnected = errors.New("client: not connected")
+	ErrUnknownChat  = errors.New("client: unknown chat")
+	ErrChatsOpen    = errors.New("client: leave every chat before changing name")
+	ErrNoHistory    = errors.New("client: the server does not serve chat history")
 )
 
 type (
+	// Client is a sweetspeak connection for one user. It has no UI of
+	// its own: the TUI, bots and integrations all drive it through
+	// Connect, OpenChat and Send, and learn what happens through
+	// callbacks or the Events channel.
 	Client struct {
 		sync.Mutex
-		ID          string
-		ws          *websockets.WebsocketHandler
-		User        *user.User
-		Connected   bool
-		Chat        *chat.Chat
-		chatInputCh chan string
+		ID   string
+		User *user.User
+		addr string
+		// domain is the federation domain of the server, if any.
+		domain string
+
+		ws        *websockets.WebsocketHandler
+		connected atomic.Bool
+		done      chan struct{}
+
+		chatsMu sync.Mutex
+		chats   map[string]*chat.Chat
+		// left holds chats we left but are still a member of on the
+		// server, whose messages are ignored.
+		left map[string]bool
+
+		pendingMu sync.Mutex
+		pending   map[string]chan message.WSMessage
+
+		readsMu sync.Mutex
+		reads   map[string]*readState
+		focused string
+
+		// index makes the messages this client has seen searchable.
+		index *search.Index
+
+		// cache, if set, keeps chats between runs; dirty is set when
+		// there is something new to save.
+		cache  *cache.Cache
+		saveMu sync.Mutex
+		dirty  atomic.Bool
+
+		handlers handlers
+		events   chan Event
+		ctx      context.Context
+		cancel   context.CancelFunc
+
+		// queued holds events for deliverEvents, which wake wakes up.
+		queueMu sync.Mutex
+		queued  []Event
+		wake    chan struct{}
 	}
 )
 
 func NewDefault() *Client {
+	return New(uuid.NewString(), user.New("anonymous", "241"))
+}
+
+func New(id string, usr *user.User) *Client {
 	c := &Client{
-		ID: uuid.NewString(),
+		ID:      id,
+		User:    usr,
+		addr:    consts.Addr,
+		done:    make(chan struct{}),
+		chats:   make(map[string]*chat.Chat),
+		left:    make(map[string]bool),
+		pending: make(map[string]chan message.WSMessage),
+		reads:   make(map[string]*readState),
+		index:   search.NewIndex(),
+		wake:    make(chan struct{}, 1),
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	go c.deliverEvents()
 
 	return c
 }
 
-func New(id string, usr *user.User, conn *websocket.Conn, chatInputCh chan string) *Client {
-	var ws *websockets.WebsocketHandler
-	ws = nil
-	if conn != nil {
-		ws = websockets.New().WithConn(conn)
-	}
-
-	c := &Client{
-		ID:          id,
-		ws:          ws,
-		User:        usr,
-		chatInputCh: chatInputCh,
-	}
+// WithAddr points the client at a server other than consts.Addr.
+func (c *Client) WithAddr(addr string) *Client {
+	c.addr = addr
+	return c
+}
 
+// WithDomain tells the client the federation domain of its server, so
+// @name@domain mentions of the user are recognized.
+func (c *Client) WithDomain(domain string) *Client {
+	c.domain = domain
 	return c
 }
 
-func (c *Client) Start() {
-	for range 5 {
-		if err := c.start(); err != nil {
-			log.Error("client connect failed: %v, retrying after %s seconds", err, ClientConnectRetryPeriod)
-			time.Sleep(ClientConnectRetryPeriod)
+// Start connects to the server, retrying up to ClientConnectAttempts
+// times. It gives up early if the client is closed.
+func (c *Client) Start() error {
+	var err error
+	for range ClientConnectAttempts {
+		if err = c.Connect(c.ctx); err == nil {
+			log.Info("connection succeeded")
+			return nil
 		}
 
-		if c.Connected {
-			if c.User.Name == "Michael" {
-				to := "void_star"
-				c.SendChatRequest(to)
-				log.Info("connection succeeded, sending chat request to void_star")
-			} else {
-				log.Info("connection succeeded")
-			}
-			return
+		log.Error("client connect failed: %v, retrying after %s", err, ClientConnectRetryPeriod)
+
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-time.After(ClientConnectRetryPeriod):
 		}
 	}
+
+	return err
 }
 
-func (c *Client) start() error {
+// Connect dials the server and introduces the client. Messages are read
+// in the background until the connection drops or the client is closed.
+func (c *Client) Connect(ctx context.Context) error {
+	if c.IsConnected() {
+		return nil
+	}
+
 	log.Debug("attempt client connect")
 	wsHandler := websockets.New()
 
-	err := wsHandler.Connect(consts.Addr)
-	if err != nil {
-		return err
+	connected := make(chan error, 1)
+	go func() {
+		connected <- wsHandler.Connect(c.addr)
+	}()
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		go func() {
+			if <-connected == nil {
+				wsHandler.Close()
+			}
+		}()
+		return ctx.Err()
 	}
 
 	wsHandler.Start()
@@ -89,64 +177,203 @@ func (c *Client) start() error {
 	// Send introduction message immediately on start
 	introMsg := message.NewIntroductionMessage(
 		c.ID,
-		*c.User,
+		c.Self(),
 	)
-	if err = wsHandler.Write(introMsg); err != nil {
+	if err := wsHandler.Write(introMsg); err != nil {
+		wsHandler.Close()
 		return err
 	}
 
 	log.Debug("introduction sent")
 
+	c.Lock()
 	c.ws = wsHandler
-	c.Connected = true
+	select {
+	case <-c.done:
+		// Reconnecting; the last connection's done is already closed.
+		c.done = make(chan struct{})
+	default:
+	}
+	c.Unlock()
+
+	c.connected.Store(true)
+	c.dispatch(ConnectionEvent{Connected: true})
 
-	go c.ReadMessages()
-	go c.WatchUserInput()
+	go c.ReadMessages(wsHandler)
+
+	// Catch up on what was said while we were away.
+	go func() {
+		if err := c.Sync(c.ctx); err != nil {
+			log.Warn("%v", err)
+		}
+	}()
 
 	log.Debug("connected successfully")
 
 	return nil
 }
 
-func (c *Client) ReadMessages() {
-	for {
-		c.readMessage()
+// Close says goodbye to the server and stops the client, saving its
+// cache. It is safe to call more than once.
+func (c *Client) Close() {
+	c.cancel()
 
-		if !c.Connected {
-			break
-		}
+	if err := c.SaveCache(); err != nil {
+		log.Error("client: saving cache: %v", err)
+	}
+
+	if ws := c.conn(); ws != nil {
+		ws.CloseWithCode(websocket.CloseNormalClosure, "client closed")
 	}
+	c.connected.Store(false)
 }
 
-func (c *Client) readMessage() {
+// Done is closed once the current connection to the server is gone.
+func (c *Client) Done() <-chan struct{} {
 	c.Lock()
 	defer c.Unlock()
 
-	if c.ws.IsClosed() {
-		c.Connected = false
-		return
+	return c.done
+}
+
+func (c *Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+// Self returns a copy of the client's user, which SetColor and Rename
+// may change at any time.
+func (c *Client) Self() user.User {
+	c.Lock()
+	defer c.Unlock()
+
+	return *c.User
+}
+
+// Address is the user's name as users of other domains write it, or
+// just the name when the server's domain isn't known.
+func (c *Client) Address() string {
+	name := c.Self().Name
+	if c.domain == "" {
+		return name
 	}
+	return name + "@" + c.domain
+}
 
-	if !c.Connected {
-		return
+// SetColor changes the color the user's messages are sent with.
+func (c *Client) SetColor(color lipgloss.Color) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.User.Color = color
+}
+
+// Rename reconnects under a new user name. The server knows chat
+// members by name, so it fails with ErrChatsOpen while any chat is open.
+// If the new name can't connect, the old one is restored.
+func (c *Client) Rename(ctx context.Context, name string) error {
+	if len(c.Chats()) > 0 {
+		return ErrChatsOpen
 	}
 
-	var wsMsg message.WSMessage
-	select {
-	case wsMsg = <-c.ws.ReadCh:
-	default:
+	c.Lock()
+	old := c.User.Name
+	c.User.Name = name
+	ws := c.ws
+	done := c.done
+	c.Unlock()
+
+	wasConnected := ws != nil && c.IsConnected()
+	if wasConnected {
+		ws.CloseWithCode(websocket.CloseNormalClosure, "renaming")
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			c.restoreName(old)
+			return ctx.Err()
+		}
 	}
 
-	if wsMsg.MessageID == "" {
-		return
+	err := c.Connect(ctx)
+	if err == nil {
+		return nil
+	}
+
+	c.restoreName(old)
+	if wasConnected {
+		if reconnectErr := c.Connect(c.ctx); reconnectErr != nil {
+			log.Error("client: reconnecting as %s: %v", old, reconnectErr)
+		}
 	}
 
+	return err
+}
+
+func (c *Client) restoreName(name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.User.Name = name
+}
+
+func (c *Client) conn() *websockets.WebsocketHandler {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.ws
+}
+
+// ReadMessages blocks on the websocket read channel and handles each
+// message as it arrives, until the connection drops or the client is
+// closed.
+func (c *Client) ReadMessages(ws *websockets.WebsocketHandler) {
+	c.Lock()
+	done := c.done
+	c.Unlock()
+	defer close(done)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case wsMsg, ok := <-ws.ReadCh:
+			if !ok {
+				log.Warn("client: connection to server closed")
+				c.connected.Store(false)
+				c.dispatch(ConnectionEvent{Connected: false})
+				return
+			}
+
+			c.readMessage(wsMsg)
+		}
+	}
+}
+
+func (c *Client) readMessage(wsMsg message.WSMessage) {
 	log.Debug("got message: %s:%v", wsMsg.MessageID, wsMsg.MessageType)
 
+	// Chat state is updated before a waiting request is woken up, so a
+	// chat is known by the time OpenChat returns it. Events for it are
+	// only queued; callbacks run on their own goroutine.
 	err := c.HandleMessage(wsMsg)
 	if err != nil {
 		log.Error("client: failed to handle message: %v", err)
 	}
+
+	if wsMsg.IsReply() {
+		c.resolvePending(wsMsg)
+	}
+}
+
+// Latency returns the round trip time to the server as measured by the
+// websocket heartbeat.
+func (c *Client) Latency() time.Duration {
+	ws := c.conn()
+	if !c.IsConnected() || ws == nil {
+		return 0
+	}
+
+	return ws.Latency()
 }
 
 func (c *Client) HandleMessage(wsMsg message.WSMessage) error {
@@ -157,7 +384,13 @@ func (c *Client) HandleMessage(wsMsg message.WSMessage) error {
 			return err
 		}
 
-		c.Chat = chat.New(cr.ChatID, "example chat", cr.Users)
+		if cr.Status != message.ChatOpenStatus {
+			log.Warn("client: chat response with status %v, no chat opened", cr.Status)
+			return nil
+		}
+
+		c.addChat(chat.New(cr.ChatID, chatName(c.Self().Name, cr.Users), cr.Users))
+		c.dispatch(ChatOpenedEvent{ChatID: cr.ChatID, Users: cr.Users})
 		log.Debug("client: receive chat response, starting chat (%s)", cr.ChatID)
 	case message.TextMsg:
 		tm, err := wsMsg.ToTextMessage()
@@ -165,50 +398,237 @@ func (c *Client) HandleMessage(wsMsg message.WSMessage) error {
 			return err
 		}
 
-		c.Chat.AddMessage(tm)
+		ch := c.Chat(tm.ChatID)
+		if ch == nil {
+			if c.hasLeft(tm.ChatID) {
+				log.Debug("client: dropping message for chat %s, which we left", tm.ChatID)
+				return nil
+			}
+			return fmt.Errorf("text message for unknown chat %s", tm.ChatID)
+		}
+
+		// A message can come both live and from a sync.
+		if len(ch.Merge(tm)) == 0 {
+			return nil
+		}
+		c.index.Add(tm)
+		c.changed()
+
+		unread, mention := c.track(tm)
+		c.dispatch(TextMessageEvent{Message: tm, Unread: unread, Mention: mention})
 		log.Debug("client: receive text message for chat (%s), content: %s", tm.ChatID, tm.Content)
+	case message.NoticeMsg:
+		nm, err := wsMsg.ToNotice()
+		if err != nil {
+			return err
+		}
+
+		// A notice answering a request is for the requester.
+		if wsMsg.IsReply() {
+			return nil
+		}
+
+		log.Info("client: server notice: %s", nm.Text)
+		c.dispatch(NoticeEvent{Notice: nm})
 	}
 
 	return nil
 }
 
-func (c *Client) SendChatMessage(content string) {
-	if !c.Connected {
-		log.Warn("client: sendChatMessage: not connected")
-		return
+// chatName names a chat after everyone in it but self.
+func chatName(self string, users []user.User) string {
+	name := ""
+	for _, u := range users {
+		if u.Name == self {
+			continue
+		}
+		if name != "" {
+			name += ", "
+		}
+		name += u.Name
 	}
 
-	if c.Chat == nil {
-		log.Warn("client: sendChatMessage: chat is nil")
-		return
+	if name == "" {
+		return self
 	}
+	return name
+}
 
-	textMsg := message.NewTextMessage(c.Chat.ID, *c.User, content)
+func (c *Client) addChat(ch *chat.Chat) {
+	c.chatsMu.Lock()
+	defer c.chatsMu.Unlock()
 
-	err := c.ws.Write(textMsg)
-	if err != nil {
-		log.Error("client: send chat message: %v", err)
-		return
+	if _, ok := c.chats[ch.ID]; !ok {
+		c.chats[ch.ID] = ch
+		delete(c.left, ch.ID)
+		c.changed()
+	}
+}
+
+// LeaveChat stops tracking chatID. The server keeps us in the chat, so
+// its messages keep coming; they are dropped until someone opens the
+// chat again.
+func (c *Client) LeaveChat(chatID string) {
+	c.chatsMu.Lock()
+	if _, ok := c.chats[chatID]; ok {
+		delete(c.chats, chatID)
+		c.left[chatID] = true
+	}
+	c.chatsMu.Unlock()
+	c.changed()
+
+	c.forget(chatID)
+}
+
+func (c *Client) hasLeft(chatID string) bool {
+	c.chatsMu.Lock()
+	defer c.chatsMu.Unlock()
+
+	return c.left[chatID]
+}
+
+// Left returns the chats left with LeaveChat.
+func (c *Client) Left() []string {
+	c.chatsMu.Lock()
+	defer c.chatsMu.Unlock()
+
+	left := make([]string, 0, len(c.left))
+	for chatID := range c.left {
+		left = append(left, chatID)
+	}
+	sort.Strings(left)
+
+	return left
+}
+
+// Chat returns the open chat with chatID, or nil.
+func (c *Client) Chat(chatID string) *chat.Chat {
+	c.chatsMu.Lock()
+	defer c.chatsMu.Unlock()
+
+	return c.chats[chatID]
+}
+
+// Chats returns every chat the client has open, by name.
+func (c *Client) Chats() []*chat.Chat {
+	c.chatsMu.Lock()
+	chats := make([]*chat.Chat, 0, len(c.chats))
+	for _, ch := range c.chats {
+		chats = append(chats, ch)
+	}
+	c.chatsMu.Unlock()
+
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].Name < chats[j].Name
+	})
+
+	return chats
+}
+
+// Send posts content to the chat with chatID.
+func (c *Client) Send(chatID string, content string) error {
+	ws := c.conn()
+	if !c.IsConnected() || ws == nil {
+		return ErrNotConnected
+	}
+
+	if c.Chat(chatID) == nil {
+		return ErrUnknownChat
+	}
+
+	if err := ws.Write(message.NewTextMessage(chatID, c.Self(), content)); err != nil {
+		return fmt.Errorf("client: send chat message: %v", err)
 	}
 
 	log.Debug("client: chat message sent (content=%s)", content)
+
+	return nil
 }
 
-func (c *Client) SendChatRequest(to string) {
-	chatReq := message.NewChatRequest(c.User.Name, to)
+// OpenChat asks the server for a chat with the user named to (user@domain
+// for users of a federated server) and returns it once it is open.
+func (c *Client) OpenChat(ctx context.Context, to string) (*chat.Chat, error) {
+	cr, err := c.RequestChat(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if cr.Status != message.ChatOpenStatus {
+		return nil, fmt.Errorf("client: chat with %s: user not found", to)
+	}
+
+	return c.Chat(cr.ChatID), nil
+}
 
-	err := c.ws.Write(chatReq)
+// RequestChat asks the server to open a chat with the user named to and
+// waits for the server's answer.
+func (c *Client) RequestChat(ctx context.Context, to string) (message.ChatResponse, error) {
+	reply, err := c.Request(ctx, message.NewChatRequest(c.Self().Name, to))
 	if err != nil {
-		log.Error("client: send chat request: %v", err)
+		return message.ChatResponse{}, err
 	}
 
-	log.Debug("client: chat request sent")
+	return reply.ToChatResponse()
 }
 
-func (c *Client) WatchUserInput() {
-	for {
-		for input := range c.chatInputCh {
-			c.SendChatMessage(input)
-		}
+// Request sends msg to the server and blocks until the server's reply to
+// it arrives or ctx is done. If ctx has no deadline, RequestTimeout is used.
+func (c *Client) Request(ctx context.Context, msg message.WSMessage) (message.WSMessage, error) {
+	ws := c.conn()
+	if !c.IsConnected() || ws == nil {
+		return message.WSMessage{}, ErrNotConnected
 	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, RequestTimeout)
+		defer cancel()
+	}
+
+	replyCh := c.addPending(msg.MessageID)
+	defer c.removePending(msg.MessageID)
+
+	if err := ws.Write(msg); err != nil {
+		return message.WSMessage{}, fmt.Errorf("client: request write: %v", err)
+	}
+
+	select {
+	case reply := <-replyCh:
+		return reply, nil
+	case <-ctx.Done():
+		return message.WSMessage{}, fmt.Errorf("client: request %s: %w", msg.MessageID, ctx.Err())
+	}
+}
+
+func (c *Client) addPending(messageID string) chan message.WSMessage {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	// Buffered so that the read loop never waits on a requester
+	// that has already given up.
+	replyCh := make(chan message.WSMessage, 1)
+	c.pending[messageID] = replyCh
+
+	return replyCh
+}
+
+func (c *Client) removePending(messageID string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	delete(c.pending, messageID)
+}
+
+func (c *Client) resolvePending(reply message.WSMessage) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	replyCh, ok := c.pending[reply.InReplyTo]
+	if !ok {
+		log.Debug("client: reply to unknown request %s", reply.InReplyTo)
+		return
+	}
+
+	delete(c.pending, reply.InReplyTo)
+	replyCh <- reply
 }
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sweetspeak/message"
+	"sweetspeak/server"
+	"sweetspeak/user"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// serve runs a server for the test and returns its address.
+func serve(t *testing.T) string {
+	t.Helper()
+
+	s := server.New()
+	s.HandleClientMessages()
+
+	hs := httptest.NewServer(http.HandlerFunc(s.HandleWS))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		s.Shutdown(ctx)
+		hs.Close()
+	})
+
+	return strings.TrimPrefix(hs.URL, "http://")
+}
+
+func newClient(t *testing.T, addr string, name string) *Client {
+	t.Helper()
+
+	c := New(uuid.NewString(), user.New(name, "1")).WithAddr(addr)
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+func connected(t *testing.T, c *Client) {
+	t.Helper()
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallbacksCanMakeRequests(t *testing.T) {
+	addr := serve(t)
+	connected(t, newClient(t, addr, "bob"))
+
+	alice := newClient(t, addr, "alice")
+	opened := make(chan error, 1)
+	alice.OnConnection(func(up bool) {
+		if up {
+			_, err := alice.OpenChat(context.Background(), "bob")
+			opened <- err
+		}
+	})
+	connected(t, alice)
+
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatalf("OpenChat from a callback: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenChat from a callback never returned")
+	}
+}
+
+func TestUndrainedEventsDoNotBlockReads(t *testing.T) {
+	size := EventBufferSize
+	EventBufferSize = 1
+	t.Cleanup(func() { EventBufferSize = size })
+
+	addr := serve(t)
+	bob := newClient(t, addr, "bob")
+	connected(t, bob)
+	connected(t, newClient(t, addr, "carol"))
+
+	alice := newClient(t, addr, "alice")
+	alice.Events() // and never read from it
+	connected(t, alice)
+
+	ctx := context.Background()
+	ch, err := alice.OpenChat(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for bob.Chat(ch.ID) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("bob never joined the chat")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const sent = 10
+	for range sent {
+		if err := bob.Send(ch.ID, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for {
+		ch.Lock()
+		got := len(ch.Messages)
+		ch.Unlock()
+		if got == sent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice read %d of %d messages", got, sent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := alice.OpenChat(ctx, "carol"); err != nil {
+		t.Fatalf("request with events backed up: %v", err)
+	}
+}
+
+func TestRenameWithChatsOpen(t *testing.T) {
+	addr := serve(t)
+	connected(t, newClient(t, addr, "bob"))
+
+	alice := newClient(t, addr, "alice")
+	connected(t, alice)
+
+	ch, err := alice.OpenChat(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.Rename(context.Background(), "alicia"); err != ErrChatsOpen {
+		t.Fatalf("rename with a chat open: %v, want ErrChatsOpen", err)
+	}
+
+	alice.LeaveChat(ch.ID)
+	if err := alice.Rename(context.Background(), "alicia"); err != nil {
+		t.Fatal(err)
+	}
+	if name := alice.Self().Name; name != "alicia" {
+		t.Fatalf("renamed to %s, want alicia", name)
+	}
+}
+
+func TestRenameRestoresNameOnFailure(t *testing.T) {
+	alice := newClient(t, "127.0.0.1:1", "alice")
+
+	if err := alice.Rename(context.Background(), "alicia"); err == nil {
+		t.Fatal("renamed without a server")
+	}
+	if name := alice.Self().Name; name != "alice" {
+		t.Fatalf("name is %s after a failed rename, want alice", name)
+	}
+}
+
+func TestLeftChatsAreIgnored(t *testing.T) {
+	addr := serve(t)
+	bob := newClient(t, addr, "bob")
+	connected(t, bob)
+
+	alice := newClient(t, addr, "alice")
+	got := make(chan string, 10)
+	alice.OnMessage(func(tm message.TextMessage) { got <- tm.Content })
+	connected(t, alice)
+
+	ch, err := alice.OpenChat(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for bob.Chat(ch.ID) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("bob never joined the chat")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	alice.LeaveChat(ch.ID)
+	if err := bob.Send(ch.ID, "anyone there?"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case content := <-got:
+		t.Fatalf("alice got %q in a chat it had left", content)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if alice.Chat(ch.ID) != nil {
+		t.Fatal("the chat came back")
+	}
+	if left := alice.Left(); len(left) != 1 || left[0] != ch.ID {
+		t.Fatalf("left %v, want [%s]", left, ch.ID)
+	}
+}
+
+func TestSearchWithoutServerHistory(t *testing.T) {
+	addr := serve(t)
+	bob := newClient(t, addr, "bob")
+	connected(t, bob)
+
+	alice := newClient(t, addr, "alice")
+	connected(t, alice)
+
+	ch, err := alice.OpenChat(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Send(ch.ID, "needle"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(alice.SearchLocal("needle", "")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("alice never got the message back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := alice.Search(context.Background(), "needle", ""); err != ErrNoHistory {
+		t.Fatalf("server search: %v, want ErrNoHistory", err)
+	}
+
+	hits, err := alice.SearchAll(context.Background(), "needle", "")
+	if err != nil || len(hits) != 1 {
+		t.Fatalf("got %d hits (%v), want the local one", len(hits), err)
+	}
+
+	if err := alice.Sync(context.Background()); err != nil {
+		t.Fatalf("sync without server history: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"sweetspeak/message"
+	"sweetspeak/user"
+)
+
+var (
+	EventBufferSize = 256
+)
+
+type (
+	// Event is anything the client reports through callbacks and Events.
+	Event interface{}
+
+	ConnectionEvent struct {
+		Connected bool
+	}
+
+	ChatOpenedEvent struct {
+		ChatID string
+		Users  []user.User
+	}
+
+	TextMessageEvent struct {
+		Message message.TextMessage
+		// Unread is the chat's unread count after this message; 0 when
+		// the chat is focused or the message is our own.
+		Unread int
+		// Mention is set when the message @mentions us and is unread.
+		Mention bool
+	}
+
+	// ChatSyncedEvent reports messages fetched for a chat after
+	// connecting, said while we were away. They are not reported one by
+	// one.
+	ChatSyncedEvent struct {
+		ChatID string
+		Added  int
+	}
+
+	NoticeEvent struct {
+		Notice message.NoticeMessage
+	}
+
+	handlers struct {
+		onEvent      []func(Event)
+		onConnection []func(bool)
+		onChatOpened []func(ChatOpenedEvent)
+		onMessage    []func(message.TextMessage)
+		onNotice     []func(message.NoticeMessage)
+	}
+)
+
+// Events returns a channel on which the client publishes connection
+// changes, opened chats and incoming messages as they happen. The
+// channel only exists once Events has been called, and should then be
+// drained: events queue up in the client until there is room in it.
+func (c *Client) Events() <-chan Event {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.events == nil {
+		c.events = make(chan Event, EventBufferSize)
+	}
+
+	return c.events
+}
+
+// Callbacks run one event at a time on the client's event goroutine, in
+// the order they were added. A slow callback holds up later events but
+// never the reading of messages, so callbacks may call OpenChat and
+// other requests.
+
+func (c *Client) OnEvent(fn func(Event)) *Client {
+	c.Lock()
+	defer c.Unlock()
+
+	c.handlers.onEvent = append(c.handlers.onEvent, fn)
+	return c
+}
+
+func (c *Client) OnConnection(fn func(connected bool)) *Client {
+	c.Lock()
+	defer c.Unlock()
+
+	c.handlers.onConnection = append(c.handlers.onConnection, fn)
+	return c
+}
+
+func (c *Client) OnChatOpened(fn func(ChatOpenedEvent)) *Client {
+	c.Lock()
+	defer c.Unlock()
+
+	c.handlers.onChatOpened = append(c.handlers.onChatOpened, fn)
+	return c
+}
+
+func (c *Client) OnMessage(fn func(message.TextMessage)) *Client {
+	c.Lock()
+	defer c.Unlock()
+
+	c.handlers.onMessage = append(c.handlers.onMessage, fn)
+	return c
+}
+
+func (c *Client) OnNotice(fn func(message.NoticeMessage)) *Client {
+	c.Lock()
+	defer c.Unlock()
+
+	c.handlers.onNotice = append(c.handlers.onNotice, fn)
+	return c
+}
+
+// dispatch queues ev for deliverEvents. It never blocks, so the read
+// goroutine can keep reading while callbacks run.
+func (c *Client) dispatch(ev Event) {
+	c.queueMu.Lock()
+	c.queued = append(c.queued, ev)
+	c.queueMu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverEvents hands queued events to callbacks and Events, in order,
+// until the client is closed.
+func (c *Client) deliverEvents() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.wake:
+		}
+
+		c.queueMu.Lock()
+		queued := c.queued
+		c.queued = nil
+		c.queueMu.Unlock()
+
+		for _, ev := range queued {
+			c.deliver(ev)
+		}
+	}
+}
+
+// deliver runs the callbacks for ev and then publishes it on Events.
+func (c *Client) deliver(ev Event) {
+	c.Lock()
+	h := c.handlers
+	events := c.events
+	c.Unlock()
+
+	switch ev := ev.(type) {
+	case ConnectionEvent:
+		for _, fn := range h.onConnection {
+			fn(ev.Connected)
+		}
+	case ChatOpenedEvent:
+		for _, fn := range h.onChatOpened {
+			fn(ev)
+		}
+	case TextMessageEvent:
+		for _, fn := range h.onMessage {
+			fn(ev.Message)
+		}
+	case NoticeEvent:
+		for _, fn := range h.onNotice {
+			fn(ev.Notice)
+		}
+	}
+
+	for _, fn := range h.onEvent {
+		fn(ev)
+	}
+
+	if events == nil {
+		return
+	}
+
+	select {
+	case events <- ev:
+	case <-c.ctx.Done():
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sweetspeak/message"
+	"sweetspeak/search"
+)
+
+// Search asks the server to search the history of our chats, or only
+// chatID's if it isn't "". Hits come back newest first.
+func (c *Client) Search(ctx context.Context, query string, chatID string) ([]message.TextMessage, error) {
+	reply, err := c.Request(ctx, message.NewSearchRequest(query, chatID, 0))
+	if err != nil {
+		return nil, err
+	}
+	if reply.MessageType == message.NoticeMsg {
+		return nil, ErrNoHistory
+	}
+
+	sr, err := reply.ToSearchResult()
+	if err != nil {
+		return nil, err
+	}
+
+	return sr.Hits, nil
+}
+
+// SearchLocal searches the messages this client has seen, without
+// asking the server.
+func (c *Client) SearchLocal(query string, chatID string) []message.TextMessage {
+	q := search.Query{Text: query}
+	if chatID != "" {
+		q.ChatIDs = []string{chatID}
+	}
+
+	return c.index.Search(q)
+}
+
+// SearchAll searches locally and, when connected, on the server, and
+// merges the hits newest first. A failed server search still returns
+// the local hits along with the error; a server without history just
+// adds nothing.
+func (c *Client) SearchAll(ctx context.Context, query string, chatID string) ([]message.TextMessage, error) {
+	hits := c.SearchLocal(query, chatID)
+	if !c.IsConnected() {
+		return hits, nil
+	}
+
+	remote, err := c.Search(ctx, query, chatID)
+	if errors.Is(err, ErrNoHistory) {
+		err = nil
+	}
+
+	seen := make(map[string]bool, len(hits))
+	for _, tm := range hits {
+		seen[tm.ID] = true
+	}
+	for _, tm := range remote {
+		if tm.ID == "" || !seen[tm.ID] {
+			hits = append(hits, tm)
+		}
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Timestamp.After(hits[j].Timestamp)
+	})
+
+	return hits, err
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"sort"
+	"sweetspeak/markdown"
+	"sweetspeak/message"
+)
+
+type (
+	// readState is how far the user has read a chat.
+	readState struct {
+		unread   int
+		mentions int
+		lastRead string
+		muted    bool
+	}
+)
+
+// Focus tells the client which chat the user is looking at. It is
+// marked read, and stays read as messages arrive. "" means none.
+func (c *Client) Focus(chatID string) {
+	c.readsMu.Lock()
+	c.focused = chatID
+	c.readsMu.Unlock()
+
+	if chatID != "" {
+		c.MarkRead(chatID)
+	}
+}
+
+func (c *Client) Focused() string {
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	return c.focused
+}
+
+// MarkRead marks every message in chatID as read.
+func (c *Client) MarkRead(chatID string) {
+	var last string
+	if ch := c.Chat(chatID); ch != nil {
+		ch.Lock()
+		if n := len(ch.Messages); n > 0 {
+			last = ch.Messages[n-1].ID
+		}
+		ch.Unlock()
+	}
+
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	st := c.read(chatID)
+	st.unread, st.mentions = 0, 0
+	if last != "" {
+		st.lastRead = last
+	}
+	c.changed()
+}
+
+// Unread is how many messages from others arrived in chatID since it was
+// last read.
+func (c *Client) Unread(chatID string) int {
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	if st, ok := c.reads[chatID]; ok {
+		return st.unread
+	}
+	return 0
+}
+
+// UnreadMentions is how many of chatID's unread messages @mention us.
+func (c *Client) UnreadMentions(chatID string) int {
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	if st, ok := c.reads[chatID]; ok {
+		return st.mentions
+	}
+	return 0
+}
+
+// Mentions returns every message in our chats that @mentions us, oldest
+// first.
+func (c *Client) Mentions() []message.TextMessage {
+	self, address := c.Self().Name, c.Address()
+
+	var found []message.TextMessage
+	for _, ch := range c.Chats() {
+		ch.Lock()
+		for _, tm := range ch.Messages {
+			if tm.From.Name != self && markdown.Mentioned(tm.Content, address) {
+				found = append(found, tm)
+			}
+		}
+		ch.Unlock()
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Timestamp.Before(found[j].Timestamp)
+	})
+
+	return found
+}
+
+// LastRead is the ID of the last message read in chatID, or "".
+func (c *Client) LastRead(chatID string) string {
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	if st, ok := c.reads[chatID]; ok {
+		return st.lastRead
+	}
+	return ""
+}
+
+// SetMuted mutes or unmutes chatID. Muted chats still count unread
+// messages, but shouldn't notify unless we're mentioned.
+func (c *Client) SetMuted(chatID string, muted bool) {
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	c.read(chatID).muted = muted
+	c.changed()
+}
+
+func (c *Client) Muted(chatID string) bool {
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	st, ok := c.reads[chatID]
+	return ok && st.muted
+}
+
+// track updates the read state for an incoming message and returns the
+// chat's unread count after it, and whether the message is an unread
+// mention of us.
+func (c *Client) track(tm message.TextMessage) (int, bool) {
+	self := c.Self().Name
+	mention := tm.From.Name != self && markdown.Mentioned(tm.Content, c.Address())
+
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	st := c.read(tm.ChatID)
+
+	// Looking at the chat, or answering in it, reads it.
+	if tm.ChatID == c.focused || tm.From.Name == self {
+		st.unread, st.mentions = 0, 0
+		if tm.ID != "" {
+			st.lastRead = tm.ID
+		}
+		return 0, false
+	}
+
+	st.unread++
+	if mention {
+		st.mentions++
+	}
+	return st.unread, mention
+}
+
+// forget drops chatID's read state, keeping it muted if it was.
+func (c *Client) forget(chatID string) {
+	c.readsMu.Lock()
+	defer c.readsMu.Unlock()
+
+	if st, ok := c.reads[chatID]; ok && st.muted {
+		c.reads[chatID] = &readState{muted: true}
+		return
+	}
+	delete(c.reads, chatID)
+}
+
+// read returns chatID's read state, creating it. readsMu must be held.
+func (c *Client) read(chatID string) *readState {
+	st, ok := c.reads[chatID]
+	if !ok {
+		st = &readState{}
+		c.reads[chatID] = st
+	}
+	return st
+}
@@ -0,0 +1,283 @@
+package commands
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sweetspeak/chat"
+	"sweetspeak/client"
+	"sweetspeak/theme"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	hexColor  = regexp.MustCompile(`^#?[0-9a-fA-F]{6}$`)
+	ansiColor = regexp.MustCompile(`^[0-9]{1,3}$`)
+)
+
+type (
+	// ActivateChatMsg asks the UI to show a chat; an empty ChatID means
+	// no chat.
+	ActivateChatMsg struct {
+		ChatID string
+	}
+
+	// ClearMsg asks the UI to clear the chat view.
+	ClearMsg struct{}
+
+	// MentionsMsg asks the UI to show every message that mentions us.
+	MentionsMsg struct{}
+
+	// ThemeMsg asks the UI to switch to Theme.
+	ThemeMsg struct {
+		Theme theme.Theme
+	}
+)
+
+// Builtins returns a registry with the standard chat commands, acting
+// through c.
+func Builtins(c *client.Client) *Registry {
+	r := NewRegistry()
+
+	r.Register(Command{
+		Name:          "join",
+		Usage:         "<user|chat>",
+		Help:          "switch to a chat, or open one with a user",
+		CompleteUsers: true,
+		Run: func(ctx Context) tea.Cmd {
+			if len(ctx.Args) != 1 {
+				return Output("usage: /join <user|chat>")
+			}
+
+			target := ctx.Args[0]
+			if ch := FindChat(c, target); ch != nil {
+				return activate(ch.ID)
+			}
+
+			return func() tea.Msg {
+				ch, err := c.OpenChat(context.Background(), target)
+				if err != nil {
+					return OutputMsg{Text: err.Error()}
+				}
+				return ActivateChatMsg{ChatID: ch.ID}
+			}
+		},
+	})
+
+	r.Register(Command{
+		Name: "leave",
+		Help: "close the current chat",
+		Run: func(ctx Context) tea.Cmd {
+			if ctx.ChatID == "" {
+				return Output("no chat to leave")
+			}
+
+			c.LeaveChat(ctx.ChatID)
+
+			next := ""
+			if chats := c.Chats(); len(chats) > 0 {
+				next = chats[0].ID
+			}
+			return activate(next)
+		},
+	})
+
+	r.Register(Command{
+		Name:  "nick",
+		Usage: "<name>",
+		Help:  "reconnect under a new name",
+		Run: func(ctx Context) tea.Cmd {
+			if len(ctx.Args) != 1 || strings.Contains(ctx.Args[0], "@") {
+				return Output("usage: /nick <name>")
+			}
+
+			name := ctx.Args[0]
+			return func() tea.Msg {
+				if err := c.Rename(context.Background(), name); err != nil {
+					return OutputMsg{Text: "nick: " + err.Error()}
+				}
+				return OutputMsg{Text: "you are now " + name}
+			}
+		},
+	})
+
+	r.Register(Command{
+		Name:  "me",
+		Usage: "<action>",
+		Help:  "describe what you are doing",
+		Run: func(ctx Context) tea.Cmd {
+			if ctx.Raw == "" {
+				return Output("usage: /me <action>")
+			}
+
+			return send(c, ctx.ChatID, "* "+c.Self().Name+" "+ctx.Raw)
+		},
+	})
+
+	r.Register(Command{
+		Name:          "msg",
+		Usage:         "<user> <text>",
+		Help:          "send a message to a user, opening a chat if needed",
+		CompleteUsers: true,
+		Run: func(ctx Context) tea.Cmd {
+			if len(ctx.Args) < 2 {
+				return Output("usage: /msg <user> <text>")
+			}
+
+			to := ctx.Args[0]
+			text := strings.TrimSpace(strings.TrimPrefix(ctx.Raw, to))
+
+			return func() tea.Msg {
+				ch := FindChat(c, to)
+				if ch == nil {
+					var err error
+					if ch, err = c.OpenChat(context.Background(), to); err != nil {
+						return OutputMsg{Text: err.Error()}
+					}
+				}
+
+				if err := c.Send(ch.ID, text); err != nil {
+					return OutputMsg{Text: err.Error()}
+				}
+				return ActivateChatMsg{ChatID: ch.ID}
+			}
+		},
+	})
+
+	r.Register(Command{
+		Name: "clear",
+		Help: "clear the chat view",
+		Run: func(ctx Context) tea.Cmd {
+			return func() tea.Msg { return ClearMsg{} }
+		},
+	})
+
+	for _, muted := range []bool{true, false} {
+		name := "mute"
+		if !muted {
+			name = "unmute"
+		}
+
+		r.Register(Command{
+			Name:          name,
+			Usage:         "[user|chat]",
+			Help:          name + " notifications from a chat, the current one by default",
+			CompleteUsers: true,
+			Run: func(ctx Context) tea.Cmd {
+				ch := c.Chat(ctx.ChatID)
+				if len(ctx.Args) > 0 {
+					ch = FindChat(c, ctx.Args[0])
+				}
+				if ch == nil {
+					return Output("no chat to %s", name)
+				}
+
+				c.SetMuted(ch.ID, muted)
+				return Output("%sd %s", name, ch.Name)
+			},
+		})
+	}
+
+	r.Register(Command{
+		Name: "mentions",
+		Help: "show every message that @mentions you",
+		Run: func(ctx Context) tea.Cmd {
+			return func() tea.Msg { return MentionsMsg{} }
+		},
+	})
+
+	r.Register(Command{
+		Name:  "theme",
+		Usage: "[name|file.yaml]",
+		Help:  "switch the color theme, or list the themes",
+		Run: func(ctx Context) tea.Cmd {
+			if ctx.Raw == "" {
+				return Output("theme: %s (have %s)", theme.Current().Name, strings.Join(theme.Names(), ", "))
+			}
+
+			t, err := theme.Find(ctx.Raw)
+			if err != nil {
+				return Output("%v", err)
+			}
+			return func() tea.Msg { return ThemeMsg{Theme: t} }
+		},
+	})
+
+	r.Register(Command{
+		Name: "help",
+		Help: "list commands",
+		Run: func(ctx Context) tea.Cmd {
+			return Output("%s", r.Help())
+		},
+	})
+
+	r.Register(Command{
+		Name:  "color",
+		Usage: "<#rrggbb|0-255>",
+		Help:  "change the color of your name",
+		Run: func(ctx Context) tea.Cmd {
+			if len(ctx.Args) != 1 {
+				return Output("usage: /color <#rrggbb|0-255>")
+			}
+
+			color := ctx.Args[0]
+			switch {
+			case hexColor.MatchString(color):
+				color = "#" + strings.TrimPrefix(color, "#")
+			case ansiColor.MatchString(color):
+			default:
+				return Output("%q is not a color", color)
+			}
+
+			c.SetColor(lipgloss.Color(color))
+			return Output("color set to %s", color)
+		},
+	})
+
+	return r
+}
+
+// FindChat finds an open chat by ID, name, or the one other user in it.
+func FindChat(c *client.Client, target string) *chat.Chat {
+	if ch := c.Chat(target); ch != nil {
+		return ch
+	}
+
+	self := c.Self().Name
+	for _, ch := range c.Chats() {
+		if strings.EqualFold(ch.Name, target) {
+			return ch
+		}
+
+		ch.Lock()
+		users := ch.Users
+		ch.Unlock()
+
+		if len(users) == 2 {
+			for _, u := range users {
+				if u.Name != self && strings.EqualFold(u.Name, target) {
+					return ch
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func activate(chatID string) tea.Cmd {
+	return func() tea.Msg {
+		return ActivateChatMsg{ChatID: chatID}
+	}
+}
+
+func send(c *client.Client, chatID string, content string) tea.Cmd {
+	return func() tea.Msg {
+		if err := c.Send(chatID, content); err != nil {
+			return OutputMsg{Text: err.Error()}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,201 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type (
+	// Context is what a command runs with.
+	Context struct {
+		// Args are the whitespace separated words after the command
+		// name; Raw is everything after it, as typed.
+		Args []string
+		Raw  string
+		// ChatID is the chat shown when the command was entered, if any.
+		ChatID string
+	}
+
+	// RunFunc does the command's work. Anything slow or fallible belongs
+	// in the returned tea.Cmd so the UI never blocks on it.
+	RunFunc func(c Context) tea.Cmd
+
+	Command struct {
+		Name  string
+		Usage string
+		Help  string
+		// CompleteUsers offers user names when tab completing the
+		// command's arguments.
+		CompleteUsers bool
+		Run           RunFunc
+	}
+
+	// Registry holds the commands the chat input understands.
+	Registry struct {
+		commands map[string]Command
+	}
+
+	// OutputMsg is text a command wants shown in the chat view.
+	OutputMsg struct {
+		Text string
+	}
+)
+
+func NewRegistry() *Registry {
+	return &Registry{
+		commands: make(map[string]Command),
+	}
+}
+
+// Register adds cmd, replacing any command with the same name.
+func (r *Registry) Register(cmd Command) *Registry {
+	r.commands[strings.ToLower(cmd.Name)] = cmd
+	return r
+}
+
+func (r *Registry) Lookup(name string) (Command, bool) {
+	cmd, ok := r.commands[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// Names returns the registered command names, sorted.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Help lists every command with its usage.
+func (r *Registry) Help() string {
+	var sb strings.Builder
+	sb.WriteString("commands:")
+	for _, name := range r.Names() {
+		cmd := r.commands[name]
+		fmt.Fprintf(&sb, "\n  %-24s %s", strings.TrimSpace("/"+name+" "+cmd.Usage), cmd.Help)
+	}
+	sb.WriteString("\n  //text                    sends text starting with a /")
+
+	return sb.String()
+}
+
+// IsCommand reports whether input should be run instead of sent.
+// "//text" escapes a message that really starts with a slash.
+func IsCommand(input string) bool {
+	return strings.HasPrefix(input, "/") && !strings.HasPrefix(input, "//")
+}
+
+// Parse splits "/name args..." into the command name and its Context.
+func Parse(input string) (string, Context) {
+	input = strings.TrimPrefix(strings.TrimSpace(input), "/")
+
+	// Any run of whitespace separates the name from its arguments.
+	name, raw := input, ""
+	if i := strings.IndexFunc(input, unicode.IsSpace); i >= 0 {
+		name, raw = input[:i], strings.TrimSpace(input[i:])
+	}
+
+	return strings.ToLower(name), Context{Args: strings.Fields(raw), Raw: raw}
+}
+
+// Execute runs the command in input for chatID.
+func (r *Registry) Execute(input string, chatID string) tea.Cmd {
+	name, ctx := Parse(input)
+	ctx.ChatID = chatID
+
+	cmd, ok := r.Lookup(name)
+	if !ok {
+		return Output("unknown command /%s, try /help", name)
+	}
+
+	return cmd.Run(ctx)
+}
+
+// Output returns a tea.Cmd that shows text in the chat view.
+func Output(format string, args ...interface{}) tea.Cmd {
+	text := fmt.Sprintf(format, args...)
+	return func() tea.Msg {
+		return OutputMsg{Text: text}
+	}
+}
+
+// Complete tab completes the last word of input: a command name right
+// after the slash, otherwise one of users. It returns the new input and,
+// when the word is still ambiguous, the candidates.
+func (r *Registry) Complete(input string, users []string) (string, []string) {
+	start := strings.LastIndexAny(input, " \t\n") + 1
+	word := input[start:]
+
+	var options []string
+	switch {
+	case start == 0 && IsCommand(word):
+		for _, name := range r.Names() {
+			options = append(options, "/"+name)
+		}
+	case strings.HasPrefix(word, "@"):
+		for _, u := range users {
+			options = append(options, "@"+u)
+		}
+	case r.completesUsers(input):
+		options = users
+	default:
+		return input, nil
+	}
+
+	var matches []string
+	for _, option := range options {
+		if strings.HasPrefix(strings.ToLower(option), strings.ToLower(word)) {
+			matches = append(matches, option)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return input, nil
+	case 1:
+		return input[:start] + matches[0] + " ", nil
+	}
+
+	return input[:start] + commonPrefix(matches), matches
+}
+
+// completesUsers reports whether input is a command whose arguments are
+// user names.
+func (r *Registry) completesUsers(input string) bool {
+	if !IsCommand(input) {
+		return false
+	}
+
+	name, _ := Parse(input)
+	cmd, ok := r.Lookup(name)
+	return ok && cmd.CompleteUsers
+}
+
+// commonPrefix returns the longest case insensitive prefix of words,
+// spelled as in the first. It compares whole runes, so it never splits
+// a multi-byte character.
+func commonPrefix(words []string) string {
+	prefix := []rune(words[0])
+	for _, w := range words[1:] {
+		n := 0
+		for _, r := range w {
+			if n == len(prefix) || !equalFold(r, prefix[n]) {
+				break
+			}
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
+
+func equalFold(a, b rune) bool {
+	return unicode.ToLower(a) == unicode.ToLower(b)
+}
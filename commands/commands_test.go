@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommonPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"alice", "alex"}, "al"},
+		{[]string{"Alice", "alex"}, "Al"},
+		{[]string{"zoë", "zoé"}, "zo"},
+		{[]string{"日本", "日曜"}, "日"},
+		{[]string{"bob", "carol"}, ""},
+	} {
+		if got := commonPrefix(tc.words); got != tc.want {
+			t.Errorf("commonPrefix(%q) = %q, want %q", tc.words, got, tc.want)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	r := NewRegistry().
+		Register(Command{Name: "join", CompleteUsers: true}).
+		Register(Command{Name: "me"})
+	users := []string{"alice", "alex", "bob"}
+
+	for _, tc := range []struct {
+		input, want string
+	}{
+		{"/jo", "/join "},
+		{"/join b", "/join bob "},
+		{"hi @b", "hi @bob "},
+		{"hi\t@b", "hi\t@bob "},
+		{"first line\n@b", "first line\n@bob "},
+		{"hi @al", "hi @al"},
+		{"hi b", "hi b"},
+	} {
+		if got, _ := r.Complete(tc.input, users); got != tc.want {
+			t.Errorf("Complete(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		name  string
+		args  []string
+		raw   string
+	}{
+		{"/help", "help", nil, ""},
+		{"/nick bob", "nick", []string{"bob"}, "bob"},
+		{"/nick\tbob", "nick", []string{"bob"}, "bob"},
+		{"  /MSG   bob   hi  there ", "msg", []string{"bob", "hi", "there"}, "bob   hi  there"},
+	} {
+		name, ctx := Parse(tc.input)
+		if name != tc.name || strings.Join(ctx.Args, "|") != strings.Join(tc.args, "|") || len(ctx.Args) != len(tc.args) || ctx.Raw != tc.raw {
+			t.Errorf("Parse(%q) = %q, %q, %q; want %q, %q, %q", tc.input, name, ctx.Args, ctx.Raw, tc.name, tc.args, tc.raw)
+		}
+	}
+}
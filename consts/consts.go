@@ -3,4 +3,9 @@ package consts
 var (
         //Addr = "test-sweetspeak.io/ws"
         Addr = "127.0.0.1:9998"
+
+	// AdminAddr serves the admin control interface; keep it on localhost.
+	AdminAddr = "127.0.0.1:9997"
+	// AdminTokenFile holds the token the admin interface asks for.
+	AdminTokenFile = "sweetspeak-admin.token"
 )
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"runtime"
+	"sweetspeak/client"
+	"sweetspeak/consts"
+	log "sweetspeak/logging"
+	"sweetspeak/server"
+	"sweetspeak/user"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/google/uuid"
+)
+
+var (
+	numClients = flag.Int("clients", 500, "number of idle clients to connect")
+	duration   = flag.Duration("duration", 10*time.Second, "how long to measure CPU usage for")
+	addr       = flag.String("addr", "127.0.0.1:9899", "address for the in-process server")
+)
+
+// sweetspeak-loadtest starts a server in-process, connects a number of
+// clients that never send anything, and reports the CPU time the whole
+// process burns while they sit idle. BenchmarkIdleConnections in
+// websockets measures the same for the connections alone, under go test.
+func main() {
+	flag.Parse()
+
+	log.SetGlobalFile("sweetspeak-loadtest.log")
+	log.SetConsoleOutput(false)
+
+	consts.Addr = *addr
+	go server.New().Start()
+
+	if err := waitForServer(*addr, 5*time.Second); err != nil {
+		fmt.Printf("server never came up: %v\n", err)
+		return
+	}
+
+	clients := make([]*client.Client, 0, *numClients)
+	for i := range *numClients {
+		usr := user.New(fmt.Sprintf("idle-%d", i), lipgloss.Color("241"))
+		c := client.New(uuid.NewString(), usr)
+		if err := c.Connect(context.Background()); err != nil {
+			fmt.Printf("client %d failed to connect: %v\n", i, err)
+			return
+		}
+		clients = append(clients, c)
+	}
+
+	// Let the handshakes settle before measuring.
+	time.Sleep(time.Second)
+
+	fmt.Printf("%d idle clients connected, %d goroutines\n", len(clients), runtime.NumGoroutine())
+
+	before := cpuTime()
+	start := time.Now()
+	time.Sleep(*duration)
+	used := cpuTime() - before
+	wall := time.Since(start)
+
+	fmt.Printf("cpu time: %s over %s (%.2f%% of one core)\n",
+		used.Round(time.Millisecond),
+		wall.Round(time.Millisecond),
+		100*used.Seconds()/wall.Seconds(),
+	)
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func waitForServer(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn.Close()
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -117,9 +118,33 @@ func (l *Logger) SetLevel(level LogLevel) {
 	l.Lock()
 	defer l.Unlock()
 
+	l.Level = level
 	l.Config.Level = level
 }
 
+func (l *Logger) GetLevel() LogLevel {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.Level
+}
+
+// ParseLevel accepts a level name such as "debug" or "WARN".
+func ParseLevel(name string) (LogLevel, error) {
+	switch strings.ToUpper(name) {
+	case "INFO":
+		return INFO, nil
+	case "ERROR", "EROR":
+		return ERROR, nil
+	case "WARN":
+		return WARN, nil
+	case "DEBUG", "DBUG":
+		return DEBUG, nil
+	}
+
+	return INFO, fmt.Errorf("unknown log level %q", name)
+}
+
 func (l *Logger) WriteLogs() {
 	for logMsg := range l.WriteCh {
 		logString := l.FormatLog(logMsg)
@@ -150,7 +175,7 @@ func (l *Logger) FormatLog(logMessage LogMsg) string {
 }
 
 func (l *Logger) writeMsg(level LogLevel, format string, args ...interface{}) {
-	if level > l.Level {
+	if level > l.GetLevel() {
 		return
 	}
 
@@ -216,6 +241,10 @@ func SetGlobalLevel(level LogLevel) {
 	DefaultLogger.SetLevel(level)
 }
 
+func GetGlobalLevel() LogLevel {
+	return DefaultLogger.GetLevel()
+}
+
 func SetGlobalFile(fileName string) {
         // Reinit with new config
         currentLevel := DefaultLogger.Level
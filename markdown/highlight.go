@@ -0,0 +1,122 @@
+package markdown
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	plainCodeStyle = lipgloss.NewStyle()
+	keywordStyle   = lipgloss.NewStyle().Bold(true)
+	stringStyle    = lipgloss.NewStyle()
+	numberStyle    = lipgloss.NewStyle()
+	commentStyle   = lipgloss.NewStyle().Italic(true)
+
+	// languages maps a fence's language to how its code is highlighted.
+	// Unknown languages, and logs, are shown plain.
+	languages = map[string]language{}
+)
+
+type language struct {
+	keywords map[string]bool
+	comment  string
+}
+
+func init() {
+	add := func(names string, comment string, keywords string) {
+		l := language{keywords: make(map[string]bool), comment: comment}
+		for _, kw := range strings.Fields(keywords) {
+			l.keywords[kw] = true
+		}
+		for _, name := range strings.Fields(names) {
+			languages[name] = l
+		}
+	}
+
+	add("go golang", "//", `break case chan const continue default defer else fallthrough
+		for func go goto if import interface map package range return select struct
+		switch type var nil true false iota`)
+	add("python py", "#", `and as assert async await break class continue def del elif else
+		except finally for from global if import in is lambda nonlocal not or pass
+		raise return try while with yield None True False self`)
+	add("javascript js typescript ts jsx tsx", "//", `async await break case catch class
+		const continue default delete do else export extends finally for function if
+		import in instanceof let new of return switch this throw try typeof var void
+		while yield null undefined true false interface type`)
+	add("rust rs", "//", `as async await break const continue crate else enum extern false fn
+		for if impl in let loop match mod move mut pub ref return self Self static
+		struct super trait true type unsafe use where while`)
+	add("c cpp c++ h java", "//", `break case char class const continue default do double
+		else enum extern float for if int long new private protected public return
+		short sizeof static struct switch this typedef union unsigned void while
+		true false null NULL`)
+	add("sh bash shell zsh console", "#", `if then else elif fi for while until do done case esac
+		in function return export local echo exit`)
+	add("yaml yml", "#", `true false null yes no on off`)
+	add("json", "", `true false null`)
+	add("sql", "--", `select from where and or not insert into values update set delete
+		create table drop alter join left right inner outer on group by order having
+		limit as null is in SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET
+		DELETE CREATE TABLE DROP ALTER JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER
+		HAVING LIMIT AS NULL IS IN`)
+}
+
+// highlight colors one line of code. It is a line at a time, so strings
+// and comments spanning lines are only colored on their first.
+func highlight(line string, lang string) string {
+	l, ok := languages[strings.ToLower(lang)]
+	if !ok {
+		return plainCodeStyle.Render(line)
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(line); {
+		c := line[i]
+
+		switch {
+		case l.comment != "" && strings.HasPrefix(line[i:], l.comment):
+			sb.WriteString(commentStyle.Render(line[i:]))
+			return sb.String()
+		case c == '"' || c == '\'' || c == '`':
+			end := i + 1
+			for end < len(line) && line[end] != c {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(line))
+			sb.WriteString(stringStyle.Render(line[i:end]))
+			i = end
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(line) && (isWord(line[end]) || line[end] == '.') {
+				end++
+			}
+			sb.WriteString(numberStyle.Render(line[i:end]))
+			i = end
+		case isWord(c):
+			end := i
+			for end < len(line) && isWord(line[end]) {
+				end++
+			}
+			if word := line[i:end]; l.keywords[word] {
+				sb.WriteString(keywordStyle.Render(word))
+			} else {
+				sb.WriteString(plainCodeStyle.Render(word))
+			}
+			i = end
+		default:
+			end := i
+			for end < len(line) && !isWord(line[end]) && strings.IndexByte("\"'`", line[end]) < 0 &&
+				(l.comment == "" || !strings.HasPrefix(line[end:], l.comment)) {
+				end++
+			}
+			sb.WriteString(plainCodeStyle.Render(line[i:end]))
+			i = end
+		}
+	}
+
+	return sb.String()
+}
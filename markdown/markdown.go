@@ -0,0 +1,275 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+
+	"sweetspeak/theme"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+var (
+	boldStyle   = lipgloss.NewStyle().Bold(true)
+	italicStyle = lipgloss.NewStyle().Italic(true)
+	codeStyle   = lipgloss.NewStyle()
+	linkStyle   = lipgloss.NewStyle().Underline(true).UnderlineSpaces(true)
+	urlStyle    = lipgloss.NewStyle().Faint(true)
+	bulletStyle = lipgloss.NewStyle()
+	gutterStyle = lipgloss.NewStyle()
+	langStyle   = lipgloss.NewStyle().Italic(true)
+
+	listItem = regexp.MustCompile(`^(\s*)([-*+]|\d{1,9}[.)])\s+(.*)$`)
+)
+
+func init() {
+	theme.OnChange(setTheme)
+}
+
+// setTheme colors markdown, mentions and highlighted code after t.
+func setTheme(t theme.Theme) {
+	codeStyle = codeStyle.Foreground(t.Code).Background(t.CodeBackground)
+	linkStyle = linkStyle.Foreground(t.Link)
+	bulletStyle = bulletStyle.Foreground(t.Accent)
+	gutterStyle = gutterStyle.Foreground(t.Rule)
+	langStyle = langStyle.Foreground(t.Rule)
+
+	mentionStyle = mentionStyle.Foreground(t.Mention)
+	selfMentionStyle = selfMentionStyle.Foreground(t.HighlightText).Background(t.Highlight)
+
+	plainCodeStyle = plainCodeStyle.Foreground(t.CodeText)
+	keywordStyle = keywordStyle.Foreground(t.Keyword)
+	stringStyle = stringStyle.Foreground(t.String)
+	numberStyle = numberStyle.Foreground(t.Number)
+	commentStyle = commentStyle.Foreground(t.Comment)
+}
+
+type (
+	// Options control how Render lays text out.
+	Options struct {
+		// Width wraps lines; <= 0 leaves them as they are.
+		Width int
+		// Self is the reader's name, as name@domain on a federated
+		// server: mentions of them stand out.
+		Self string
+	}
+)
+
+const (
+	fence  = "```"
+	gutter = "│ "
+)
+
+// Render renders the markdown subset chat messages use: **bold**,
+// *italic*, `code`, fenced code blocks, [links](url), lists and @mentions.
+func Render(src string, o Options) string {
+	var (
+		out   []string
+		lines = strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	)
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, fence):
+			lang := strings.TrimSpace(strings.TrimPrefix(trimmed, fence))
+
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			out = append(out, codeBlock(code, lang, o.Width)...)
+		case listItem.MatchString(line):
+			out = append(out, listLine(listItem.FindStringSubmatch(line), o)...)
+		default:
+			out = append(out, wrap(Inline(line, o), o.Width))
+		}
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// Inline renders the inline markup of a single line.
+func Inline(s string, o Options) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()", s[i+1]) >= 0:
+			sb.WriteByte(s[i+1])
+			i += 2
+			continue
+		case c == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end > 0 {
+				sb.WriteString(codeStyle.Render(s[i+1 : i+1+end]))
+				i += end + 2
+				continue
+			}
+		case (c == '*' || c == '_') && strings.HasPrefix(s[i:], strings.Repeat(string(c), 2)):
+			delim := s[i : i+2]
+			if end := closing(s, i+2, delim); end > 0 {
+				sb.WriteString(boldStyle.Render(Inline(s[i+2:end], o)))
+				i = end + 2
+				continue
+			}
+		case c == '*' || c == '_':
+			if opens(s, i) {
+				if end := closing(s, i+1, string(c)); end > 0 {
+					sb.WriteString(italicStyle.Render(Inline(s[i+1:end], o)))
+					i = end + 1
+					continue
+				}
+			}
+		case c == '@' && (i == 0 || !isWord(s[i-1])):
+			if name, n := mention(s[i:]); n > 0 {
+				if o.Self != "" && Names(name, o.Self) {
+					sb.WriteString(selfMentionStyle.Render("@" + name))
+				} else {
+					sb.WriteString(mentionStyle.Render("@" + name))
+				}
+				i += n
+				continue
+			}
+		case c == '[':
+			if text, url, n := link(s[i:]); n > 0 {
+				sb.WriteString(linkStyle.Render(Inline(text, o)))
+				if url != text {
+					sb.WriteString(" " + urlStyle.Render("("+url+")"))
+				}
+				i += n
+				continue
+			}
+		}
+
+		sb.WriteByte(s[i])
+		i++
+	}
+
+	return sb.String()
+}
+
+// opens reports whether the emphasis marker at i starts a span: it must
+// touch the word after it, and an underscore must not sit inside a word
+// like snake_case.
+func opens(s string, i int) bool {
+	if i+1 >= len(s) || s[i+1] == ' ' {
+		return false
+	}
+	return s[i] == '*' || i == 0 || !isWord(s[i-1])
+}
+
+// closing finds delim closing a span that starts at from, or -1.
+func closing(s string, from int, delim string) int {
+	for j := from; j+len(delim) <= len(s); j++ {
+		if !strings.HasPrefix(s[j:], delim) || j == from || s[j-1] == ' ' {
+			continue
+		}
+		// "**" never closes a single "*" span.
+		if len(delim) == 1 && j+1 < len(s) && s[j+1] == delim[0] {
+			j++
+			continue
+		}
+		if delim[0] == '_' && j+len(delim) < len(s) && isWord(s[j+len(delim)]) {
+			continue
+		}
+		return j
+	}
+
+	return -1
+}
+
+// link parses "[text](url)" at the start of s, returning how many bytes
+// it took.
+func link(s string) (string, string, int) {
+	mid := strings.Index(s, "](")
+	if mid < 0 || strings.IndexByte(s[1:mid], '[') >= 0 {
+		return "", "", 0
+	}
+
+	end := strings.IndexByte(s[mid+2:], ')')
+	if end <= 0 {
+		return "", "", 0
+	}
+
+	return s[1:mid], s[mid+2 : mid+2+end], mid + 3 + end
+}
+
+func isWord(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func listLine(m []string, o Options) []string {
+	indent := strings.Repeat("  ", len(strings.ReplaceAll(m[1], "\t", "  "))/2)
+
+	marker := m[2]
+	if strings.IndexByte("-*+", marker[0]) >= 0 {
+		marker = "•"
+	}
+	marker = indent + bulletStyle.Render(marker) + " "
+
+	return hang(marker, o.Width, func(w int) string {
+		return wrap(Inline(m[3], o), w)
+	})
+}
+
+func codeBlock(code []string, lang string, width int) []string {
+	var out []string
+	if lang != "" {
+		out = append(out, langStyle.Render(lang))
+	}
+
+	prefix := gutterStyle.Render(gutter)
+	// The gutter is multibyte: measure it in cells, not bytes.
+	gutterWidth := lipgloss.Width(gutter)
+	for _, line := range code {
+		line = highlight(strings.ReplaceAll(line, "\t", "    "), lang)
+		if width > gutterWidth {
+			line = ansi.Hardwrap(line, width-gutterWidth, true)
+		}
+		for _, l := range strings.Split(line, "\n") {
+			out = append(out, prefix+l)
+		}
+	}
+
+	return out
+}
+
+// Hang renders src after prefix, e.g. an author's name, with the rest of
+// the message indented to line up under the first line.
+func Hang(prefix string, src string, o Options) string {
+	return strings.Join(hang(prefix, o.Width, func(w int) string {
+		o.Width = w
+		return Render(src, o)
+	}), "\n")
+}
+
+// hang renders what follows prefix at the width left after it and
+// indents every line but the first by the prefix's width. Too narrow to
+// bother, it just renders at full width.
+func hang(prefix string, width int, render func(width int) string) []string {
+	indent := ansi.StringWidth(prefix)
+	if width > 0 && width-indent < 10 {
+		indent = 0
+	}
+
+	lines := strings.Split(render(width-indent), "\n")
+	for i := range lines {
+		if i == 0 {
+			lines[i] = prefix + lines[i]
+		} else {
+			lines[i] = strings.Repeat(" ", indent) + lines[i]
+		}
+	}
+
+	return lines
+}
+
+func wrap(s string, width int) string {
+	if width <= 0 {
+		return s
+	}
+	return ansi.Wrap(s, width, "")
+}
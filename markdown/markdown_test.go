@@ -0,0 +1,18 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/x/ansi"
+)
+
+func TestCodeBlockWrapsToWidth(t *testing.T) {
+	out := Render("```\n"+strings.Repeat("x", 10)+"\n```", Options{Width: 6})
+
+	want := []string{"│ xxxx", "│ xxxx", "│ xx"}
+	got := strings.Split(ansi.Strip(out), "\n")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("code block wrapped to %q, want %q", got, want)
+	}
+}
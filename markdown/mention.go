@@ -0,0 +1,101 @@
+package markdown
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	mentionStyle     = lipgloss.NewStyle().Bold(true)
+	selfMentionStyle = lipgloss.NewStyle().Bold(true)
+)
+
+// Mentions returns the names @mentioned in src, leaving out anything in
+// code, in the order they appear.
+func Mentions(src string) []string {
+	var (
+		names  []string
+		inCode bool
+	)
+
+	for _, line := range strings.Split(src, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), fence) {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+
+		inSpan := false
+		for i := 0; i < len(line); i++ {
+			switch {
+			case line[i] == '`':
+				inSpan = !inSpan
+			case !inSpan && line[i] == '@' && (i == 0 || !isWord(line[i-1])):
+				if name, n := mention(line[i:]); n > 0 {
+					names = append(names, name)
+					i += n - 1
+				}
+			}
+		}
+	}
+
+	return names
+}
+
+// Mentioned reports whether src @mentions self; see Names.
+func Mentioned(src string, self string) bool {
+	for _, m := range Mentions(src) {
+		if Names(m, self) {
+			return true
+		}
+	}
+	return false
+}
+
+// Names reports whether the mention "@mention" names the user self,
+// which is name@domain when their server federates as domain. A mention
+// with a domain only names them if it is theirs: "@bob@example.org" is
+// somebody else than the local "bob".
+func Names(mention string, self string) bool {
+	name, domain, _ := strings.Cut(self, "@")
+	local, mentionDomain, federated := strings.Cut(mention, "@")
+
+	if !strings.EqualFold(local, name) {
+		return false
+	}
+	return !federated || strings.EqualFold(mentionDomain, domain)
+}
+
+// mention parses "@name" or "@name@domain" at the start of s, returning
+// the name and how many bytes it took.
+func mention(s string) (string, int) {
+	end := 1
+	for end < len(s) && isName(s[end]) {
+		end++
+	}
+	if end == 1 {
+		return "", 0
+	}
+
+	// user@domain addressing from federation.
+	if end+1 < len(s) && s[end] == '@' && isName(s[end+1]) {
+		end++
+		for end < len(s) && (isName(s[end]) || s[end] == '.') {
+			end++
+		}
+	}
+
+	// A trailing dot ends the sentence, not the name.
+	for s[end-1] == '.' {
+		end--
+	}
+
+	return s[1:end], end
+}
+
+func isName(c byte) bool {
+	return isWord(c) || c == '-'
+}
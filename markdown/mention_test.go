@@ -0,0 +1,36 @@
+package markdown
+
+import "testing"
+
+func TestNames(t *testing.T) {
+	for _, tc := range []struct {
+		mention, self string
+		want          bool
+	}{
+		{"bob", "bob", true},
+		{"Bob", "bob", true},
+		{"bob", "bob@here.org", true},
+		{"bob@here.org", "bob@here.org", true},
+		{"bob@HERE.org", "bob@here.org", true},
+		{"bob@other.org", "bob@here.org", false},
+		{"bob@other.org", "bob", false},
+		{"bobby", "bob", false},
+		{"alice@here.org", "bob@here.org", false},
+	} {
+		if got := Names(tc.mention, tc.self); got != tc.want {
+			t.Errorf("Names(%q, %q) = %v, want %v", tc.mention, tc.self, got, tc.want)
+		}
+	}
+}
+
+func TestMentioned(t *testing.T) {
+	if Mentioned("ping @bob@other.org", "bob") {
+		t.Error("a mention of bob on another domain named the local bob")
+	}
+	if !Mentioned("ping @bob.", "bob") {
+		t.Error("@bob. did not name bob")
+	}
+	if Mentioned("`@bob` in code", "bob") {
+		t.Error("a mention in code counted")
+	}
+}
@@ -19,8 +19,40 @@ const (
 	ChatRequestMsg
 	ChatResponseMsg
 	IntroductionMsg
+	NoticeMsg
+	SearchMsg
+	SearchResultMsg
+	HistoryMsg
+	HistoryResultMsg
 )
 
+var messageTypeNames = map[MessageType]string{
+	NonMsg:           "none",
+	TextMsg:          "text",
+	StatusMsg:        "status",
+	ChatRequestMsg:   "chat_request",
+	ChatResponseMsg:  "chat_response",
+	IntroductionMsg:  "introduction",
+	NoticeMsg:        "notice",
+	SearchMsg:        "search",
+	SearchResultMsg:  "search_result",
+	HistoryMsg:       "history",
+	HistoryResultMsg: "history_result",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// Known reports whether t is one of the message types above.
+func (t MessageType) Known() bool {
+	_, ok := messageTypeNames[t]
+	return ok
+}
+
 type ChatStatus int
 
 const (
@@ -29,9 +61,26 @@ const (
 	NotConnected
 )
 
+type NoticeKind int
+
+const (
+	// ShutdownNotice tells clients the server is going away.
+	ShutdownNotice NoticeKind = iota
+	// AnnouncementNotice is an operator broadcast.
+	AnnouncementNotice
+	// KickedNotice is sent right before the server drops a client.
+	KickedNotice
+	// ThrottleNotice tells a client its messages are being dropped
+	// until RetryAfter has passed.
+	ThrottleNotice
+	// RefusedNotice explains why the server would not admit a client.
+	RefusedNotice
+)
+
 type (
 	WSMessage struct {
 		MessageID   string      `yaml:"message_id"`
+		InReplyTo   string      `yaml:"in_reply_to,omitempty"`
 		MessageType MessageType `yaml:"message_type"`
 		Payload     interface{} `yaml:"payload"`
 	}
@@ -42,6 +91,9 @@ type (
 	}
 
 	TextMessage struct {
+		// ID is assigned by the server, whatever the sender put there,
+		// and is the same for every copy of the message.
+		ID        string    `yaml:"id,omitempty"`
 		ChatID    string    `yaml:"chat_id"`
 		From      user.User `yaml:"from"`
 		Timestamp time.Time `yaml:"timestamp"`
@@ -65,6 +117,48 @@ type (
 		Users  []user.User `yaml:"users"`
 		Status ChatStatus  `yaml:"chat_status"`
 	}
+
+	// NoticeMessage is sent by the server to tell a client something
+	// about the server itself rather than about a chat.
+	NoticeMessage struct {
+		Kind       NoticeKind    `yaml:"kind"`
+		Text       string        `yaml:"text"`
+		Timestamp  time.Time     `yaml:"timestamp"`
+		RetryAfter time.Duration `yaml:"retry_after,omitempty"`
+	}
+
+	// SearchRequest asks the server to search the history of the
+	// sender's chats, or just ChatID's.
+	SearchRequest struct {
+		Query  string `yaml:"query"`
+		ChatID string `yaml:"chat_id,omitempty"`
+		Limit  int    `yaml:"limit,omitempty"`
+	}
+
+	// SearchResult holds the matching messages, newest first.
+	SearchResult struct {
+		Query string        `yaml:"query"`
+		Hits  []TextMessage `yaml:"hits"`
+	}
+
+	// HistoryRequest asks for a chat's messages newer than After, the ID
+	// of the last message the client already has; all of them if empty.
+	HistoryRequest struct {
+		ChatID string `yaml:"chat_id"`
+		After  string `yaml:"after,omitempty"`
+		Limit  int    `yaml:"limit,omitempty"`
+	}
+
+	// HistoryResult holds the requested messages, oldest first. Users is
+	// who is in the chat now.
+	HistoryResult struct {
+		ChatID   string        `yaml:"chat_id"`
+		Users    []user.User   `yaml:"users"`
+		Messages []TextMessage `yaml:"messages"`
+		// More is set when Messages was cut off at the limit; ask again
+		// after the last one for the rest.
+		More bool `yaml:"more,omitempty"`
+	}
 )
 
 func NewWSMessage(messageType MessageType, payload interface{}) WSMessage {
@@ -75,6 +169,17 @@ func NewWSMessage(messageType MessageType, payload interface{}) WSMessage {
 	}
 }
 
+// ReplyTo marks w as the reply to req so that the sender of req
+// can match the two up.
+func (w WSMessage) ReplyTo(req WSMessage) WSMessage {
+	w.InReplyTo = req.MessageID
+	return w
+}
+
+func (w *WSMessage) IsReply() bool {
+	return w.InReplyTo != ""
+}
+
 func (w *WSMessage) String() string {
 	data, _ := yaml.Marshal(w)
 	return string(data)
@@ -83,6 +188,7 @@ func (w *WSMessage) String() string {
 func (w *WSMessage) UnmarshalYAML(value *yaml.Node) error {
 	var tmp struct {
 		MessageID   string      `yaml:"message_id"`
+		InReplyTo   string      `yaml:"in_reply_to"`
 		MessageType MessageType `yaml:"message_type"`
 		Payload     yaml.Node   `yaml:"payload"`
 	}
@@ -92,6 +198,7 @@ func (w *WSMessage) UnmarshalYAML(value *yaml.Node) error {
 	}
 
 	w.MessageID = tmp.MessageID
+	w.InReplyTo = tmp.InReplyTo
 	w.MessageType = tmp.MessageType
 
 	switch w.MessageType {
@@ -119,6 +226,36 @@ func (w *WSMessage) UnmarshalYAML(value *yaml.Node) error {
 			return err
 		}
 		w.Payload = data
+	case NoticeMsg:
+		var data NoticeMessage
+		if err := tmp.Payload.Decode(&data); err != nil {
+			return err
+		}
+		w.Payload = data
+	case SearchMsg:
+		var data SearchRequest
+		if err := tmp.Payload.Decode(&data); err != nil {
+			return err
+		}
+		w.Payload = data
+	case SearchResultMsg:
+		var data SearchResult
+		if err := tmp.Payload.Decode(&data); err != nil {
+			return err
+		}
+		w.Payload = data
+	case HistoryMsg:
+		var data HistoryRequest
+		if err := tmp.Payload.Decode(&data); err != nil {
+			return err
+		}
+		w.Payload = data
+	case HistoryResultMsg:
+		var data HistoryResult
+		if err := tmp.Payload.Decode(&data); err != nil {
+			return err
+		}
+		w.Payload = data
 	}
 
 	return nil
@@ -160,6 +297,41 @@ func (w *WSMessage) ToChatResponse() (ChatResponse, error) {
 	return ChatResponse{}, fmt.Errorf("payload is not ChatResponse")
 }
 
+func (w *WSMessage) ToNotice() (NoticeMessage, error) {
+	if nm, ok := w.Payload.(NoticeMessage); ok {
+		return nm, nil
+	}
+	return NoticeMessage{}, fmt.Errorf("payload is not NoticeMessage")
+}
+
+func (w *WSMessage) ToSearchRequest() (SearchRequest, error) {
+	if sr, ok := w.Payload.(SearchRequest); ok {
+		return sr, nil
+	}
+	return SearchRequest{}, fmt.Errorf("payload is not SearchRequest")
+}
+
+func (w *WSMessage) ToSearchResult() (SearchResult, error) {
+	if sr, ok := w.Payload.(SearchResult); ok {
+		return sr, nil
+	}
+	return SearchResult{}, fmt.Errorf("payload is not SearchResult")
+}
+
+func (w *WSMessage) ToHistoryRequest() (HistoryRequest, error) {
+	if hr, ok := w.Payload.(HistoryRequest); ok {
+		return hr, nil
+	}
+	return HistoryRequest{}, fmt.Errorf("payload is not HistoryRequest")
+}
+
+func (w *WSMessage) ToHistoryResult() (HistoryResult, error) {
+	if hr, ok := w.Payload.(HistoryResult); ok {
+		return hr, nil
+	}
+	return HistoryResult{}, fmt.Errorf("payload is not HistoryResult")
+}
+
 func NewIntroductionMessage(clientID string, u user.User) WSMessage {
 	return NewWSMessage(IntroductionMsg, IntroductionMessage{
 		ClientID: clientID,
@@ -190,3 +362,52 @@ func NewChatResponse(chatID string, users []user.User, status ChatStatus) WSMess
 		Status: status,
 	})
 }
+
+func NewNotice(kind NoticeKind, text string) WSMessage {
+	return NewWSMessage(NoticeMsg, NoticeMessage{
+		Kind:      kind,
+		Text:      text,
+		Timestamp: time.Now(),
+	})
+}
+
+func NewThrottleNotice(text string, retryAfter time.Duration) WSMessage {
+	return NewWSMessage(NoticeMsg, NoticeMessage{
+		Kind:       ThrottleNotice,
+		Text:       text,
+		Timestamp:  time.Now(),
+		RetryAfter: retryAfter,
+	})
+}
+
+func NewSearchRequest(query string, chatID string, limit int) WSMessage {
+	return NewWSMessage(SearchMsg, SearchRequest{
+		Query:  query,
+		ChatID: chatID,
+		Limit:  limit,
+	})
+}
+
+func NewSearchResult(query string, hits []TextMessage) WSMessage {
+	return NewWSMessage(SearchResultMsg, SearchResult{
+		Query: query,
+		Hits:  hits,
+	})
+}
+
+func NewHistoryRequest(chatID string, after string, limit int) WSMessage {
+	return NewWSMessage(HistoryMsg, HistoryRequest{
+		ChatID: chatID,
+		After:  after,
+		Limit:  limit,
+	})
+}
+
+func NewHistoryResult(chatID string, users []user.User, messages []TextMessage, more bool) WSMessage {
+	return NewWSMessage(HistoryResultMsg, HistoryResult{
+		ChatID:   chatID,
+		Users:    users,
+		Messages: messages,
+		More:     more,
+	})
+}
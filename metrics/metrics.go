@@ -0,0 +1,383 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// DefaultBuckets suits latencies measured in seconds, from 100µs to 10s.
+	DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+	Default = NewRegistry()
+)
+
+type (
+	// Registry holds metrics and writes them out in the Prometheus text
+	// exposition format.
+	Registry struct {
+		sync.Mutex
+		metrics []metric
+	}
+
+	metric interface {
+		write(w io.Writer)
+	}
+
+	Counter struct {
+		value atomic.Uint64
+	}
+
+	CounterVec struct {
+		sync.Mutex
+		name     string
+		help     string
+		label    string
+		counters map[string]*Counter
+	}
+
+	Gauge struct {
+		value atomic.Int64
+	}
+
+	Histogram struct {
+		sync.Mutex
+		buckets []float64
+		counts  []uint64
+		sum     float64
+		count   uint64
+	}
+
+	HistogramVec struct {
+		sync.Mutex
+		name       string
+		help       string
+		label      string
+		buckets    []float64
+		histograms map[string]*Histogram
+	}
+
+	counterMetric struct {
+		name    string
+		help    string
+		counter *Counter
+	}
+
+	gaugeMetric struct {
+		name  string
+		help  string
+		gauge *Gauge
+	}
+
+	gaugeFuncMetric struct {
+		name string
+		help string
+		fn   func() float64
+	}
+
+	histogramMetric struct {
+		name      string
+		help      string
+		histogram *Histogram
+	}
+)
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) Expose(w io.Writer) {
+	r.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the registry on an HTTP endpoint such as /metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Expose(w)
+	})
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(&counterMetric{name: name, help: help, counter: c})
+	return c
+}
+
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	cv := &CounterVec{
+		name:     name,
+		help:     help,
+		label:    label,
+		counters: make(map[string]*Counter),
+	}
+	r.register(cv)
+	return cv
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(&gaugeMetric{name: name, help: help, gauge: g})
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFuncMetric{name: name, help: help, fn: fn})
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(&histogramMetric{name: name, help: help, histogram: h})
+	return h
+}
+
+func (r *Registry) NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	hv := &HistogramVec{
+		name:       name,
+		help:       help,
+		label:      label,
+		buckets:    buckets,
+		histograms: make(map[string]*Histogram),
+	}
+	r.register(hv)
+	return hv
+}
+
+func NewCounter(name, help string) *Counter {
+	return Default.NewCounter(name, help)
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	return Default.NewCounterVec(name, help, label)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return Default.NewGauge(name, help)
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.NewGaugeFunc(name, help, fn)
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	return Default.NewHistogramVec(name, help, label, buckets)
+}
+
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// HandlerFor serves several registries as one exposition, in order.
+// Their metric names must not overlap.
+func HandlerFor(registries ...*Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, r := range registries {
+			r.Expose(w)
+		}
+	})
+}
+
+//************* COUNTER **************
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (cm *counterMetric) write(w io.Writer) {
+	writeHeader(w, cm.name, cm.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", cm.name, cm.counter.Value())
+}
+
+func (cv *CounterVec) WithLabel(value string) *Counter {
+	cv.Lock()
+	defer cv.Unlock()
+
+	c, ok := cv.counters[value]
+	if !ok {
+		c = &Counter{}
+		cv.counters[value] = c
+	}
+
+	return c
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	writeHeader(w, cv.name, cv.help, "counter")
+
+	cv.Lock()
+	defer cv.Unlock()
+
+	for _, value := range sortedKeys(cv.counters) {
+		fmt.Fprintf(w, "%s{%s} %d\n", cv.name, labelPair(cv.label, value), cv.counters[value].Value())
+	}
+}
+
+//************* GAUGE **************
+
+func (g *Gauge) Set(v int64) {
+	g.value.Store(v)
+}
+
+func (g *Gauge) Add(n int64) {
+	g.value.Add(n)
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+func (gm *gaugeMetric) write(w io.Writer) {
+	writeHeader(w, gm.name, gm.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", gm.name, gm.gauge.Value())
+}
+
+func (gf *gaugeFuncMetric) write(w io.Writer) {
+	writeHeader(w, gf.name, gf.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gf.name, formatFloat(gf.fn()))
+}
+
+//************* HISTOGRAM **************
+
+func newHistogram(buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) writeSeries(w io.Writer, name string, labels string) {
+	h.Lock()
+	defer h.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func (hm *histogramMetric) write(w io.Writer) {
+	writeHeader(w, hm.name, hm.help, "histogram")
+	hm.histogram.writeSeries(w, hm.name, "")
+}
+
+func (hv *HistogramVec) WithLabel(value string) *Histogram {
+	hv.Lock()
+	defer hv.Unlock()
+
+	h, ok := hv.histograms[value]
+	if !ok {
+		h = newHistogram(hv.buckets)
+		hv.histograms[value] = h
+	}
+
+	return h
+}
+
+func (hv *HistogramVec) write(w io.Writer) {
+	writeHeader(w, hv.name, hv.help, "histogram")
+
+	hv.Lock()
+	defer hv.Unlock()
+
+	for _, value := range sortedKeys(hv.histograms) {
+		hv.histograms[value].writeSeries(w, hv.name, labelPair(hv.label, value))
+	}
+}
+
+//************* FORMATTING **************
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func labelPair(label, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf("%s=\"%s\"", label, value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Bell rings the terminal bell.
+	Bell Method = iota
+	// OSC9 is the desktop notification iTerm2, WezTerm, kitty and
+	// Windows Terminal understand.
+	OSC9
+	// OSC777 is the desktop notification of urxvt, foot and VTE based
+	// terminals like GNOME Terminal.
+	OSC777
+)
+
+var (
+	// MaxBody keeps notifications to a glance.
+	MaxBody = 200
+
+	methodNames = map[string]Method{
+		"bell":   Bell,
+		"osc9":   OSC9,
+		"osc777": OSC777,
+	}
+)
+
+type (
+	Method int
+
+	// Notifier gets the user's attention through the terminal.
+	Notifier struct {
+		out     io.Writer
+		methods []Method
+	}
+)
+
+func New(methods ...Method) *Notifier {
+	return &Notifier{
+		out:     os.Stdout,
+		methods: methods,
+	}
+}
+
+// Parse builds a Notifier from a comma separated list of methods, e.g.
+// "bell,osc9". "off" or "" notifies nobody.
+func Parse(spec string) (*Notifier, error) {
+	n := New()
+
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "off" {
+			continue
+		}
+
+		m, ok := methodNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown notification method %q, want bell, osc9, osc777 or off", name)
+		}
+		n.methods = append(n.methods, m)
+	}
+
+	return n, nil
+}
+
+// WithOutput writes to w instead of stdout.
+func (n *Notifier) WithOutput(w io.Writer) *Notifier {
+	n.out = w
+	return n
+}
+
+func (n *Notifier) Enabled() bool {
+	return len(n.methods) > 0
+}
+
+// Notify sends title and body by every configured method.
+func (n *Notifier) Notify(title string, body string) error {
+	title, body = clean(title, MaxBody), clean(body, MaxBody)
+
+	var sb strings.Builder
+	for _, m := range n.methods {
+		switch m {
+		case Bell:
+			sb.WriteString("\a")
+		case OSC9:
+			fmt.Fprintf(&sb, "\x1b]9;%s: %s\x07", title, body)
+		case OSC777:
+			// The title ends at the first ';'.
+			fmt.Fprintf(&sb, "\x1b]777;notify;%s;%s\x07", strings.ReplaceAll(title, ";", ","), body)
+		}
+	}
+
+	if sb.Len() == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(n.out, sb.String())
+	return err
+}
+
+// clean keeps s from ending the escape sequence early or filling the
+// screen: control characters become spaces and it is cut to limit runes.
+func clean(s string, limit int) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+
+	if r := []rune(s); len(r) > limit {
+		s = string(r[:limit-1]) + "…"
+	}
+
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// now is the clock buckets refill by; tests replace it.
+var now = time.Now
+
+type (
+	// Bucket is a token bucket: it holds up to Burst tokens and refills
+	// at Rate tokens per second. Each allowed event takes one token.
+	Bucket struct {
+		sync.Mutex
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+
+	// Limiter hands out one Bucket per key, e.g. per chat ID.
+	Limiter struct {
+		sync.Mutex
+		rate    float64
+		burst   int
+		buckets map[string]*Bucket
+	}
+)
+
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now(),
+	}
+}
+
+// Allow takes a token if one is available. When it isn't, Allow returns
+// false along with how long until the next token is due.
+func (b *Bucket) Allow() (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	t := now()
+	b.tokens += t.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = t
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if b.rate <= 0 {
+		return false, time.Duration(1<<63 - 1)
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*Bucket),
+	}
+}
+
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.bucket(key).Allow()
+}
+
+func (l *Limiter) bucket(key string) *Bucket {
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+
+	return b
+}
+
+// Forget drops the bucket for key, e.g. once the chat is gone.
+func (l *Limiter) Forget(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.buckets, key)
+}
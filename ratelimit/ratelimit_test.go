@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock makes now return a time the test moves by hand.
+func fakeClock(t *testing.T) *time.Time {
+	t.Helper()
+
+	clock := time.Unix(1_700_000_000, 0)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+
+	return &clock
+}
+
+func TestBucketBurst(t *testing.T) {
+	fakeClock(t)
+
+	b := NewBucket(1, 3)
+	for i := range 3 {
+		if ok, _ := b.Allow(); !ok {
+			t.Fatalf("event %d of the burst refused", i+1)
+		}
+	}
+
+	ok, wait := b.Allow()
+	if ok {
+		t.Fatal("event past the burst allowed")
+	}
+	if wait != time.Second {
+		t.Fatalf("wait %s, want 1s", wait)
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	clock := fakeClock(t)
+
+	b := NewBucket(2, 2)
+	b.Allow()
+	b.Allow()
+
+	*clock = clock.Add(250 * time.Millisecond)
+	ok, wait := b.Allow()
+	if ok {
+		t.Fatal("allowed with half a token")
+	}
+	if wait != 250*time.Millisecond {
+		t.Fatalf("wait %s, want 250ms", wait)
+	}
+
+	*clock = clock.Add(250 * time.Millisecond)
+	if ok, _ := b.Allow(); !ok {
+		t.Fatal("refused with a whole token")
+	}
+
+	// A long pause refills no more than the burst.
+	*clock = clock.Add(time.Hour)
+	for i := range 2 {
+		if ok, _ := b.Allow(); !ok {
+			t.Fatalf("event %d after the pause refused", i+1)
+		}
+	}
+	if ok, _ := b.Allow(); ok {
+		t.Fatal("a pause refilled past the burst")
+	}
+}
+
+func TestBucketWithoutRate(t *testing.T) {
+	fakeClock(t)
+
+	b := NewBucket(0, 1)
+	b.Allow()
+	if ok, wait := b.Allow(); ok || wait <= 0 {
+		t.Fatalf("Allow = %t, %s on an empty bucket that never refills", ok, wait)
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	fakeClock(t)
+
+	l := NewLimiter(1, 1)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("first event for a refused")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("second event for a allowed")
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("b was limited by a's bucket")
+	}
+
+	// A forgotten key starts over with a full bucket.
+	l.Forget("a")
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("a still limited after Forget")
+	}
+}
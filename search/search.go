@@ -0,0 +1,206 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sweetspeak/message"
+	"sync"
+	"unicode"
+)
+
+var (
+	// DefaultLimit caps the hits of a query that doesn't say.
+	DefaultLimit = 50
+)
+
+type (
+	// Index is an in-memory inverted index over text messages. Queries
+	// match messages containing every word of the query; the last word
+	// may be a prefix, so results show up while it's being typed.
+	Index struct {
+		sync.RWMutex
+		messages []message.TextMessage
+		ids      map[string]bool
+		postings map[string][]int
+	}
+
+	Query struct {
+		Text string
+		// ChatIDs limits the search to these chats; nil means all.
+		ChatIDs []string
+		Limit   int
+	}
+)
+
+func NewIndex() *Index {
+	return &Index{
+		ids:      make(map[string]bool),
+		postings: make(map[string][]int),
+	}
+}
+
+// Add indexes tm. A message already indexed under the same ID is
+// skipped, so history can be added more than once.
+func (ix *Index) Add(tm message.TextMessage) {
+	ix.Lock()
+	defer ix.Unlock()
+
+	if tm.ID != "" {
+		if ix.ids[tm.ID] {
+			return
+		}
+		ix.ids[tm.ID] = true
+	}
+
+	doc := len(ix.messages)
+	ix.messages = append(ix.messages, tm)
+
+	seen := make(map[string]bool)
+	for _, term := range Tokenize(tm.Content + " " + tm.From.Name) {
+		if !seen[term] {
+			seen[term] = true
+			ix.postings[term] = append(ix.postings[term], doc)
+		}
+	}
+}
+
+func (ix *Index) Len() int {
+	ix.RLock()
+	defer ix.RUnlock()
+
+	return len(ix.messages)
+}
+
+// Search returns the messages matching q, newest first.
+func (ix *Index) Search(q Query) []message.TextMessage {
+	terms := Tokenize(q.Text)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	var allowed map[string]bool
+	if q.ChatIDs != nil {
+		allowed = make(map[string]bool, len(q.ChatIDs))
+		for _, id := range q.ChatIDs {
+			allowed[id] = true
+		}
+	}
+
+	ix.RLock()
+	defer ix.RUnlock()
+
+	var docs []int
+	for i, term := range terms {
+		var matches []int
+		if i == len(terms)-1 {
+			matches = ix.prefixed(term)
+		} else {
+			matches = ix.postings[term]
+		}
+
+		if i == 0 {
+			docs = matches
+		} else {
+			docs = intersect(docs, matches)
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+	}
+
+	var hits []message.TextMessage
+	for i := len(docs) - 1; i >= 0 && len(hits) < limit; i-- {
+		tm := ix.messages[docs[i]]
+		if allowed == nil || allowed[tm.ChatID] {
+			hits = append(hits, tm)
+		}
+	}
+
+	return hits
+}
+
+// prefixed returns the sorted documents with a term starting with
+// prefix. RLock must be held.
+func (ix *Index) prefixed(prefix string) []int {
+	var docs []int
+	for term, postings := range ix.postings {
+		if strings.HasPrefix(term, prefix) {
+			docs = append(docs, postings...)
+		}
+	}
+	sort.Ints(docs)
+
+	return dedupe(docs)
+}
+
+// Tokenize splits s into lower case words.
+func Tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Snippet cuts content down to about width runes around the first match
+// of query, on one line, so a hit can be shown with its context.
+func Snippet(content string, query string, width int) string {
+	content = strings.Join(strings.Fields(content), " ")
+
+	runes := []rune(content)
+	if len(runes) <= width {
+		return content
+	}
+
+	at := 0
+	lower := strings.ToLower(content)
+	for _, term := range Tokenize(query) {
+		if i := strings.Index(lower, term); i >= 0 {
+			at = len([]rune(lower[:i]))
+			break
+		}
+	}
+
+	start := max(0, min(at-width/3, len(runes)-width))
+	end := min(len(runes), start+width)
+
+	snippet := string(runes[start:end])
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+
+	return snippet
+}
+
+func intersect(a, b []int) []int {
+	var out []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func dedupe(sorted []int) []int {
+	out := sorted[:0]
+	for i, v := range sorted {
+		if i == 0 || v != sorted[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
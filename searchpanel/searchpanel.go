@@ -0,0 +1,249 @@
+package searchpanel
+
+import (
+	"fmt"
+	"strings"
+	"sweetspeak/message"
+	"sweetspeak/search"
+	"sweetspeak/theme"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	// SearchDelay is how long typing has to pause before a search runs.
+	SearchDelay = 250 * time.Millisecond
+
+	titleStyle    = lipgloss.NewStyle().Bold(true)
+	helpStyle     = lipgloss.NewStyle()
+	hitStyle      = lipgloss.NewStyle().PaddingLeft(2)
+	selectedStyle = lipgloss.NewStyle().PaddingLeft(1).
+			Border(lipgloss.NormalBorder(), false, false, false, true)
+	metaStyle  = lipgloss.NewStyle()
+	matchStyle = lipgloss.NewStyle().Bold(true)
+)
+
+func init() {
+	theme.OnChange(func(t theme.Theme) {
+		titleStyle = titleStyle.Foreground(t.Title)
+		helpStyle = helpStyle.Foreground(t.Subtle)
+		selectedStyle = selectedStyle.BorderForeground(t.Accent)
+		metaStyle = metaStyle.Foreground(t.Meta)
+		matchStyle = matchStyle.Foreground(t.Highlight)
+	})
+}
+
+type (
+	// Model is the ctrl+f overlay: a query and the hits for it across
+	// every chat.
+	Model struct {
+		input    textinput.Model
+		search   SearchFunc
+		hits     []Hit
+		selected int
+		seq      int
+		status   string
+		width    int
+		height   int
+	}
+
+	Hit struct {
+		Message message.TextMessage
+		// Chat is the name to show for the hit's chat.
+		Chat string
+	}
+
+	// SearchFunc runs a query. It is called off the update loop.
+	SearchFunc func(query string) ([]Hit, error)
+
+	// QueryMsg runs the search typed so far, unless more was typed since.
+	QueryMsg struct {
+		Seq int
+	}
+
+	ResultsMsg struct {
+		Seq  int
+		Hits []Hit
+		Err  error
+	}
+
+	// JumpMsg asks for the chat view to show a hit.
+	JumpMsg struct {
+		ChatID    string
+		MessageID string
+	}
+
+	CloseMsg struct{}
+)
+
+func New(search SearchFunc) Model {
+	m := Model{
+		input:  textinput.New(),
+		search: search,
+	}
+
+	m.input.Placeholder = "search all chats..."
+	m.input.Prompt = "/ "
+
+	return m
+}
+
+func (m *Model) SetSize(width, height int) *Model {
+	m.width = width
+	m.height = height
+	m.input.Width = width - 4
+	return m
+}
+
+// Open clears the last search and focuses the query.
+func (m Model) Open() (Model, tea.Cmd) {
+	m.input.Reset()
+	m.hits = nil
+	m.selected = 0
+	m.status = ""
+	m.seq++
+
+	return m, m.input.Focus()
+}
+
+func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "esc", "ctrl+f":
+			return m, func() tea.Msg { return CloseMsg{} }
+		case "up", "ctrl+p":
+			m.selected = max(m.selected-1, 0)
+			return m, nil
+		case "down", "ctrl+n":
+			m.selected = min(m.selected+1, max(len(m.hits)-1, 0))
+			return m, nil
+		case "enter":
+			if len(m.hits) == 0 {
+				return m, nil
+			}
+			hit := m.hits[m.selected].Message
+			return m, func() tea.Msg {
+				return JumpMsg{ChatID: hit.ChatID, MessageID: hit.ID}
+			}
+		}
+
+		before := m.input.Value()
+
+		var cmd tea.Cmd
+		m.input, cmd = m.input.Update(msg)
+		if m.input.Value() == before {
+			return m, cmd
+		}
+
+		m.seq++
+		seq := m.seq
+		return m, tea.Batch(cmd, tea.Tick(SearchDelay, func(time.Time) tea.Msg {
+			return QueryMsg{Seq: seq}
+		}))
+	case QueryMsg:
+		query := strings.TrimSpace(m.input.Value())
+		if msg.Seq != m.seq {
+			return m, nil
+		}
+		if query == "" {
+			m.hits, m.status = nil, ""
+			return m, nil
+		}
+
+		m.status = "searching..."
+		seq, run := m.seq, m.search
+		return m, func() tea.Msg {
+			hits, err := run(query)
+			return ResultsMsg{Seq: seq, Hits: hits, Err: err}
+		}
+	case ResultsMsg:
+		if msg.Seq != m.seq {
+			return m, nil
+		}
+
+		m.hits = msg.Hits
+		m.selected = 0
+		m.status = fmt.Sprintf("%d hit(s)", len(m.hits))
+		if msg.Err != nil {
+			m.status += fmt.Sprintf(", server search failed: %v", msg.Err)
+		}
+	}
+
+	return m, nil
+}
+
+func (m Model) View() string {
+	lines := []string{
+		titleStyle.Render("Search"),
+		m.input.View(),
+		helpStyle.Render(strings.TrimPrefix(m.status+"  ↑/↓ select · enter jump · esc close", "  ")),
+		"",
+	}
+
+	// Each hit takes two lines; keep the selected one in view.
+	fit := max((m.height-len(lines))/2, 1)
+	first := max(0, m.selected-fit+1)
+
+	query := m.input.Value()
+	for i := first; i < len(m.hits) && i < first+fit; i++ {
+		hit := m.hits[i]
+
+		meta := metaStyle.Render(fmt.Sprintf("%s · %s · %s",
+			hit.Chat, hit.Message.Timestamp.Local().Format("Jan 2 15:04"), hit.Message.From.Name))
+		snippet := highlight(search.Snippet(hit.Message.Content, query, max(m.width-6, 20)), query)
+
+		style := hitStyle
+		if i == m.selected {
+			style = selectedStyle
+		}
+		lines = append(lines, style.Render(meta+"\n"+snippet))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// highlight marks every word of query found in s.
+func highlight(s string, query string) string {
+	lower := strings.ToLower(s)
+
+	var marks []bool
+	for _, term := range search.Tokenize(query) {
+		for i := 0; ; {
+			j := strings.Index(lower[i:], term)
+			if j < 0 {
+				break
+			}
+			if marks == nil {
+				marks = make([]bool, len(s))
+			}
+			for k := i + j; k < i+j+len(term) && k < len(marks); k++ {
+				marks[k] = true
+			}
+			i += j + len(term)
+		}
+	}
+	// Lower casing changed the length; don't risk splitting a rune.
+	if marks == nil || len(lower) != len(s) {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && marks[j] == marks[i] {
+			j++
+		}
+		if marks[i] {
+			sb.WriteString(matchStyle.Render(s[i:j]))
+		} else {
+			sb.WriteString(s[i:j])
+		}
+		i = j
+	}
+
+	return sb.String()
+}
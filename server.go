@@ -1,14 +1,87 @@
 package main
 
 import (
+        "flag"
+        "strings"
+        "sweetspeak/bus"
+        "sweetspeak/consts"
         log "sweetspeak/logging"
         "sweetspeak/server"
+        "sweetspeak/store"
 )
 
+var (
+        policyFile = flag.String("policy", "", "YAML admission policy (origins, IP lists, connection caps)")
+        addr       = flag.String("addr", consts.Addr, "address to serve clients on")
+        adminAddr  = flag.String("admin-addr", consts.AdminAddr, "address for the admin interface")
+        adminToken = flag.String("admin-token-file", consts.AdminTokenFile, "file the admin interface token is written to")
+        storeFile  = flag.String("store", "sweetspeak-server.yaml", "store file name in the data directory")
+
+        // Clients are not authenticated, so history is off unless asked for.
+        unsafeHistory = flag.Bool("unsafe-history", false, "serve chat history and search to any client claiming a member's name")
+
+        // Running several nodes of one deployment.
+        nodeID    = flag.String("node", "", "node ID; enables the inter-server bus")
+        busListen = flag.String("bus-listen", "127.0.0.1:9996", "address to accept other nodes on")
+        busPeers  = flag.String("peers", "", "comma separated bus addresses of every other node")
+
+        federationFile = flag.String("federation", "", "YAML federation config (domain, listen address, peers)")
+)
 
 func main() {
+        flag.Parse()
+
+        consts.Addr = *addr
+        consts.AdminAddr = *adminAddr
+        consts.AdminTokenFile = *adminToken
+
         log.SetGlobalFile("sweetspeak-server.log")
 
-        ss := server.New()
+        st, err := store.Open(*storeFile)
+        if err != nil {
+                panic(err)
+        }
+
+        ss := server.New().WithStore(st)
+
+        if *unsafeHistory {
+                log.Warn("serving chat history to unauthenticated clients")
+                ss.WithHistory()
+        }
+
+        if *policyFile != "" {
+                policy, err := server.LoadAdmissionPolicy(*policyFile)
+                if err != nil {
+                        panic(err)
+                }
+                ss.WithAdmissionPolicy(policy)
+        }
+
+        if *nodeID != "" {
+                var peers []string
+                if *busPeers != "" {
+                        peers = strings.Split(*busPeers, ",")
+                }
+
+                mesh := bus.NewMesh(*nodeID, *busListen, peers)
+                if err := mesh.Start(); err != nil {
+                        panic(err)
+                }
+                ss.WithBus(mesh)
+        }
+
+        if *federationFile != "" {
+                cfg, err := server.LoadFederationConfig(*federationFile)
+                if err != nil {
+                        panic(err)
+                }
+
+                link := bus.NewMesh(cfg.Domain, cfg.Listen, cfg.PeerAddrs()).WithAuth(cfg.Secrets())
+                if err := link.Start(); err != nil {
+                        panic(err)
+                }
+                ss.WithFederation(cfg.Domain, link)
+        }
+
         ss.Start()
 }
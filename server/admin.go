@@ -0,0 +1,288 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sweetspeak/consts"
+	log "sweetspeak/logging"
+	"sweetspeak/message"
+	"sweetspeak/metrics"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	AdminClient struct {
+		ClientID   string `yaml:"client_id"`
+		Name       string `yaml:"name"`
+		RemoteAddr string `yaml:"remote_addr"`
+		Latency    string `yaml:"latency"`
+	}
+
+	AdminChat struct {
+		ID       string   `yaml:"id"`
+		Name     string   `yaml:"name"`
+		Members  []string `yaml:"members"`
+		Online   []string `yaml:"online"`
+		Messages int      `yaml:"messages"`
+	}
+)
+
+// WithAdminToken sets the bearer token the admin interface asks for.
+// Without one, Start makes one up and writes it to
+// consts.AdminTokenFile, where sweetspeak-admin reads it.
+func (s *Server) WithAdminToken(token string) *Server {
+	s.adminToken = token
+	return s
+}
+
+func (s *Server) ensureAdminToken() error {
+	if s.adminToken != "" {
+		return nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(secret)
+
+	// Only the operator may read it, whatever an old file allowed.
+	os.Remove(consts.AdminTokenFile)
+	if err := os.WriteFile(consts.AdminTokenFile, []byte(token+"\n"), 0o600); err != nil {
+		return err
+	}
+	s.adminToken = token
+
+	log.Info("admin token written to %s", consts.AdminTokenFile)
+
+	return nil
+}
+
+// AdminHandler serves the operator control interface used by
+// sweetspeak-admin. It must only ever be exposed on localhost.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /clients", s.adminListClients)
+	mux.HandleFunc("GET /chats", s.adminListChats)
+	mux.HandleFunc("GET /bans", s.adminListBans)
+	mux.HandleFunc("POST /kick", s.adminKick)
+	mux.HandleFunc("POST /ban", s.adminBan)
+	mux.HandleFunc("POST /unban", s.adminUnban)
+	mux.HandleFunc("POST /broadcast", s.adminBroadcast)
+	mux.HandleFunc("GET /loglevel", s.adminGetLogLevel)
+	mux.HandleFunc("POST /loglevel", s.adminSetLogLevel)
+	// Metrics stay on the admin interface, off the public client port.
+	mux.Handle("GET /metrics", metrics.HandlerFor(metrics.Default, s.metrics))
+
+	return s.adminAuth(mux)
+}
+
+// adminAuth lets through only requests bearing the admin token. Requests
+// made by web pages, which carry an Origin, are refused outright: being
+// on localhost does not stop a page the operator visits from posting to
+// the admin interface.
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			http.Error(w, "cross-origin requests are refused", http.StatusForbidden)
+			return
+		}
+
+		want := "Bearer " + s.adminToken
+		got := r.Header.Get("Authorization")
+		if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			http.Error(w, "missing or wrong admin token", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) adminListClients(w http.ResponseWriter, r *http.Request) {
+	snapshot := s.clients.snapshot()
+	clients := make([]AdminClient, 0, len(snapshot))
+	for _, c := range snapshot {
+		clients = append(clients, AdminClient{
+			ClientID:   c.ClientID,
+			Name:       c.User.Name,
+			RemoteAddr: c.RemoteAddr,
+			Latency:    c.WSHandler.Latency().String(),
+		})
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Name < clients[j].Name
+	})
+
+	writeYAML(w, clients)
+}
+
+func (s *Server) adminListChats(w http.ResponseWriter, r *http.Request) {
+	snapshot := s.chats.snapshot()
+	chats := make([]AdminChat, 0, len(snapshot))
+	for _, c := range snapshot {
+		c.Lock()
+		ac := AdminChat{
+			ID:       c.ID,
+			Name:     c.Name,
+			Messages: len(c.Messages),
+		}
+		for _, u := range c.Users {
+			ac.Members = append(ac.Members, u.Name)
+			if s.LookupClient("", u.Name) != nil {
+				ac.Online = append(ac.Online, u.Name)
+			}
+		}
+		c.Unlock()
+
+		chats = append(chats, ac)
+	}
+
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].Name < chats[j].Name
+	})
+
+	writeYAML(w, chats)
+}
+
+func (s *Server) adminListBans(w http.ResponseWriter, r *http.Request) {
+	s.banMu.Lock()
+	bans := make([]string, 0, len(s.banned))
+	for name := range s.banned {
+		bans = append(bans, name)
+	}
+	s.banMu.Unlock()
+
+	sort.Strings(bans)
+
+	writeYAML(w, bans)
+}
+
+func (s *Server) adminKick(w http.ResponseWriter, r *http.Request) {
+	userName := r.URL.Query().Get("user")
+	if userName == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	if !s.Kick(userName, "kicked by an operator") {
+		http.Error(w, fmt.Sprintf("%s is not connected", userName), http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprintf(w, "kicked %s\n", userName)
+}
+
+func (s *Server) adminBan(w http.ResponseWriter, r *http.Request) {
+	userName := r.URL.Query().Get("user")
+	if userName == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	s.banMu.Lock()
+	s.banned[userName] = true
+	s.banMu.Unlock()
+
+	log.Warn("admin: banned %s", userName)
+	s.Kick(userName, "banned by an operator")
+
+	fmt.Fprintf(w, "banned %s\n", userName)
+}
+
+func (s *Server) adminUnban(w http.ResponseWriter, r *http.Request) {
+	userName := r.URL.Query().Get("user")
+	if userName == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	s.banMu.Lock()
+	delete(s.banned, userName)
+	s.banMu.Unlock()
+
+	log.Warn("admin: unbanned %s", userName)
+
+	fmt.Fprintf(w, "unbanned %s\n", userName)
+}
+
+func (s *Server) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	text, err := io.ReadAll(r.Body)
+	if err != nil || len(text) == 0 {
+		http.Error(w, "missing announcement text", http.StatusBadRequest)
+		return
+	}
+
+	sent := s.Broadcast(message.NewNotice(message.AnnouncementNotice, string(text)))
+
+	fmt.Fprintf(w, "announcement sent to %d clients\n", sent)
+}
+
+func (s *Server) adminGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%s\n", log.LogNames[log.GetGlobalLevel()])
+}
+
+func (s *Server) adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	level, err := log.ParseLevel(r.URL.Query().Get("level"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.SetGlobalLevel(level)
+	log.Info("admin: log level set to %s", log.LogNames[level])
+
+	fmt.Fprintf(w, "log level set to %s\n", log.LogNames[level])
+}
+
+// Kick tells the named user why and drops every connection they have.
+// It reports whether the user was connected.
+func (s *Server) Kick(userName string, reason string) bool {
+	clients := s.clients.lookupAll(userName)
+
+	for _, client := range clients {
+		log.Warn("kicking %s: %s", client.String(), reason)
+
+		if err := client.Send(message.NewNotice(message.KickedNotice, reason)); err != nil {
+			log.Warn("kick: notify %s: %v", client.String(), err)
+		}
+		client.WSHandler.CloseWithCode(websocket.ClosePolicyViolation, reason)
+	}
+
+	return len(clients) > 0
+}
+
+// Broadcast sends wsMsg to every connected client and returns how many
+// it was queued for.
+func (s *Server) Broadcast(wsMsg message.WSMessage) int {
+	sent := 0
+	for _, c := range s.clients.snapshot() {
+		if err := c.Send(wsMsg); err != nil {
+			log.Warn("broadcast: %s: %v", c.String(), err)
+			continue
+		}
+		sent++
+	}
+
+	return sent
+}
+
+func writeYAML(w http.ResponseWriter, v interface{}) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
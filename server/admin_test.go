@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sweetspeak/message"
+	"sweetspeak/websockets"
+	"testing"
+)
+
+func adminRequest(t *testing.T, url string, token string, origin string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestAdminNeedsToken(t *testing.T) {
+	s := New().WithAdminToken("secret")
+	hs := httptest.NewServer(s.AdminHandler())
+	t.Cleanup(hs.Close)
+
+	url := hs.URL + "/ban?user=bob"
+	for _, tc := range []struct {
+		name   string
+		token  string
+		origin string
+		want   int
+	}{
+		{"no token", "", "", http.StatusUnauthorized},
+		{"wrong token", "guess", "", http.StatusUnauthorized},
+		{"from a web page", "secret", "http://evil.example", http.StatusForbidden},
+		{"operator", "secret", "", http.StatusOK},
+	} {
+		if got := adminRequest(t, url, tc.token, tc.origin); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	s.banMu.Lock()
+	defer s.banMu.Unlock()
+	if !s.banned["bob"] {
+		t.Fatal("the operator's ban did not stick")
+	}
+}
+
+func TestBanDropsEveryConnection(t *testing.T) {
+	s := New().WithAdminToken("secret")
+	addr := serve(t, s)
+	hs := httptest.NewServer(s.AdminHandler())
+	t.Cleanup(hs.Close)
+
+	first := connect(t, addr, "bob")
+	second := connect(t, addr, "bob")
+	waitUntil(t, "both connections", func() bool {
+		return len(s.clients.lookupAll("bob")) == 2
+	})
+
+	if got := adminRequest(t, hs.URL+"/ban?user=bob", "secret", ""); got != http.StatusOK {
+		t.Fatalf("ban: status %d", got)
+	}
+
+	waitUntil(t, "bob to be dropped", func() bool {
+		return s.LookupClient("", "bob") == nil
+	})
+	for _, ws := range []*websockets.WebsocketHandler{first, second} {
+		expect(t, ws, message.NoticeMsg)
+	}
+}
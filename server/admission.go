@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// AdmissionPolicy decides which websocket connections the server
+	// accepts. Zero values mean "no restriction".
+	AdmissionPolicy struct {
+		// AllowedOrigins lists browser origins (scheme://host[:port]) that
+		// may connect in addition to the server's own host. "*" allows any
+		// origin. Requests without an Origin header (native clients) are
+		// always allowed.
+		AllowedOrigins []string `yaml:"allowed_origins"`
+		// Allow, if not empty, restricts connections to these IPs/CIDRs.
+		Allow []string `yaml:"allow"`
+		// Deny refuses connections from these IPs/CIDRs, even if allowed.
+		Deny          []string `yaml:"deny"`
+		MaxConnsPerIP int      `yaml:"max_conns_per_ip"`
+		MaxClients    int      `yaml:"max_clients"`
+
+		allowNets []*net.IPNet
+		denyNets  []*net.IPNet
+	}
+
+	admissionError struct {
+		reason string
+		text   string
+		// Cap refusals are reported to the client over the websocket so
+		// it can show why; the rest are plain HTTP 403s.
+		afterUpgrade bool
+	}
+)
+
+func DefaultAdmissionPolicy() *AdmissionPolicy {
+	return &AdmissionPolicy{}
+}
+
+// LoadAdmissionPolicy reads a YAML admission policy from path.
+func LoadAdmissionPolicy(path string) (*AdmissionPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := DefaultAdmissionPolicy()
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("admission policy %s: %v", path, err)
+	}
+
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("admission policy %s: %v", path, err)
+	}
+
+	return p, nil
+}
+
+func (p *AdmissionPolicy) compile() error {
+	var err error
+
+	if p.allowNets, err = parseNets(p.Allow); err != nil {
+		return err
+	}
+
+	if p.denyNets, err = parseNets(p.Deny); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("bad address %q: %v", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func (p *AdmissionPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// CheckIP applies the allow and deny lists to ip.
+func (p *AdmissionPolicy) CheckIP(ip net.IP) bool {
+	for _, n := range p.denyNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(p.allowNets) == 0 {
+		return true
+	}
+
+	for _, n := range p.allowNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *admissionError) Error() string {
+	return e.text
+}
+
+// admit checks r against the admission policy and, if it passes, counts
+// the connection against its IP. The caller must call release(ip) once
+// the connection is gone.
+func (s *Server) admit(r *http.Request) (string, *admissionError) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !s.policy.CheckOrigin(r) {
+		return ip, &admissionError{reason: "origin", text: "origin not allowed"}
+	}
+
+	if parsed := net.ParseIP(ip); parsed == nil || !s.policy.CheckIP(parsed) {
+		return ip, &admissionError{reason: "denied_ip", text: "address not allowed"}
+	}
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.policy.MaxClients > 0 && s.totalConns >= s.policy.MaxClients {
+		return ip, &admissionError{reason: "server_full", text: "server is full, try again later", afterUpgrade: true}
+	}
+
+	if s.policy.MaxConnsPerIP > 0 && s.connsPerIP[ip] >= s.policy.MaxConnsPerIP {
+		return ip, &admissionError{reason: "ip_cap", text: "too many connections from your address", afterUpgrade: true}
+	}
+
+	s.connsPerIP[ip]++
+	s.totalConns++
+
+	return ip, nil
+}
+
+func (s *Server) release(ip string) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+	s.totalConns--
+}
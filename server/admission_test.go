@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sweetspeak/message"
+	"testing"
+)
+
+func request(remoteAddr string, origin string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://chat.example/", nil)
+	r.RemoteAddr = remoteAddr
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	return r
+}
+
+func TestAdmissionCaps(t *testing.T) {
+	s := New().WithAdmissionPolicy(&AdmissionPolicy{MaxClients: 3, MaxConnsPerIP: 2})
+
+	for i, tc := range []struct {
+		remoteAddr string
+		reason     string
+	}{
+		{"192.0.2.1:1000", ""},
+		{"192.0.2.1:1001", ""},
+		{"192.0.2.1:1002", "ip_cap"},
+		{"192.0.2.2:1000", ""},
+		{"192.0.2.3:1000", "server_full"},
+	} {
+		_, err := s.admit(request(tc.remoteAddr, ""))
+		switch {
+		case tc.reason == "" && err != nil:
+			t.Fatalf("connection %d refused: %v", i, err)
+		case tc.reason != "" && (err == nil || err.reason != tc.reason):
+			t.Fatalf("connection %d: %v, want refusal for %s", i, err, tc.reason)
+		case err != nil && !err.afterUpgrade:
+			t.Fatalf("connection %d: cap refusals are reported over the websocket", i)
+		}
+	}
+
+	// Room frees up as connections go.
+	s.release("192.0.2.1")
+	if _, err := s.admit(request("192.0.2.3:1000", "")); err != nil {
+		t.Fatalf("after a release: %v", err)
+	}
+}
+
+func TestAdmissionLists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := "allow: [192.0.2.0/24, 2001:db8::1]\ndeny: [192.0.2.66]\nallowed_origins: [https://web.example]\n"
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := LoadAdmissionPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]bool{
+		"192.0.2.1":    true,
+		"192.0.2.66":   false,
+		"198.51.100.1": false,
+		"2001:db8::1":  true,
+		"2001:db8::2":  false,
+	} {
+		if got := p.CheckIP(net.ParseIP(ip)); got != want {
+			t.Errorf("CheckIP(%s) = %t, want %t", ip, got, want)
+		}
+	}
+
+	for origin, want := range map[string]bool{
+		"":                     true,
+		"https://web.example":  true,
+		"http://chat.example":  true,
+		"https://evil.example": false,
+	} {
+		if got := p.CheckOrigin(request("192.0.2.1:1000", origin)); got != want {
+			t.Errorf("CheckOrigin(%q) = %t, want %t", origin, got, want)
+		}
+	}
+}
+
+func TestAdmissionRefusesOverTheWebsocket(t *testing.T) {
+	s := New().WithAdmissionPolicy(&AdmissionPolicy{MaxClients: 1})
+	addr := serve(t, s)
+
+	connect(t, addr, "alice")
+	waitUntil(t, "alice", func() bool {
+		return s.LookupClient("", "alice") != nil
+	})
+
+	bob := connect(t, addr, "bob")
+	wsMsg := expect(t, bob, message.NoticeMsg)
+	nm, err := wsMsg.ToNotice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nm.Kind != message.RefusedNotice {
+		t.Fatalf("bob got notice %v, want a refusal", nm.Kind)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"sweetspeak/bus"
+	"sweetspeak/chat"
+	log "sweetspeak/logging"
+	"sweetspeak/message"
+	"sweetspeak/user"
+)
+
+// WithBus joins the server to the other nodes of its deployment. Users
+// connected to any node can then chat with each other.
+func (s *Server) WithBus(b bus.Bus) *Server {
+	s.bus = b
+	return s
+}
+
+func (s *Server) handleBusEvents() {
+	defer s.wg.Done()
+
+	log.Info("cluster: node %s handling bus events...", s.bus.NodeID())
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case ev := <-s.bus.Events():
+			busEvents.WithLabel(ev.Kind.String()).Inc()
+			s.handleBusEvent(ev)
+		}
+	}
+}
+
+func (s *Server) handleBusEvent(ev bus.Event) {
+	switch ev.Kind {
+	case bus.PeerUpEvent:
+		log.Info("cluster: node %s is up", ev.From)
+		users := s.localUsers()
+		if err := s.bus.Send(ev.From, bus.Event{Kind: bus.PresenceSyncEvent, Users: users}); err != nil {
+			log.Error("cluster: presence sync to %s: %v", ev.From, err)
+		}
+	case bus.PeerDownEvent:
+		log.Warn("cluster: node %s is down", ev.From)
+		s.presence.drop(ev.From)
+	case bus.PresenceSyncEvent:
+		s.presence.sync(ev.From, ev.Users)
+	case bus.PresenceJoinEvent:
+		for _, u := range ev.Users {
+			s.presence.join(ev.From, u)
+		}
+	case bus.PresenceLeaveEvent:
+		for _, u := range ev.Users {
+			s.presence.leave(ev.From, u.Name)
+		}
+	case bus.ChatEvent:
+		if ev.Chat != nil {
+			s.addRemoteChat(*ev.Chat)
+		}
+	case bus.DeliverEvent:
+		if ev.Message != nil {
+			s.deliver(ev.From, ev.To, *ev.Message)
+		}
+	default:
+		log.Warn("cluster: unknown event %s from %s", ev.Kind, ev.From)
+	}
+}
+
+func (s *Server) localUsers() []user.User {
+	clients := s.clients.snapshot()
+	users := make([]user.User, 0, len(clients))
+	for _, c := range clients {
+		users = append(users, c.User)
+	}
+	return users
+}
+
+// announcePresence tells the other nodes that u connected to or left
+// this one.
+func (s *Server) announcePresence(kind bus.EventKind, u user.User) {
+	if s.bus == nil {
+		return
+	}
+
+	if err := s.bus.Broadcast(bus.Event{Kind: kind, Users: []user.User{u}}); err != nil {
+		log.Error("cluster: announcing %s for %s: %v", kind, u.Name, err)
+	}
+}
+
+// announceChat shares a chat opened on this node, so members connected
+// elsewhere can post to it.
+func (s *Server) announceChat(c *chat.Chat) {
+	if s.bus == nil {
+		return
+	}
+
+	c.Lock()
+	info := &bus.ChatInfo{ID: c.ID, Name: c.Name, Users: c.Users}
+	c.Unlock()
+
+	if err := s.bus.Broadcast(bus.Event{Kind: bus.ChatEvent, Chat: info}); err != nil {
+		log.Error("cluster: announcing chat %s: %v", info.ID, err)
+	}
+}
+
+func (s *Server) addRemoteChat(info bus.ChatInfo) {
+	if s.LookupChat(info.ID) != nil {
+		return
+	}
+
+	newChat := chat.New(info.ID, info.Name, info.Users)
+	s.chats.add(newChat)
+
+	if s.store != nil {
+		if err := s.store.SaveChat(newChat); err != nil {
+			log.Error("cluster: saving chat %s: %v", info.ID, err)
+		}
+	}
+}
+
+// relay asks node to pass wsMsg on to its clients named in to.
+func (s *Server) relay(node string, to []string, wsMsg message.WSMessage) error {
+	return s.bus.Send(node, bus.Event{Kind: bus.DeliverEvent, To: to, Message: &wsMsg})
+}
+
+// deliver hands a message relayed from another node to local clients.
+// Text messages are also recorded in this node's copy of the chat.
+func (s *Server) deliver(from string, to []string, wsMsg message.WSMessage) {
+	if wsMsg.MessageType == message.TextMsg {
+		tm, err := wsMsg.ToTextMessage()
+		if err != nil {
+			log.Error("cluster: text message from %s: %v", from, err)
+			return
+		}
+
+		if c := s.LookupChat(tm.ChatID); c != nil {
+			order := s.chats.ordering(tm.ChatID)
+			order.Lock()
+			defer order.Unlock()
+
+			c.AddMessage(tm)
+			s.index.Add(tm)
+			if s.store != nil {
+				if err := s.store.AppendMessage(tm); err != nil {
+					log.Error("cluster: chat [%s]: saving message: %v", tm.ChatID, err)
+				}
+			}
+		}
+	}
+
+	for _, name := range to {
+		client := s.LookupClient("", name)
+		if client == nil {
+			log.Debug("cluster: %s relayed a message for %s, who is not here", from, name)
+			continue
+		}
+
+		if err := client.Send(wsMsg); err != nil {
+			log.Error("cluster: deliver to %s: %v", client.String(), err)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sweetspeak/bus"
+	"sweetspeak/chat"
+	log "sweetspeak/logging"
+	"sweetspeak/message"
+	"sweetspeak/user"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// FederatedChatTimeout is how long a chat request waits for another
+// domain to answer before its sender is told the user wasn't found.
+var FederatedChatTimeout = 30 * time.Second
+
+type (
+	// FederationConfig links this deployment to independently run
+	// servers. Their users are addressed as user@domain.
+	//
+	//	domain: alpha.example
+	//	listen: 0.0.0.0:9995
+	//	peers:
+	//	  - domain: beta.example
+	//	    addr: beta.example:9995
+	//	    secret: something long and random
+	FederationConfig struct {
+		Domain string           `yaml:"domain"`
+		Listen string           `yaml:"listen"`
+		Peers  []FederationPeer `yaml:"peers"`
+	}
+
+	// FederationPeer is a server we federate with. Both sides must be
+	// configured with the same secret.
+	FederationPeer struct {
+		Domain string `yaml:"domain"`
+		Addr   string `yaml:"addr"`
+		Secret string `yaml:"secret"`
+	}
+
+	// pendingChat is a chat request waiting on another domain's answer.
+	pendingChat struct {
+		domain string
+		client *ServerClient
+		req    message.WSMessage
+		name   string
+	}
+)
+
+// LoadFederationConfig reads a YAML federation config from path.
+func LoadFederationConfig(path string) (*FederationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &FederationConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("federation config %s: %v", path, err)
+	}
+
+	if cfg.Domain == "" || cfg.Listen == "" {
+		return nil, fmt.Errorf("federation config %s: domain and listen are required", path)
+	}
+
+	for _, p := range cfg.Peers {
+		if p.Domain == "" || p.Addr == "" || p.Secret == "" {
+			return nil, fmt.Errorf("federation config %s: peers need a domain, addr and secret", path)
+		}
+	}
+
+	return cfg, nil
+}
+
+func (cfg *FederationConfig) PeerAddrs() []string {
+	addrs := make([]string, 0, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		addrs = append(addrs, p.Addr)
+	}
+	return addrs
+}
+
+func (cfg *FederationConfig) Secrets() map[string]string {
+	secrets := make(map[string]string, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		secrets[p.Domain] = p.Secret
+	}
+	return secrets
+}
+
+// WithFederation federates the server as domain over link, which must
+// authenticate its peers; see bus.Mesh.WithAuth.
+func (s *Server) WithFederation(domain string, link bus.Bus) *Server {
+	s.domain = domain
+	s.federation = link
+	return s
+}
+
+// splitAddress splits user@domain. Plain user names have no domain.
+func splitAddress(addr string) (string, string) {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
+
+// remoteDomain returns the domain of addr if it belongs to another
+// server.
+func (s *Server) remoteDomain(addr string) (string, string, bool) {
+	name, domain := splitAddress(addr)
+	if domain == "" || domain == s.domain {
+		return name, "", false
+	}
+	return name, domain, true
+}
+
+// qualify names a local user the way other domains see them.
+func (s *Server) qualify(u user.User) user.User {
+	u.Name = fmt.Sprintf("%s@%s", u.Name, s.domain)
+	return u
+}
+
+// fromDomain reports whether every user claims to belong to domain, so
+// a peer can only speak for its own users.
+func fromDomain(users []user.User, domain string) bool {
+	for _, u := range users {
+		if _, d := splitAddress(u.Name); d != domain {
+			return false
+		}
+	}
+	return len(users) > 0
+}
+
+func (s *Server) handleFederationEvents() {
+	defer s.wg.Done()
+
+	log.Info("federation: serving %s...", s.domain)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case ev := <-s.federation.Events():
+			federationEvents.WithLabel(ev.Kind.String()).Inc()
+			if err := s.handleFederationEvent(ev); err != nil {
+				log.Warn("federation: %s from %s: %v", ev.Kind, ev.From, err)
+			}
+		}
+	}
+}
+
+func (s *Server) handleFederationEvent(ev bus.Event) error {
+	switch ev.Kind {
+	case bus.PeerUpEvent:
+		log.Info("federation: linked with %s", ev.From)
+	case bus.PeerDownEvent:
+		log.Warn("federation: lost %s", ev.From)
+		s.failPendingChats(s.takePendingChats(func(_ string, pending pendingChat) bool {
+			return pending.domain == ev.From
+		}))
+	case bus.ChatRequestEvent:
+		return s.rcvFederatedChatRequest(ev)
+	case bus.ChatAcceptEvent, bus.ChatRejectEvent:
+		return s.rcvFederatedChatAnswer(ev)
+	case bus.DeliverEvent:
+		return s.rcvFederatedMessage(ev)
+	default:
+		return fmt.Errorf("unexpected event")
+	}
+
+	return nil
+}
+
+// requestFederatedChat asks domain to open a chat between fromClient
+// and its user name. fromClient gets its chat response once domain
+// answers.
+func (s *Server) requestFederatedChat(fromClient *ServerClient, req message.WSMessage, name string, domain string) error {
+	notFound := func(reason error) error {
+		chatResp := message.NewChatResponse("", nil, message.UsrNotFoundStatus).ReplyTo(req)
+		if err := fromClient.Send(chatResp); err != nil {
+			return fmt.Errorf("federated chat request: from-client write: %v", err)
+		}
+		return fmt.Errorf("federated chat request to %s@%s: %v", name, domain, reason)
+	}
+
+	if s.federation == nil {
+		return notFound(fmt.Errorf("federation is not configured"))
+	}
+
+	chatID := uuid.NewString()
+
+	s.fedMu.Lock()
+	s.fedPending[chatID] = pendingChat{domain: domain, client: fromClient, req: req, name: name}
+	s.fedMu.Unlock()
+
+	ev := bus.Event{
+		Kind: bus.ChatRequestEvent,
+		Chat: &bus.ChatInfo{
+			ID:    chatID,
+			Name:  fmt.Sprintf("%s and %s@%s's Chat", fromClient.User.Name, name, domain),
+			Users: []user.User{s.qualify(fromClient.User)},
+		},
+		To: []string{name},
+	}
+
+	if err := s.federation.Send(domain, ev); err != nil {
+		s.fedMu.Lock()
+		delete(s.fedPending, chatID)
+		s.fedMu.Unlock()
+
+		return notFound(err)
+	}
+
+	log.Info("federation: asked %s for a chat with %s (%s)", domain, name, chatID)
+
+	time.AfterFunc(FederatedChatTimeout, func() {
+		expired := s.takePendingChats(func(id string, _ pendingChat) bool {
+			return id == chatID
+		})
+		if len(expired) > 0 {
+			log.Warn("federation: %s never answered chat request %s", domain, chatID)
+			s.failPendingChats(expired)
+		}
+	})
+
+	return nil
+}
+
+func (s *Server) rcvFederatedChatRequest(ev bus.Event) error {
+	if ev.Chat == nil || len(ev.To) != 1 || !fromDomain(ev.Chat.Users, ev.From) {
+		return fmt.Errorf("malformed chat request")
+	}
+
+	answer := bus.Event{Kind: bus.ChatRejectEvent, Chat: &bus.ChatInfo{ID: ev.Chat.ID}}
+
+	toClient := s.LookupClient("", ev.To[0])
+	if toClient == nil {
+		log.Info("federation: %s asked for %s, who is not here", ev.From, ev.To[0])
+		return s.federation.Send(ev.From, answer)
+	}
+
+	// The peer picks the ID; it must not take over a chat of ours.
+	users := append(ev.Chat.Users, toClient.User)
+	newChat := chat.New(ev.Chat.ID, ev.Chat.Name, users)
+	if !s.chats.addNew(newChat) {
+		log.Warn("federation: %s asked for chat %s, which already exists", ev.From, ev.Chat.ID)
+		return s.federation.Send(ev.From, answer)
+	}
+
+	chatResp := message.NewChatResponse(newChat.ID, users, message.ChatOpenStatus)
+	if err := toClient.Send(chatResp); err != nil {
+		// The peer's request times out; nobody will use the chat.
+		s.chats.remove(newChat.ID)
+		return fmt.Errorf("to-client write: %v", err)
+	}
+
+	if s.store != nil {
+		if err := s.store.SaveChat(newChat); err != nil {
+			log.Error("federation: saving chat %s: %v", newChat.ID, err)
+		}
+	}
+
+	answer.Kind = bus.ChatAcceptEvent
+	answer.Chat.Users = []user.User{s.qualify(toClient.User)}
+
+	return s.federation.Send(ev.From, answer)
+}
+
+func (s *Server) rcvFederatedChatAnswer(ev bus.Event) error {
+	if ev.Chat == nil {
+		return fmt.Errorf("missing chat")
+	}
+
+	s.fedMu.Lock()
+	pending, ok := s.fedPending[ev.Chat.ID]
+	if ok && pending.domain == ev.From {
+		delete(s.fedPending, ev.Chat.ID)
+	}
+	s.fedMu.Unlock()
+
+	if !ok || pending.domain != ev.From {
+		return fmt.Errorf("no chat request %s pending with %s", ev.Chat.ID, ev.From)
+	}
+
+	fromClient := pending.client
+
+	if ev.Kind == bus.ChatRejectEvent {
+		chatResp := message.NewChatResponse("", nil, message.UsrNotFoundStatus).ReplyTo(pending.req)
+		return fromClient.Send(chatResp)
+	}
+
+	if !fromDomain(ev.Chat.Users, ev.From) {
+		return fmt.Errorf("chat accept names users outside %s", ev.From)
+	}
+
+	users := append([]user.User{fromClient.User}, ev.Chat.Users...)
+	newChat := chat.New(
+		ev.Chat.ID,
+		fmt.Sprintf("%s and %s@%s's Chat", fromClient.User.Name, pending.name, pending.domain),
+		users,
+	)
+	if !s.chats.addNew(newChat) {
+		s.failPendingChats([]pendingChat{pending})
+		return fmt.Errorf("chat %s already exists", newChat.ID)
+	}
+
+	if s.store != nil {
+		if err := s.store.SaveChat(newChat); err != nil {
+			log.Error("federation: saving chat %s: %v", newChat.ID, err)
+		}
+	}
+
+	log.Info("federation: chat %s opened with %s", newChat.ID, ev.From)
+
+	chatResp := message.NewChatResponse(newChat.ID, users, message.ChatOpenStatus).ReplyTo(pending.req)
+	return fromClient.Send(chatResp)
+}
+
+// takePendingChats removes and returns the pending chat requests match
+// picks.
+func (s *Server) takePendingChats(match func(chatID string, pending pendingChat) bool) []pendingChat {
+	s.fedMu.Lock()
+	defer s.fedMu.Unlock()
+
+	var taken []pendingChat
+	for chatID, pending := range s.fedPending {
+		if match(chatID, pending) {
+			taken = append(taken, pending)
+			delete(s.fedPending, chatID)
+		}
+	}
+
+	return taken
+}
+
+// dropPendingChats forgets the chat requests of a client that went away;
+// answers to them are ignored.
+func (s *Server) dropPendingChats(client *ServerClient) {
+	s.takePendingChats(func(_ string, pending pendingChat) bool {
+		return pending.client == client
+	})
+}
+
+// failPendingChats tells the senders of chat requests that will never be
+// answered that the user wasn't found.
+func (s *Server) failPendingChats(failed []pendingChat) {
+	for _, pending := range failed {
+		chatResp := message.NewChatResponse("", nil, message.UsrNotFoundStatus).ReplyTo(pending.req)
+		if err := pending.client.Send(chatResp); err != nil {
+			log.Warn("federation: from-client write: %v", err)
+		}
+	}
+}
+
+// federate sends textMessage on to the members of each other domain.
+func (s *Server) federate(textMessage message.TextMessage, members map[string][]string) error {
+	textMessage.From = s.qualify(textMessage.From)
+	wsMsg := message.NewWSMessage(message.TextMsg, textMessage)
+
+	for domain, names := range members {
+		if err := s.federation.Send(domain, bus.Event{Kind: bus.DeliverEvent, To: names, Message: &wsMsg}); err != nil {
+			return fmt.Errorf("chat [%s]: federate to %s: %v", textMessage.ChatID, domain, err)
+		}
+	}
+
+	return nil
+}
+
+// rcvFederatedMessage accepts a text message from another domain, as
+// long as it was sent by one of its users to a chat they belong to.
+func (s *Server) rcvFederatedMessage(ev bus.Event) error {
+	if ev.Message == nil || ev.Message.MessageType != message.TextMsg {
+		return fmt.Errorf("only text messages are relayed")
+	}
+
+	tm, err := ev.Message.ToTextMessage()
+	if err != nil {
+		return err
+	}
+
+	if !fromDomain([]user.User{tm.From}, ev.From) {
+		return fmt.Errorf("message from %s does not belong to %s", tm.From.Name, ev.From)
+	}
+
+	c := s.LookupChat(tm.ChatID)
+	if c == nil || !isMember(c, tm.From.Name) {
+		return fmt.Errorf("%s is not in chat %s", tm.From.Name, tm.ChatID)
+	}
+
+	var to []string
+	for _, name := range ev.To {
+		if isMember(c, name) {
+			to = append(to, name)
+		}
+	}
+
+	s.deliver(ev.From, to, *ev.Message)
+
+	return nil
+}
+
+func isMember(c *chat.Chat, name string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, u := range c.Users {
+		if u.Name == name {
+			return true
+		}
+	}
+	return false
+}
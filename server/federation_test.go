@@ -0,0 +1,199 @@
+package server
+
+import (
+	"net"
+	"sweetspeak/bus"
+	"sweetspeak/message"
+	"sweetspeak/user"
+	"testing"
+	"time"
+)
+
+// federatedServer runs a server for domain that federates over link.
+func federatedServer(t *testing.T, domain string, link bus.Bus) (*Server, string) {
+	t.Helper()
+
+	s := New().WithFederation(domain, link)
+	s.wg.Add(1)
+	go s.handleFederationEvents()
+
+	return s, serve(t, s)
+}
+
+func (s *Server) pendingChats() int {
+	s.fedMu.Lock()
+	defer s.fedMu.Unlock()
+
+	return len(s.fedPending)
+}
+
+func TestFederatedChat(t *testing.T) {
+	retry := bus.DialRetryInterval
+	bus.DialRetryInterval = 50 * time.Millisecond
+	t.Cleanup(func() { bus.DialRetryInterval = retry })
+
+	var addrs []string
+	for range 2 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, ln.Addr().String())
+		ln.Close()
+	}
+
+	secret := "something long and random"
+	links := []*bus.Mesh{
+		bus.NewMesh("alpha.test", addrs[0], addrs[1:]).WithAuth(map[string]string{"beta.test": secret}),
+		bus.NewMesh("beta.test", addrs[1], addrs[:1]).WithAuth(map[string]string{"alpha.test": secret}),
+	}
+	for _, link := range links {
+		if err := link.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { link.Close() })
+	}
+
+	alpha, alphaAddr := federatedServer(t, "alpha.test", links[0])
+	beta, betaAddr := federatedServer(t, "beta.test", links[1])
+
+	alice := connect(t, alphaAddr, "alice")
+	bob := connect(t, betaAddr, "bob")
+	waitUntil(t, "both clients", func() bool {
+		return alpha.LookupClient("", "alice") != nil && beta.LookupClient("", "bob") != nil
+	})
+
+	// The links come up in the background; until then requests fail.
+	var opened message.ChatResponse
+	waitUntil(t, "the chat to open", func() bool {
+		if err := alice.Write(message.NewChatRequest("alice", "bob@beta.test")); err != nil {
+			t.Fatal(err)
+		}
+		wsMsg := expect(t, alice, message.ChatResponseMsg)
+		cr, err := wsMsg.ToChatResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened = cr
+		return cr.Status == message.ChatOpenStatus
+	})
+
+	joined := expectChatResponse(t, bob, message.ChatOpenStatus)
+	if joined.ChatID != opened.ChatID {
+		t.Fatalf("bob joined chat %s, alice opened %s", joined.ChatID, opened.ChatID)
+	}
+
+	if err := alice.Write(message.NewTextMessage(opened.ChatID, *user.New("alice", "1"), "hi bob")); err != nil {
+		t.Fatal(err)
+	}
+	tm := expectText(t, bob)
+	if tm.Content != "hi bob" || tm.From.Name != "alice@alpha.test" {
+		t.Fatalf("bob got %q from %s", tm.Content, tm.From.Name)
+	}
+
+	if err := bob.Write(message.NewTextMessage(opened.ChatID, *user.New("bob", "1"), "hi alice")); err != nil {
+		t.Fatal(err)
+	}
+	// Alice gets her own message back first.
+	if tm = expectText(t, alice); tm.Content != "hi bob" {
+		t.Fatalf("alice got %q back, want her own message", tm.Content)
+	}
+	tm = expectText(t, alice)
+	if tm.Content != "hi alice" || tm.From.Name != "bob@beta.test" {
+		t.Fatalf("alice got %q from %s", tm.Content, tm.From.Name)
+	}
+
+	// Nobody by that name on beta.
+	if err := alice.Write(message.NewChatRequest("alice", "carol@beta.test")); err != nil {
+		t.Fatal(err)
+	}
+	expectChatResponse(t, alice, message.UsrNotFoundStatus)
+	if n := alpha.pendingChats(); n != 0 {
+		t.Fatalf("%d chat requests still pending", n)
+	}
+}
+
+func TestFederatedChatRequestExpires(t *testing.T) {
+	timeout := FederatedChatTimeout
+	FederatedChatTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { FederatedChatTimeout = timeout })
+
+	// gamma.test is linked but never answers.
+	hub := bus.NewHub()
+	alpha, alphaAddr := federatedServer(t, "alpha.test", hub.Join("alpha.test"))
+	hub.Join("gamma.test")
+
+	alice := connect(t, alphaAddr, "alice")
+	if err := alice.Write(message.NewChatRequest("alice", "dave@gamma.test")); err != nil {
+		t.Fatal(err)
+	}
+	expectChatResponse(t, alice, message.UsrNotFoundStatus)
+	if n := alpha.pendingChats(); n != 0 {
+		t.Fatalf("%d chat requests still pending", n)
+	}
+}
+
+func TestFederatedChatRequestDroppedOnDisconnect(t *testing.T) {
+	hub := bus.NewHub()
+	alpha, alphaAddr := federatedServer(t, "alpha.test", hub.Join("alpha.test"))
+	hub.Join("gamma.test")
+
+	alice := connect(t, alphaAddr, "alice")
+	if err := alice.Write(message.NewChatRequest("alice", "dave@gamma.test")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the request to be pending", func() bool {
+		return alpha.pendingChats() == 1
+	})
+
+	alice.Close()
+	waitUntil(t, "the request to be dropped", func() bool {
+		return alpha.pendingChats() == 0
+	})
+}
+
+func TestFederatedChatRequestCannotReuseChatID(t *testing.T) {
+	hub := bus.NewHub()
+	alpha, alphaAddr := federatedServer(t, "alpha.test", hub.Join("alpha.test"))
+	gamma := hub.Join("gamma.test")
+
+	alice := connect(t, alphaAddr, "alice")
+	connect(t, alphaAddr, "bob")
+	waitUntil(t, "both clients", func() bool {
+		return alpha.LookupClient("", "alice") != nil && alpha.LookupClient("", "bob") != nil
+	})
+
+	if err := alice.Write(message.NewChatRequest("alice", "bob")); err != nil {
+		t.Fatal(err)
+	}
+	chatID := expectChatResponse(t, alice, message.ChatOpenStatus).ChatID
+
+	err := gamma.Send("alpha.test", bus.Event{
+		Kind: bus.ChatRequestEvent,
+		Chat: &bus.ChatInfo{ID: chatID, Name: "mine now", Users: []user.User{*user.New("mallory@gamma.test", "1")}},
+		To:   []string{"bob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for answered := false; !answered; {
+		select {
+		case ev := <-gamma.Events():
+			switch ev.Kind {
+			case bus.ChatRejectEvent:
+				answered = true
+			case bus.ChatAcceptEvent:
+				t.Fatal("alpha accepted a chat ID it already uses")
+			}
+		case <-timeout:
+			t.Fatal("no answer to gamma")
+		}
+	}
+
+	c := alpha.LookupChat(chatID)
+	if c == nil || isMember(c, "mallory@gamma.test") {
+		t.Fatal("gamma took over the chat")
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+var (
+	// The server reports itself not ready once the message queue is
+	// more than ReadyQueueThreshold full.
+	ReadyQueueThreshold = 0.8
+)
+
+type (
+	HealthReport struct {
+		Status        string   `yaml:"status"`
+		Problems      []string `yaml:"problems,omitempty"`
+		Uptime        string   `yaml:"uptime"`
+		Goroutines    int      `yaml:"goroutines"`
+		Clients       int      `yaml:"clients"`
+		QueueDepth    int      `yaml:"queue_depth"`
+		QueueCapacity int      `yaml:"queue_capacity"`
+		Store         string   `yaml:"store"`
+	}
+)
+
+// handleHealthz answers liveness probes: the process is up and serving
+// HTTP. It always returns 200 along with the current report.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := s.Health()
+	report.Status = "ok"
+	report.Problems = nil
+
+	writeYAML(w, report)
+}
+
+// handleReadyz answers readiness probes: 503 while the server should not
+// be sent new clients.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := s.Health()
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	writeYAML(w, report)
+}
+
+func (s *Server) Health() HealthReport {
+	report := HealthReport{
+		Uptime:        time.Since(s.startedAt).Round(time.Second).String(),
+		Goroutines:    runtime.NumGoroutine(),
+		Clients:       s.clients.len(),
+		QueueDepth:    s.QueueDepth(),
+		QueueCapacity: s.QueueCapacity(),
+		Store:         "none",
+	}
+
+	if s.store != nil {
+		report.Store = "ok"
+		if err := s.store.Check(); err != nil {
+			report.Store = err.Error()
+			report.Problems = append(report.Problems, "store unavailable")
+		}
+	}
+
+	if s.shuttingDown.Load() {
+		report.Problems = append(report.Problems, "shutting down")
+	}
+
+	if float64(report.QueueDepth) > ReadyQueueThreshold*float64(report.QueueCapacity) {
+		report.Problems = append(report.Problems,
+			fmt.Sprintf("message queue backlog %d/%d", report.QueueDepth, report.QueueCapacity))
+	}
+
+	report.Status = "ok"
+	if len(report.Problems) > 0 {
+		report.Status = "unavailable"
+	}
+
+	return report
+}
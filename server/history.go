@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	log "sweetspeak/logging"
+	"sweetspeak/message"
+)
+
+var (
+	// MaxHistory caps the messages sent back for one history request.
+	MaxHistory = 500
+)
+
+// refuseHistory answers req with a notice when history is not served,
+// reporting whether it did.
+func (s *Server) refuseHistory(fromClient *ServerClient, req message.WSMessage) (bool, error) {
+	if s.serveHistory {
+		return false, nil
+	}
+
+	log.Debug("history: refusing %s for %s, history is off", req.MessageType, fromClient.User.Name)
+
+	notice := message.NewNotice(message.RefusedNotice, "this server does not serve chat history").ReplyTo(req)
+	if err := fromClient.Send(notice); err != nil {
+		return true, fmt.Errorf("history: reply: %v", err)
+	}
+	return true, nil
+}
+
+// RcvHistory sends a member the messages of a chat it has not seen yet:
+// those after the message with ID After, or from the start if the server
+// does not know that message. See WithHistory.
+func (s *Server) RcvHistory(fromClient *ServerClient, req message.WSMessage, hr message.HistoryRequest) error {
+	if refused, err := s.refuseHistory(fromClient, req); refused {
+		return err
+	}
+
+	member := false
+	for _, id := range s.memberChats(fromClient.User.Name) {
+		member = member || id == hr.ChatID
+	}
+
+	c := s.chats.lookup(hr.ChatID)
+	if !member || c == nil {
+		log.Warn("history: %s asked for chat %s it is not in", fromClient.User.Name, hr.ChatID)
+		return fromClient.Send(message.NewHistoryResult(hr.ChatID, nil, nil, false).ReplyTo(req))
+	}
+
+	limit := hr.Limit
+	if limit <= 0 || limit > MaxHistory {
+		limit = MaxHistory
+	}
+
+	c.Lock()
+	users := append(c.Users[:0:0], c.Users...)
+	start := 0
+	if hr.After != "" {
+		for i := len(c.Messages) - 1; i >= 0; i-- {
+			if c.Messages[i].ID == hr.After {
+				start = i + 1
+				break
+			}
+		}
+	}
+	messages := c.Messages[start:]
+	// The client asks again, after the last of these, for the rest.
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	messages = append(messages[:0:0], messages...)
+	c.Unlock()
+
+	log.Debug("history: %d messages of %s for %s", len(messages), hr.ChatID, fromClient.User.Name)
+
+	if err := fromClient.Send(message.NewHistoryResult(hr.ChatID, users, messages, more).ReplyTo(req)); err != nil {
+		return fmt.Errorf("history: reply: %v", err)
+	}
+
+	return nil
+}
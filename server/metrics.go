@@ -0,0 +1,75 @@
+package server
+
+import (
+	"sweetspeak/metrics"
+)
+
+var (
+	connectionsTotal = metrics.NewCounter(
+		"sweetspeak_connections_total",
+		"Websocket connections accepted.",
+	)
+	connectedClients = metrics.NewGauge(
+		"sweetspeak_connected_clients",
+		"Clients that completed the introduction handshake and are still connected.",
+	)
+	handshakeFailures = metrics.NewCounterVec(
+		"sweetspeak_handshake_failures_total",
+		"Connections dropped before the client was registered, by reason.",
+		"reason",
+	)
+	messagesReceived = metrics.NewCounterVec(
+		"sweetspeak_messages_received_total",
+		"Messages received from clients, by message type.",
+		"type",
+	)
+	throttledMessages = metrics.NewCounterVec(
+		"sweetspeak_throttled_messages_total",
+		"Messages dropped by rate limiting, by which limit was hit.",
+		"scope",
+	)
+	handleMsgDuration = metrics.NewHistogramVec(
+		"sweetspeak_handle_msg_duration_seconds",
+		"Time spent in HandleMsg, by message type.",
+		"type",
+		metrics.DefaultBuckets,
+	)
+	busEvents = metrics.NewCounterVec(
+		"sweetspeak_bus_events_received_total",
+		"Events received from other server nodes, by kind.",
+		"kind",
+	)
+	federationEvents = metrics.NewCounterVec(
+		"sweetspeak_federation_events_received_total",
+		"Events received from federated servers, by kind.",
+		"kind",
+	)
+)
+
+// registerMetrics fills the server's own registry with gauges read from
+// it. They are kept out of metrics.Default so that several servers in
+// one process, like a LocalBus cluster, don't report over each other.
+func (s *Server) registerMetrics() {
+	s.metrics = metrics.NewRegistry()
+
+	s.metrics.NewGaugeFunc(
+		"sweetspeak_message_queue_depth",
+		"Messages waiting across the server message queues.",
+		func() float64 { return float64(s.QueueDepth()) },
+	)
+	s.metrics.NewGaugeFunc(
+		"sweetspeak_message_queue_capacity",
+		"Total capacity of the server message queues.",
+		func() float64 { return float64(s.QueueCapacity()) },
+	)
+	s.metrics.NewGaugeFunc(
+		"sweetspeak_indexed_messages",
+		"Messages in the search index.",
+		func() float64 { return float64(s.index.Len()) },
+	)
+	s.metrics.NewGaugeFunc(
+		"sweetspeak_remote_clients",
+		"Users connected to other server nodes.",
+		func() float64 { return float64(s.presence.len()) },
+	)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	log "sweetspeak/logging"
+	"sweetspeak/message"
+	"sweetspeak/search"
+	"time"
+)
+
+var (
+	// MaxSearchHits caps the hits sent back for one search.
+	MaxSearchHits = 100
+)
+
+// RcvSearch answers a client's search over the history of the chats it
+// is a member of. See WithHistory.
+func (s *Server) RcvSearch(fromClient *ServerClient, req message.WSMessage, sr message.SearchRequest) error {
+	if refused, err := s.refuseHistory(fromClient, req); refused {
+		return err
+	}
+
+	start := time.Now()
+
+	chatIDs := s.memberChats(fromClient.User.Name)
+	if sr.ChatID != "" {
+		allowed := false
+		for _, id := range chatIDs {
+			allowed = allowed || id == sr.ChatID
+		}
+		if !allowed {
+			chatIDs = []string{}
+		} else {
+			chatIDs = []string{sr.ChatID}
+		}
+	}
+
+	limit := sr.Limit
+	if limit <= 0 || limit > MaxSearchHits {
+		limit = MaxSearchHits
+	}
+
+	hits := s.index.Search(search.Query{Text: sr.Query, ChatIDs: chatIDs, Limit: limit})
+
+	log.Debug("search: %s searched %d chats for %q, %d hits in %s",
+		fromClient.User.Name, len(chatIDs), sr.Query, len(hits), time.Since(start))
+
+	if err := fromClient.Send(message.NewSearchResult(sr.Query, hits).ReplyTo(req)); err != nil {
+		return fmt.Errorf("search: reply: %v", err)
+	}
+
+	return nil
+}
+
+// memberChats returns the IDs of the chats name is a member of.
+func (s *Server) memberChats(name string) []string {
+	ids := []string{}
+	for _, c := range s.chats.snapshot() {
+		c.Lock()
+		for _, u := range c.Users {
+			if u.Name == name {
+				ids = append(ids, c.ID)
+				break
+			}
+		}
+		c.Unlock()
+	}
+
+	return ids
+}
@@ -1,44 +1,124 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sweetspeak/bus"
 	"sweetspeak/chat"
 	"sweetspeak/consts"
 	log "sweetspeak/logging"
 	"sweetspeak/message"
+	"sweetspeak/metrics"
+	"sweetspeak/ratelimit"
+	"sweetspeak/search"
+	"sweetspeak/store"
 	"sweetspeak/user"
 	"sweetspeak/websockets"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
 var (
 	IntroductionTimeout = 5 * time.Second
+	ShutdownTimeout     = 10 * time.Second
+
+	// SlowClientPolicy is applied when a client stops draining its
+	// outbound queue.
+	SlowClientPolicy = websockets.OverflowDisconnect
+
+	// Each client may send ClientMessageRate messages per second with
+	// bursts of up to ClientMessageBurst; each chat accepts
+	// ChatMessageRate text messages per second across all its members.
+	ClientMessageRate  = 5.0
+	ClientMessageBurst = 20
+	ChatMessageRate    = 20.0
+	ChatMessageBurst   = 50
+
+	// MaxMessageSize caps a single message from a client, as encoded.
+	// YAML indents every line of a multi-line message, so a full 32KB
+	// composer of short lines takes several times that on the wire.
+	MaxMessageSize int64 = 256 * 1024
+
+	// A throttled client is told to slow down at most once per
+	// ThrottleNoticeInterval.
+	ThrottleNoticeInterval = 5 * time.Second
+
+	// Client messages are handled by MessageWorkers goroutines, each
+	// with its own queue of MessageQueueSize.
+	MessageWorkers   = runtime.NumCPU()
+	MessageQueueSize = 1000
 )
 
 type (
 	Server struct {
-		sync.Mutex
-		Clients   map[*ServerClient]interface{}
-		Chats     map[string]*chat.Chat
-		MessageCh chan serverMsg
+		clients *clientIndex
+		chats   *chatIndex
+		queues  []chan serverMsg
+		// index makes every message this server has seen searchable.
+		index *search.Index
+		// serveHistory lets clients search and fetch history; see
+		// WithHistory.
+		serveHistory bool
+
+		// bus and presence are only used when the server is one node of
+		// a larger deployment; see WithBus.
+		bus      bus.Bus
+		presence *presenceIndex
+
+		// domain and federation link the server to other deployments;
+		// see WithFederation.
+		domain     string
+		federation bus.Bus
+		fedMu      sync.Mutex
+		fedPending map[string]pendingChat
+
+		ctx         context.Context
+		cancel      context.CancelFunc
+		wg          sync.WaitGroup
+		store       store.Store
+		httpServer  *http.Server
+		adminServer *http.Server
+		// adminToken must be presented to the admin interface; see
+		// WithAdminToken.
+		adminToken string
+		chatLimiter *ratelimit.Limiter
+		// metrics holds the gauges of this server; counters shared by
+		// every server in the process are in metrics.Default.
+		metrics *metrics.Registry
+
+		banMu  sync.Mutex
+		banned map[string]bool
+
+		upgrader   websocket.Upgrader
+		policy     *AdmissionPolicy
+		connMu     sync.Mutex
+		connsPerIP map[string]int
+		totalConns int
+
+		startedAt    time.Time
+		shuttingDown atomic.Bool
 	}
 
 	ServerClient struct {
-		ClientID  string
-		User      user.User
-		WSHandler *websockets.WebsocketHandler
-		Connected bool
+		ClientID   string
+		User       user.User
+		WSHandler  *websockets.WebsocketHandler
+		Connected  atomic.Bool
+		RemoteAddr string
+
+		limiter        *ratelimit.Bucket
+		throttleMu     sync.Mutex
+		lastThrottleAt time.Time
 	}
 
 	serverMsg struct {
@@ -49,141 +129,451 @@ type (
 
 func New() *Server {
 	s := &Server{
-		Clients:   make(map[*ServerClient]interface{}),
-		Chats:     make(map[string]*chat.Chat),
-		MessageCh: make(chan serverMsg, 1000),
+		clients:    newClientIndex(),
+		chats:      newChatIndex(),
+		index:      search.NewIndex(),
+		presence:   newPresenceIndex(),
+		fedPending: make(map[string]pendingChat),
+		queues:     make([]chan serverMsg, max(MessageWorkers, 1)),
+		banned:     make(map[string]bool),
+		startedAt:  time.Now(),
+
+		chatLimiter: ratelimit.NewLimiter(ChatMessageRate, ChatMessageBurst),
+		policy:      DefaultAdmissionPolicy(),
+		connsPerIP:  make(map[string]int),
+	}
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return s.policy.CheckOrigin(r)
+		},
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	for i := range s.queues {
+		s.queues[i] = make(chan serverMsg, MessageQueueSize)
+	}
+
+	s.registerMetrics()
+
+	return s
+}
+
+func (s *Server) WithAdmissionPolicy(policy *AdmissionPolicy) *Server {
+	s.policy = policy
+	return s
+}
 
+func (s *Server) WithStore(st store.Store) *Server {
+	s.store = st
 	return s
 }
 
+// WithHistory lets clients search chat history and fetch what they
+// missed. It is off by default: a client is whoever it introduces itself
+// as, and nothing checks that, so anyone could read any user's chats by
+// claiming their name. Only turn it on where every client is trusted,
+// until the server authenticates users.
+func (s *Server) WithHistory() *Server {
+	s.serveHistory = true
+	return s
+}
+
+// Start serves clients until the listener fails or the process receives
+// SIGINT/SIGTERM, then shuts the server down gracefully.
 func (s *Server) Start() {
 	log.Info("starting server...")
 
-	go s.HandleClientMessages()
-	go s.HandleClientDisconnect()
+	if err := s.loadChats(); err != nil {
+		log.Error("loading chats: %v", err)
+	}
+
+	s.HandleClientMessages()
+
+	if s.bus != nil {
+		s.wg.Add(1)
+		go s.handleBusEvents()
+	}
+
+	if s.federation != nil {
+		s.wg.Add(1)
+		go s.handleFederationEvents()
+	}
 
-	http.HandleFunc("/", s.HandleWS)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.HandleWS)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	s.httpServer = &http.Server{
+		Addr:    consts.Addr,
+		Handler: mux,
+	}
+
+	if err := s.ensureAdminToken(); err != nil {
+		log.Error("admin token: %v", err)
+	}
 
-	log.Info("listening on %s...", consts.Addr)
-	if err := http.ListenAndServe(consts.Addr, nil); err != nil {
-		panic(err)
+	s.adminServer = &http.Server{
+		Addr:    consts.AdminAddr,
+		Handler: s.AdminHandler(),
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Info("listening on %s...", consts.Addr)
+		errCh <- s.httpServer.ListenAndServe()
+	}()
+
+	go func() {
+		log.Info("admin interface listening on %s...", consts.AdminAddr)
+		err := s.adminServer.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("admin listen: %v", err)
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("listen: %v", err)
+		}
+	case <-sigCtx.Done():
+		log.Info("shutdown signal received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Error("shutdown: %v", err)
 	}
 }
 
+// Shutdown stops accepting connections, tells every client the server is
+// going away, closes their sockets and waits (until ctx is done) for the
+// client goroutines to finish before flushing the store.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Info("shutting down server...")
+	s.shuttingDown.Store(true)
+
+	// Websocket connections are hijacked from the http server, so this
+	// only stops the listener; the sockets are closed below.
+	if s.httpServer != nil {
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			log.Error("shutdown: http server: %v", err)
+		}
+	}
+
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			log.Error("shutdown: admin server: %v", err)
+		}
+	}
+
+	s.Broadcast(message.NewNotice(message.ShutdownNotice, "server is shutting down"))
+
+	var closeWg sync.WaitGroup
+	for _, c := range s.clients.snapshot() {
+		closeWg.Add(1)
+		go func(c *ServerClient) {
+			defer closeWg.Done()
+			c.WSHandler.CloseWithCode(websocket.CloseGoingAway, "server shutting down")
+		}(c)
+	}
+	closeWg.Wait()
+
+	s.cancel()
+
+	var waitErr error
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		waitErr = fmt.Errorf("waiting for client handlers: %v", ctx.Err())
+	}
+
+	if s.bus != nil {
+		if err := s.bus.Close(); err != nil {
+			log.Error("shutdown: bus: %v", err)
+		}
+	}
+
+	if s.federation != nil {
+		if err := s.federation.Close(); err != nil {
+			log.Error("shutdown: federation: %v", err)
+		}
+	}
+
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			return fmt.Errorf("closing store: %v", err)
+		}
+	}
+
+	log.Info("server shut down")
+
+	return waitErr
+}
+
+func (s *Server) loadChats() error {
+	if s.store == nil {
+		return nil
+	}
+
+	// Whatever was read before an error is still worth serving.
+	chats, err := s.store.LoadChats()
+	for _, c := range chats {
+		s.chats.add(c)
+
+		c.Lock()
+		for _, tm := range c.Messages {
+			s.index.Add(tm)
+		}
+		c.Unlock()
+	}
+
+	log.Info("loaded %d chats from store, %d messages indexed", len(chats), s.index.Len())
+
+	return err
+}
+
 func (s *Server) HandleWS(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+	ip, admitErr := s.admit(r)
+	if admitErr != nil && !admitErr.afterUpgrade {
+		log.Warn("refusing connection from %s: %v", r.RemoteAddr, admitErr)
+		handshakeFailures.WithLabel(admitErr.reason).Inc()
+		http.Error(w, admitErr.Error(), http.StatusForbidden)
+		return
+	}
+
+	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Error("websocket upgrade: %v", err)
+		handshakeFailures.WithLabel("upgrade").Inc()
+		if admitErr == nil {
+			s.release(ip)
+		}
+		return
+	}
+
+	if admitErr != nil {
+		log.Warn("refusing connection from %s: %v", r.RemoteAddr, admitErr)
+		handshakeFailures.WithLabel(admitErr.reason).Inc()
+		s.refuse(c, admitErr.Error())
 		return
 	}
 
+	connectionsTotal.Inc()
+
 	// Listen for the introduction message so that
 	// we can identify this client.
 
-	ws := websockets.New().WithConn(c).Start()
+	ws := websockets.New().
+		WithConn(c).
+		WithOverflowPolicy(SlowClientPolicy).
+		WithReadLimit(MaxMessageSize).
+		Start()
+
+	go func() {
+		<-ws.Done()
+		s.release(ip)
+	}()
+
 	newClient := &ServerClient{
-		WSHandler: ws,
+		WSHandler:  ws,
+		RemoteAddr: c.RemoteAddr().String(),
+		limiter:    ratelimit.NewBucket(ClientMessageRate, ClientMessageBurst),
 	}
 
 	wsMsg, ok := newClient.ReadWithTimeout(IntroductionTimeout)
 	if !ok {
 		log.Error("client introduction never received (%s)", c.RemoteAddr().String())
+		handshakeFailures.WithLabel("timeout").Inc()
+		ws.Close()
 		return
 	}
 
 	if wsMsg.MessageType != message.IntroductionMsg {
 		log.Error("client sent non-introduction (%s)", c.RemoteAddr().String())
+		handshakeFailures.WithLabel("not_introduction").Inc()
+		ws.Close()
 		return
 	}
 
 	im, err := wsMsg.ToIntroduction()
 	if err != nil {
 		log.Error("reading client introduction: %v", err)
+		handshakeFailures.WithLabel("bad_introduction").Inc()
+		ws.Close()
 		return
 	}
 
 	newClient.ClientID = im.ClientID
 	newClient.User = im.User
-	newClient.Connected = true
+	newClient.Connected.Store(true)
+
+	if s.IsBanned(im.User.Name) {
+		log.Warn("refusing banned user %s (%s)", im.User.Name, newClient.RemoteAddr)
+		handshakeFailures.WithLabel("banned").Inc()
+		newClient.Send(message.NewNotice(message.KickedNotice, "you are banned from this server"))
+		ws.CloseWithCode(websocket.ClosePolicyViolation, "banned")
+		return
+	}
 
 	s.AddClient(newClient)
 
 	log.Info("client connect success: %s %s", newClient.ClientID, newClient.User.Name)
 }
 
+// refuse tells a freshly upgraded connection why it is being turned
+// away and closes it.
+func (s *Server) refuse(c *websocket.Conn, reason string) {
+	ws := websockets.New().WithConn(c).Start()
+	if err := ws.Write(message.NewNotice(message.RefusedNotice, reason)); err != nil {
+		log.Warn("refuse: notify %s: %v", c.RemoteAddr().String(), err)
+	}
+	ws.CloseWithCode(websocket.CloseTryAgainLater, reason)
+}
+
+func (s *Server) IsBanned(userName string) bool {
+	s.banMu.Lock()
+	defer s.banMu.Unlock()
+
+	return s.banned[userName]
+}
+
 func (s *Server) AddClient(client *ServerClient) {
-	s.Lock()
-	defer s.Unlock()
+	if s.ctx.Err() != nil {
+		// Shutting down; don't take on new clients.
+		client.WSHandler.CloseWithCode(websocket.CloseGoingAway, "server shutting down")
+		return
+	}
 
-	s.Clients[client] = true
+	s.clients.add(client)
+	connectedClients.Inc()
+	s.announcePresence(bus.PresenceJoinEvent, client.User)
+
+	s.wg.Add(1)
 	go s.clientHandler(client)
 }
 
+// clientHandler blocks on the client's read channel and forwards each
+// message to the client's message worker. The read channel is closed
+// once the connection drops, at which point the client is removed.
 func (s *Server) clientHandler(client *ServerClient) {
-        log.Debug("client handler started for %s:%s", client.User.Name, client.ClientID)
+	log.Debug("client handler started for %s:%s", client.User.Name, client.ClientID)
+
+	defer s.wg.Done()
+	defer s.RemoveClient(client)
+
+	queue := s.queues[shardFor(client.ClientID, len(s.queues))]
+
 	for {
-		if client.WSHandler.IsClosed() {
-			break
-		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-client.WSHandler.Done():
+			return
+		case wsMsg, ok := <-client.ReadCh():
+			if !ok {
+				return
+			}
 
-		wsMsg, ok := client.Read()
-		if !ok {
-			continue
-		}
+			if allowed, wait := client.limiter.Allow(); !allowed {
+				throttledMessages.WithLabel("client").Inc()
+				s.throttle(client, "you are sending messages too quickly", wait)
+				continue
+			}
 
-                s.MessageCh <- serverMsg{client: client, msg: wsMsg}
+			select {
+			case queue <- serverMsg{client: client, msg: wsMsg}:
+			case <-s.ctx.Done():
+				return
+			}
+		}
 	}
-
-	client.Connected = false
-        log.Warn("client disconnected (%s)", client.User.Name)
 }
 
+// HandleClientMessages starts one worker per message queue. Workers run
+// without any server-wide lock; shared state is guarded by the client
+// and chat indexes and by each chat's own lock.
 func (s *Server) HandleClientMessages() {
-	log.Info("listening for client messages...")
-	for msg := range s.MessageCh {
-                s.Lock()
-                client := msg.client
-                wsMsg := msg.msg
+	log.Info("listening for client messages on %d workers...", len(s.queues))
 
-		log.Debug("message received: %v", wsMsg.MessageType)
+	for _, queue := range s.queues {
+		s.wg.Add(1)
+		go s.messageWorker(queue)
+	}
+}
+
+func (s *Server) messageWorker(queue chan serverMsg) {
+	defer s.wg.Done()
 
-		if err := s.HandleMsg(client, wsMsg); err != nil {
-			log.Error("reading client message: %v", err)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg := <-queue:
+			s.handleClientMessage(msg)
 		}
-                s.Unlock()
 	}
 }
 
-func (s *Server) HandleClientDisconnect() {
-	for {
-		s.handleClientDisconnect()
+// QueueDepth returns the number of client messages waiting across all
+// message queues.
+func (s *Server) QueueDepth() int {
+	depth := 0
+	for _, queue := range s.queues {
+		depth += len(queue)
 	}
+	return depth
+}
+
+func (s *Server) QueueCapacity() int {
+	return len(s.queues) * MessageQueueSize
 }
 
-func (s *Server) handleClientDisconnect() {
-	s.Lock()
-	defer s.Unlock()
+func (s *Server) handleClientMessage(msg serverMsg) {
+	client := msg.client
+	wsMsg := msg.msg
 
-	for c := range s.Clients {
-		if !c.Connected {
-			delete(s.Clients, c)
-                        log.Warn("client deleted from map (%s)", c.User.Name)
-		}
+	log.Debug("message received: %v", wsMsg.MessageType)
+
+	// Clients pick the type: unknown ones share a label, rather than
+	// adding a series each.
+	msgType := "unknown"
+	if wsMsg.MessageType.Known() {
+		msgType = wsMsg.MessageType.String()
 	}
+	messagesReceived.WithLabel(msgType).Inc()
 
+	start := time.Now()
+	if err := s.HandleMsg(client, wsMsg); err != nil {
+		log.Error("reading client message: %v", err)
+	}
+	handleMsgDuration.WithLabel(msgType).Observe(time.Since(start).Seconds())
 }
 
-func (sc *ServerClient) Read() (message.WSMessage, bool) {
-	var wsMsg message.WSMessage
+func (s *Server) RemoveClient(client *ServerClient) {
+	client.Connected.Store(false)
+	if s.clients.remove(client) {
+		connectedClients.Dec()
+		s.dropPendingChats(client)
 
-	select {
-	case wsMsg = <-sc.ReadCh():
-	default:
-		return message.WSMessage{}, false
+		if s.LookupClient("", client.User.Name) == nil {
+			s.announcePresence(bus.PresenceLeaveEvent, client.User)
+			s.forgetChatLimits(client.User.Name)
+		}
 	}
 
-	return wsMsg, true
+	log.Warn("client disconnected (%s)", client.User.Name)
 }
 
 func (sc *ServerClient) ReadWithTimeout(timeout time.Duration) (message.WSMessage, bool) {
@@ -215,7 +605,7 @@ func (s *Server) HandleMsg(client *ServerClient, wsMsg message.WSMessage) error
 			return err
 		}
 
-		return s.RcvChatRequest(client, cr)
+		return s.RcvChatRequest(client, wsMsg, cr)
 	case message.TextMsg:
 		tm, err := wsMsg.ToTextMessage()
 		if err != nil {
@@ -223,32 +613,61 @@ func (s *Server) HandleMsg(client *ServerClient, wsMsg message.WSMessage) error
 		}
 
 		return s.RcvTextMessage(client, tm)
+	case message.SearchMsg:
+		sr, err := wsMsg.ToSearchRequest()
+		if err != nil {
+			return err
+		}
+
+		return s.RcvSearch(client, wsMsg, sr)
+	case message.HistoryMsg:
+		hr, err := wsMsg.ToHistoryRequest()
+		if err != nil {
+			return err
+		}
+
+		return s.RcvHistory(client, wsMsg, hr)
 	default:
 	}
 
 	return nil
 }
 
-func (s *Server) RcvChatRequest(fromClient *ServerClient, chatRequest message.ChatRequest) error {
+func (s *Server) RcvChatRequest(fromClient *ServerClient, req message.WSMessage, chatRequest message.ChatRequest) error {
 	toUser := chatRequest.To
 
-	// Look up toUser first.
+	// Users of other deployments are addressed as user@domain.
+	name, domain, federated := s.remoteDomain(toUser)
+	if federated {
+		return s.requestFederatedChat(fromClient, req, name, domain)
+	}
+	toUser = name
+
+	// Look up toUser first, here and then on the other nodes.
 	toClient := s.LookupClient("", toUser)
-	if toClient == nil {
+	remote, isRemote := s.presence.lookup(toUser)
+	if toClient == nil && !isRemote {
 		// Send user not found message.
-		chatResp := message.NewChatResponse("", nil, message.UsrNotFoundStatus)
-		fromClient.WSHandler.WriteCh <- chatResp
+		chatResp := message.NewChatResponse("", nil, message.UsrNotFoundStatus).ReplyTo(req)
+		if err := fromClient.Send(chatResp); err != nil {
+			return fmt.Errorf("chat request: from-client write: %v", err)
+		}
 		return fmt.Errorf("client [%s] chat request: user not found (%v)", fromClient.ClientID, toUser)
 	}
 
-	// toClient is valid, create a local chat entry and
+	// toUser is valid, create a local chat entry and
 	// send an open response to both clients.
 
+	peer := remote.User
+	if toClient != nil {
+		peer = toClient.User
+	}
+
 	var (
 		chatID = uuid.NewString()
 		users  = []user.User{
 			fromClient.User,
-			toClient.User,
+			peer,
 		}
 		chatResp = message.NewChatResponse(
 			chatID,
@@ -257,19 +676,33 @@ func (s *Server) RcvChatRequest(fromClient *ServerClient, chatRequest message.Ch
 		)
 	)
 
-	s.Chats[chatID] = chat.New(
+	newChat := chat.New(
 		chatID,
 		fmt.Sprintf("%s and %s's Chat", chatRequest.From, chatRequest.To),
 		users,
 	)
+	s.chats.add(newChat)
+
+	if s.store != nil {
+		if err := s.store.SaveChat(newChat); err != nil {
+			log.Error("chat request: saving chat %s: %v", chatID, err)
+		}
+	}
+
+	s.announceChat(newChat)
 
 	log.Debug("chat request: sending chat response to users")
 
-	if err := toClient.Send(chatResp); err != nil {
-		return fmt.Errorf("chat request: to-client write: %v", err)
+	if toClient != nil {
+		if err := toClient.Send(chatResp); err != nil {
+			return fmt.Errorf("chat request: to-client write: %v", err)
+		}
+	} else if err := s.relay(remote.Node, []string{toUser}, chatResp); err != nil {
+		return fmt.Errorf("chat request: relay to %s: %v", remote.Node, err)
 	}
 
-	if err := fromClient.Send(chatResp); err != nil {
+	// Only the requesting client is waiting on this response.
+	if err := fromClient.Send(chatResp.ReplyTo(req)); err != nil {
 		return fmt.Errorf("chat request: from-client write: %v", err)
 	}
 
@@ -278,36 +711,31 @@ func (s *Server) RcvChatRequest(fromClient *ServerClient, chatRequest message.Ch
 	return nil
 }
 
-// Assume caller calls Lock()
 func (s *Server) LookupClient(clientID string, userName string) *ServerClient {
 	if clientID != "" {
-		for c := range s.Clients {
-			if c.ClientID == clientID {
-				return c
-			}
+		if c := s.clients.lookupID(clientID); c != nil {
+			return c
 		}
 	}
 
 	if userName != "" {
-		for c := range s.Clients {
-			if c.User.Name == userName {
-				return c
-			}
-		}
+		return s.clients.lookupName(userName)
 	}
 
 	return nil
 }
 
 func (s *Server) LookupChat(chatID string) *chat.Chat {
-	if c, ok := s.Chats[chatID]; ok {
-		return c
-	}
-	return nil
+	return s.chats.lookup(chatID)
+}
+
+// AddChat registers c with the server without persisting it.
+func (s *Server) AddChat(c *chat.Chat) {
+	s.chats.add(c)
 }
 
 func (s *Server) RcvTextMessage(fromClient *ServerClient, textMessage message.TextMessage) error {
-        log.Debug("received text message: %s - %s", textMessage.ChatID, textMessage.Content)
+	log.Debug("received text message: %s - %s", textMessage.ChatID, textMessage.Content)
 	// Look up the chat
 	clientChat := s.LookupChat(textMessage.ChatID)
 	if clientChat == nil {
@@ -318,16 +746,63 @@ func (s *Server) RcvTextMessage(fromClient *ServerClient, textMessage message.Te
 		return fmt.Errorf("client [%s] text message: chat not found (%v)", fromClient.ClientID, textMessage.ChatID)
 	}
 
+	if !isMember(clientChat, fromClient.User.Name) {
+		return fmt.Errorf("client [%s] text message: %s is not in chat %s", fromClient.ClientID, fromClient.User.Name, textMessage.ChatID)
+	}
+
+	// Clients must not pick IDs: a reused one would replace or hide
+	// another message wherever messages are deduplicated. Nor may they
+	// speak for anyone else.
+	textMessage.ID = uuid.NewString()
+	textMessage.From = fromClient.User
+
 	var (
 		chatID = textMessage.ChatID
 		wsMsg  = message.NewWSMessage(message.TextMsg, textMessage)
 	)
 
-	// Forward textMessage to all users in the chat.
-	for _, u := range clientChat.Users {
+	if allowed, wait := s.chatLimiter.Allow(chatID); !allowed {
+		throttledMessages.WithLabel("chat").Inc()
+		s.throttle(fromClient, "this chat is too busy", wait)
+		return nil
+	}
+
+	order := s.chats.ordering(chatID)
+	order.Lock()
+	defer order.Unlock()
+
+	clientChat.Lock()
+	users := append(clientChat.Users[:0:0], clientChat.Users...)
+	clientChat.Unlock()
+
+	clientChat.AddMessage(textMessage)
+	s.index.Add(textMessage)
+	if s.store != nil {
+		if err := s.store.AppendMessage(textMessage); err != nil {
+			log.Error("chat [%s]: saving message: %v", chatID, err)
+		}
+	}
+
+	// Forward textMessage to all users in the chat. Members connected
+	// to other nodes get one relay per node.
+	remoteMembers := make(map[string][]string)
+	federatedMembers := make(map[string][]string)
+	for _, u := range users {
+		if name, domain, federated := s.remoteDomain(u.Name); federated {
+			federatedMembers[domain] = append(federatedMembers[domain], name)
+			continue
+		}
+
 		toClient := s.LookupClient("", u.Name)
 		if toClient == nil {
-			return fmt.Errorf("chat [%s]: client is nil (%s)", chatID, toClient.String())
+			if remote, ok := s.presence.lookup(u.Name); ok {
+				remoteMembers[remote.Node] = append(remoteMembers[remote.Node], u.Name)
+				continue
+			}
+
+			// Offline members will see the message in the chat's history.
+			log.Debug("chat [%s]: %s is offline", chatID, u.Name)
+			continue
 		}
 
 		if err := toClient.Send(wsMsg); err != nil {
@@ -335,11 +810,67 @@ func (s *Server) RcvTextMessage(fromClient *ServerClient, textMessage message.Te
 		}
 	}
 
-        log.Debug("message forwarded successfully for chat (%s)", clientChat.ID)
+	for node, names := range remoteMembers {
+		if err := s.relay(node, names, wsMsg); err != nil {
+			return fmt.Errorf("chat [%s]: relay to %s: %v", chatID, node, err)
+		}
+	}
+
+	if len(federatedMembers) > 0 && s.federation != nil {
+		if err := s.federate(textMessage, federatedMembers); err != nil {
+			return err
+		}
+	}
+
+	log.Debug("message forwarded successfully for chat (%s)", clientChat.ID)
 
 	return nil
 }
 
+// forgetChatLimits drops the rate limit buckets of name's chats that
+// nobody here is connected to any more, so the limiter doesn't keep one
+// for every chat ever used.
+func (s *Server) forgetChatLimits(name string) {
+	for _, chatID := range s.memberChats(name) {
+		c := s.chats.lookup(chatID)
+		if c == nil {
+			continue
+		}
+
+		c.Lock()
+		users := append(c.Users[:0:0], c.Users...)
+		c.Unlock()
+
+		online := false
+		for _, u := range users {
+			online = online || s.LookupClient("", u.Name) != nil
+		}
+		if !online {
+			s.chatLimiter.Forget(chatID)
+		}
+	}
+}
+
+// throttle tells client that its message was dropped, unless it was
+// already told so recently.
+func (s *Server) throttle(client *ServerClient, reason string, retryAfter time.Duration) {
+	client.throttleMu.Lock()
+	if time.Since(client.lastThrottleAt) < ThrottleNoticeInterval {
+		client.throttleMu.Unlock()
+		log.Debug("throttling %s: %s", client.String(), reason)
+		return
+	}
+	client.lastThrottleAt = time.Now()
+	client.throttleMu.Unlock()
+
+	log.Warn("throttling %s: %s", client.String(), reason)
+
+	text := fmt.Sprintf("slow down: %s, message dropped (retry in %s)", reason, retryAfter.Round(time.Millisecond))
+	if err := client.Send(message.NewThrottleNotice(text, retryAfter)); err != nil {
+		log.Warn("throttle: notify %s: %v", client.String(), err)
+	}
+}
+
 func (sc *ServerClient) String() string {
-	return fmt.Sprintf("%s:%s:%t", sc.ClientID, sc.User.Name, sc.Connected)
+	return fmt.Sprintf("%s:%s:%t", sc.ClientID, sc.User.Name, sc.Connected.Load())
 }
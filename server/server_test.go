@@ -0,0 +1,282 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sweetspeak/message"
+	"sweetspeak/metrics"
+	"sweetspeak/user"
+	"sweetspeak/websockets"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// serve serves s's clients over httptest, without the rest of Start,
+// and returns the address to connect to.
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+
+	s.HandleClientMessages()
+
+	hs := httptest.NewServer(http.HandlerFunc(s.HandleWS))
+	t.Cleanup(func() {
+		hs.CloseClientConnections()
+		hs.Close()
+		s.cancel()
+		s.wg.Wait()
+	})
+
+	return strings.TrimPrefix(hs.URL, "http://")
+}
+
+// connect introduces name to the server at addr.
+func connect(t *testing.T, addr string, name string) *websockets.WebsocketHandler {
+	t.Helper()
+
+	ws := websockets.New()
+	if err := ws.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	ws.Start()
+	t.Cleanup(ws.Close)
+
+	if err := ws.Write(message.NewIntroductionMessage(uuid.NewString(), *user.New(name, "1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	return ws
+}
+
+// expect returns the next message of type kind sent to ws.
+func expect(t *testing.T, ws *websockets.WebsocketHandler, kind message.MessageType) message.WSMessage {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case wsMsg, ok := <-ws.ReadCh:
+			if !ok {
+				t.Fatalf("connection closed waiting for %s", kind)
+			}
+			if wsMsg.MessageType == kind {
+				return wsMsg
+			}
+		case <-timeout:
+			t.Fatalf("no %s", kind)
+		}
+	}
+}
+
+func expectChatResponse(t *testing.T, ws *websockets.WebsocketHandler, status message.ChatStatus) message.ChatResponse {
+	t.Helper()
+
+	wsMsg := expect(t, ws, message.ChatResponseMsg)
+	cr, err := wsMsg.ToChatResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Status != status {
+		t.Fatalf("chat response status %v, want %v", cr.Status, status)
+	}
+	return cr
+}
+
+func expectText(t *testing.T, ws *websockets.WebsocketHandler) message.TextMessage {
+	t.Helper()
+
+	wsMsg := expect(t, ws, message.TextMsg)
+	tm, err := wsMsg.ToTextMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+// expectReply returns the answer to req sent to ws.
+func expectReply(t *testing.T, ws *websockets.WebsocketHandler, req message.WSMessage) message.WSMessage {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case wsMsg, ok := <-ws.ReadCh:
+			if !ok {
+				t.Fatalf("connection closed waiting for the reply to %s", req.MessageType)
+			}
+			if wsMsg.InReplyTo == req.MessageID {
+				return wsMsg
+			}
+		case <-timeout:
+			t.Fatalf("no reply to %s", req.MessageType)
+		}
+	}
+}
+
+// waitUntil polls cond until it holds or a few seconds pass.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerAssignsMessageIDs(t *testing.T) {
+	s := New()
+	addr := serve(t, s)
+
+	alice := connect(t, addr, "alice")
+	bob := connect(t, addr, "bob")
+	waitUntil(t, "both clients", func() bool {
+		return s.LookupClient("", "alice") != nil && s.LookupClient("", "bob") != nil
+	})
+
+	if err := alice.Write(message.NewChatRequest("alice", "bob")); err != nil {
+		t.Fatal(err)
+	}
+	chatID := expectChatResponse(t, alice, message.ChatOpenStatus).ChatID
+
+	var ids []string
+	for range 2 {
+		forged := message.NewWSMessage(message.TextMsg, message.TextMessage{
+			ID:        "chosen-by-alice",
+			ChatID:    chatID,
+			From:      *user.New("alice", "1"),
+			Timestamp: time.Now(),
+			Content:   "hi",
+		})
+		if err := alice.Write(forged); err != nil {
+			t.Fatal(err)
+		}
+
+		tm := expectText(t, bob)
+		if tm.ID == "" || tm.ID == "chosen-by-alice" {
+			t.Fatalf("message kept ID %q", tm.ID)
+		}
+		ids = append(ids, tm.ID)
+	}
+
+	if ids[0] == ids[1] {
+		t.Fatalf("both messages got ID %s", ids[0])
+	}
+}
+
+func TestHistoryNeedsWithHistory(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		s := New()
+		if enabled {
+			s.WithHistory()
+		}
+		addr := serve(t, s)
+
+		alice := connect(t, addr, "alice")
+		connect(t, addr, "bob")
+		waitUntil(t, "both clients", func() bool {
+			return s.LookupClient("", "alice") != nil && s.LookupClient("", "bob") != nil
+		})
+
+		if err := alice.Write(message.NewChatRequest("alice", "bob")); err != nil {
+			t.Fatal(err)
+		}
+		chatID := expectChatResponse(t, alice, message.ChatOpenStatus).ChatID
+
+		if err := alice.Write(message.NewTextMessage(chatID, *user.New("alice", "1"), "remember this")); err != nil {
+			t.Fatal(err)
+		}
+		expectText(t, alice)
+
+		// Anyone can claim to be bob.
+		mallory := connect(t, addr, "bob")
+		for _, req := range []message.WSMessage{
+			message.NewHistoryRequest(chatID, "", 0),
+			message.NewSearchRequest("remember", "", 0),
+		} {
+			if err := mallory.Write(req); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := expectReply(t, mallory, req)
+
+			if refused := reply.MessageType == message.NoticeMsg; refused == enabled {
+				t.Fatalf("history enabled %v: %s answered with %s", enabled, req.MessageType, reply.MessageType)
+			}
+		}
+	}
+}
+
+func TestServerChecksSender(t *testing.T) {
+	s := New()
+	addr := serve(t, s)
+
+	alice := connect(t, addr, "alice")
+	bob := connect(t, addr, "bob")
+	connect(t, addr, "mallory")
+	waitUntil(t, "all clients", func() bool {
+		return s.LookupClient("", "alice") != nil && s.LookupClient("", "bob") != nil && s.LookupClient("", "mallory") != nil
+	})
+
+	if err := alice.Write(message.NewChatRequest("alice", "bob")); err != nil {
+		t.Fatal(err)
+	}
+	chatID := expectChatResponse(t, alice, message.ChatOpenStatus).ChatID
+
+	// alice claims to be bob.
+	if err := alice.Write(message.NewTextMessage(chatID, *user.New("bob", "1"), "it's me, bob")); err != nil {
+		t.Fatal(err)
+	}
+	if tm := expectText(t, bob); tm.From.Name != "alice" {
+		t.Fatalf("message from alice arrived from %s", tm.From.Name)
+	}
+
+	// mallory is not in the chat.
+	mallory := s.LookupClient("", "mallory")
+	err := s.RcvTextMessage(mallory, message.TextMessage{
+		ChatID:    chatID,
+		From:      mallory.User,
+		Timestamp: time.Now(),
+		Content:   "let me in",
+	})
+	if err == nil {
+		t.Fatal("a non-member posted to the chat")
+	}
+
+	c := s.LookupChat(chatID)
+	c.Lock()
+	defer c.Unlock()
+	if len(c.Messages) != 1 {
+		t.Fatalf("chat holds %d messages, want 1", len(c.Messages))
+	}
+}
+
+func TestUnknownMessageTypesShareALabel(t *testing.T) {
+	s := New()
+	addr := serve(t, s)
+
+	alice := connect(t, addr, "alice")
+	waitUntil(t, "alice", func() bool {
+		return s.LookupClient("", "alice") != nil
+	})
+
+	before := messagesReceived.WithLabel("unknown").Value()
+	for _, kind := range []message.MessageType{1000, 1001, 1002} {
+		if err := alice.Write(message.WSMessage{MessageType: kind, MessageID: uuid.NewString()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, "the messages to be counted", func() bool {
+		return messagesReceived.WithLabel("unknown").Value()-before == 3
+	})
+
+	var out strings.Builder
+	metrics.Default.Expose(&out)
+	if strings.Contains(out.String(), "unknown(") {
+		t.Fatal("an unknown message type got its own series")
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"hash/fnv"
+	"slices"
+	"sweetspeak/chat"
+	"sweetspeak/user"
+	"sync"
+)
+
+type (
+	// clientIndex holds the connected clients, indexed by client ID and
+	// by user name. Reads vastly outnumber writes, hence the RWMutex.
+	clientIndex struct {
+		sync.RWMutex
+		all  map[*ServerClient]struct{}
+		byID map[string]*ServerClient
+		// A user may be connected more than once; the most recent
+		// connection comes last.
+		byName map[string][]*ServerClient
+	}
+
+	// chatIndex holds the chats by ID. Each chat.Chat guards its own
+	// messages, so the index lock is only held for the map itself.
+	chatIndex struct {
+		sync.RWMutex
+		byID map[string]*chatEntry
+	}
+
+	chatEntry struct {
+		chat *chat.Chat
+		// order serializes the delivery of the chat's messages. It
+		// lives and goes with the chat.
+		order sync.Mutex
+	}
+)
+
+func newClientIndex() *clientIndex {
+	return &clientIndex{
+		all:    make(map[*ServerClient]struct{}),
+		byID:   make(map[string]*ServerClient),
+		byName: make(map[string][]*ServerClient),
+	}
+}
+
+func (ci *clientIndex) add(c *ServerClient) {
+	ci.Lock()
+	defer ci.Unlock()
+
+	ci.all[c] = struct{}{}
+	ci.byID[c.ClientID] = c
+	ci.byName[c.User.Name] = append(ci.byName[c.User.Name], c)
+}
+
+// remove reports whether c was still in the index.
+func (ci *clientIndex) remove(c *ServerClient) bool {
+	ci.Lock()
+	defer ci.Unlock()
+
+	if _, ok := ci.all[c]; !ok {
+		return false
+	}
+
+	delete(ci.all, c)
+
+	// A newer connection may have taken over the ID.
+	if ci.byID[c.ClientID] == c {
+		delete(ci.byID, c.ClientID)
+	}
+
+	conns := slices.DeleteFunc(ci.byName[c.User.Name], func(other *ServerClient) bool {
+		return other == c
+	})
+	if len(conns) == 0 {
+		delete(ci.byName, c.User.Name)
+	} else {
+		ci.byName[c.User.Name] = conns
+	}
+
+	return true
+}
+
+func (ci *clientIndex) lookupID(clientID string) *ServerClient {
+	ci.RLock()
+	defer ci.RUnlock()
+
+	return ci.byID[clientID]
+}
+
+func (ci *clientIndex) lookupName(userName string) *ServerClient {
+	ci.RLock()
+	defer ci.RUnlock()
+
+	conns := ci.byName[userName]
+	if len(conns) == 0 {
+		return nil
+	}
+
+	return conns[len(conns)-1]
+}
+
+// lookupAll returns every connection of userName.
+func (ci *clientIndex) lookupAll(userName string) []*ServerClient {
+	ci.RLock()
+	defer ci.RUnlock()
+
+	return slices.Clone(ci.byName[userName])
+}
+
+func (ci *clientIndex) snapshot() []*ServerClient {
+	ci.RLock()
+	defer ci.RUnlock()
+
+	clients := make([]*ServerClient, 0, len(ci.all))
+	for c := range ci.all {
+		clients = append(clients, c)
+	}
+
+	return clients
+}
+
+func (ci *clientIndex) len() int {
+	ci.RLock()
+	defer ci.RUnlock()
+
+	return len(ci.all)
+}
+
+func newChatIndex() *chatIndex {
+	return &chatIndex{
+		byID: make(map[string]*chatEntry),
+	}
+}
+
+func (ci *chatIndex) add(c *chat.Chat) {
+	ci.Lock()
+	defer ci.Unlock()
+
+	ci.byID[c.ID] = &chatEntry{chat: c}
+}
+
+// addNew adds c unless a chat with its ID exists, and reports whether
+// it did.
+func (ci *chatIndex) addNew(c *chat.Chat) bool {
+	ci.Lock()
+	defer ci.Unlock()
+
+	if _, ok := ci.byID[c.ID]; ok {
+		return false
+	}
+	ci.byID[c.ID] = &chatEntry{chat: c}
+	return true
+}
+
+// remove forgets chatID, along with its ordering lock.
+func (ci *chatIndex) remove(chatID string) {
+	ci.Lock()
+	defer ci.Unlock()
+
+	delete(ci.byID, chatID)
+}
+
+func (ci *chatIndex) lookup(chatID string) *chat.Chat {
+	ci.RLock()
+	defer ci.RUnlock()
+
+	if e, ok := ci.byID[chatID]; ok {
+		return e.chat
+	}
+	return nil
+}
+
+// ordering returns the lock held while a message of chatID is recorded
+// and forwarded. Senders are sharded by client, so without it two
+// members' messages could reach the history, the store and each member
+// in different orders. Chats that are not in the index have nothing to
+// keep in order, and get a lock of their own.
+func (ci *chatIndex) ordering(chatID string) *sync.Mutex {
+	ci.RLock()
+	defer ci.RUnlock()
+
+	if e, ok := ci.byID[chatID]; ok {
+		return &e.order
+	}
+	return &sync.Mutex{}
+}
+
+func (ci *chatIndex) snapshot() []*chat.Chat {
+	ci.RLock()
+	defer ci.RUnlock()
+
+	chats := make([]*chat.Chat, 0, len(ci.byID))
+	for _, e := range ci.byID {
+		chats = append(chats, e.chat)
+	}
+
+	return chats
+}
+
+// shardFor picks the message worker for a client. All of one client's
+// messages land on the same worker, so they are handled in order.
+func shardFor(clientID string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(clientID))
+	return int(h.Sum32() % uint32(shards))
+}
+
+type (
+	// presenceIndex records which users are connected to the other nodes
+	// of the deployment, as reported over the bus.
+	presenceIndex struct {
+		sync.RWMutex
+		byName map[string]remoteUser
+		byNode map[string]map[string]struct{}
+	}
+
+	remoteUser struct {
+		Node string
+		User user.User
+	}
+)
+
+func newPresenceIndex() *presenceIndex {
+	return &presenceIndex{
+		byName: make(map[string]remoteUser),
+		byNode: make(map[string]map[string]struct{}),
+	}
+}
+
+func (pi *presenceIndex) join(node string, u user.User) {
+	pi.Lock()
+	defer pi.Unlock()
+
+	pi.joinLocked(node, u)
+}
+
+func (pi *presenceIndex) joinLocked(node string, u user.User) {
+	if pi.byNode[node] == nil {
+		pi.byNode[node] = make(map[string]struct{})
+	}
+	pi.byNode[node][u.Name] = struct{}{}
+	pi.byName[u.Name] = remoteUser{Node: node, User: u}
+}
+
+func (pi *presenceIndex) leave(node string, userName string) {
+	pi.Lock()
+	defer pi.Unlock()
+
+	pi.leaveLocked(node, userName)
+}
+
+func (pi *presenceIndex) leaveLocked(node string, userName string) {
+	delete(pi.byNode[node], userName)
+	if ru, ok := pi.byName[userName]; ok && ru.Node == node {
+		delete(pi.byName, userName)
+	}
+}
+
+// sync replaces everything known about node with users.
+func (pi *presenceIndex) sync(node string, users []user.User) {
+	pi.Lock()
+	defer pi.Unlock()
+
+	pi.dropLocked(node)
+	for _, u := range users {
+		pi.joinLocked(node, u)
+	}
+}
+
+func (pi *presenceIndex) drop(node string) {
+	pi.Lock()
+	defer pi.Unlock()
+
+	pi.dropLocked(node)
+}
+
+func (pi *presenceIndex) dropLocked(node string) {
+	for name := range pi.byNode[node] {
+		pi.leaveLocked(node, name)
+	}
+	delete(pi.byNode, node)
+}
+
+func (pi *presenceIndex) lookup(userName string) (remoteUser, bool) {
+	pi.RLock()
+	defer pi.RUnlock()
+
+	ru, ok := pi.byName[userName]
+	return ru, ok
+}
+
+func (pi *presenceIndex) len() int {
+	pi.RLock()
+	defer pi.RUnlock()
+
+	return len(pi.byName)
+}
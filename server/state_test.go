@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"sweetspeak/chat"
+	"sweetspeak/message"
+	"sweetspeak/user"
+	"sweetspeak/websockets"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// benchClients is how many simulated clients the state benchmarks hold.
+const benchClients = 10_000
+
+var (
+	benchOnce    sync.Once
+	benchSrv     *Server
+	benchMembers []*ServerClient
+)
+
+// benchServer returns a server holding benchClients simulated clients,
+// paired up into chats. Nothing is networked. It is built once and
+// shared, as building it takes far longer than any benchmark step.
+func benchServer(b *testing.B) (*Server, []*ServerClient) {
+	b.Helper()
+
+	benchOnce.Do(func() {
+		benchSrv = New()
+		benchMembers = simulatedClients(benchClients)
+		for _, c := range benchMembers {
+			benchSrv.AddClient(c)
+		}
+
+		for i := range benchClients / 2 {
+			users := []user.User{benchMembers[2*i].User, benchMembers[2*i+1].User}
+			benchSrv.AddChat(chat.New(fmt.Sprintf("chat-%d", i), fmt.Sprintf("chat %d", i), users))
+		}
+	})
+
+	return benchSrv, benchMembers
+}
+
+func simulatedClients(n int) []*ServerClient {
+	clients := make([]*ServerClient, n)
+	for i := range clients {
+		clients[i] = &ServerClient{
+			ClientID:  uuid.NewString(),
+			User:      *user.New(fmt.Sprintf("sim-%d", i), "241"),
+			WSHandler: websockets.New(),
+		}
+		clients[i].Connected.Store(true)
+	}
+
+	return clients
+}
+
+func BenchmarkAddRemoveClient(b *testing.B) {
+	s, _ := benchServer(b)
+	churn := simulatedClients(b.N)
+
+	b.ResetTimer()
+	for _, c := range churn {
+		s.AddClient(c)
+		s.RemoveClient(c)
+		c.WSHandler.Close()
+	}
+}
+
+func BenchmarkLookupClientByName(b *testing.B) {
+	s, clients := benchServer(b)
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(next.Add(1)) % len(clients)
+			if s.LookupClient("", clients[i].User.Name) == nil {
+				b.Fatalf("client %d not found", i)
+			}
+		}
+	})
+}
+
+func BenchmarkLookupClientByID(b *testing.B) {
+	s, clients := benchServer(b)
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(next.Add(1)) % len(clients)
+			if s.LookupClient(clients[i].ClientID, "") == nil {
+				b.Fatalf("client %d not found", i)
+			}
+		}
+	})
+}
+
+func BenchmarkLookupChatAddMessage(b *testing.B) {
+	s, _ := benchServer(b)
+	chats := benchClients / 2
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(next.Add(1)) % chats
+			c := s.LookupChat(fmt.Sprintf("chat-%d", i))
+			if c == nil {
+				b.Fatalf("chat %d not found", i)
+			}
+			c.AddMessage(message.TextMessage{ChatID: c.ID, Content: "hello"})
+		}
+	})
+}
+
+func TestChatOrderingGoesWithTheChat(t *testing.T) {
+	ci := newChatIndex()
+	ci.add(chat.New("chat", "general", nil))
+
+	if ci.ordering("chat") != ci.ordering("chat") {
+		t.Fatal("one chat got two ordering locks")
+	}
+
+	ci.remove("chat")
+	if len(ci.byID) != 0 {
+		t.Fatalf("index still holds %d entries", len(ci.byID))
+	}
+}
+
+func TestRemoveClientWhileReading(t *testing.T) {
+	s := New()
+	client := simulatedClients(1)[0]
+	s.clients.add(client)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			_ = client.String()
+		}
+	}()
+	s.RemoveClient(client)
+	<-done
+
+	if client.Connected.Load() {
+		t.Fatal("removed client still marked connected")
+	}
+}
@@ -0,0 +1,17 @@
+package store
+
+import (
+	"os"
+	log "sweetspeak/logging"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Keep test logs out of the source tree.
+	log.DefaultLogDir = os.TempDir()
+	log.SetGlobalFile("sweetspeak-store-test.log")
+	log.SetConsoleOutput(false)
+	log.SetGlobalLevel(log.ERROR)
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sweetspeak/chat"
+	log "sweetspeak/logging"
+	"sweetspeak/message"
+	"sweetspeak/user"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	DefaultDataDir = "data"
+	// SyncInterval is how often written records are fsynced to disk.
+	SyncInterval = time.Second
+)
+
+type (
+	// Store persists chats and their message history for the server.
+	Store interface {
+		SaveChat(c *chat.Chat) error
+		AppendMessage(tm message.TextMessage) error
+		LoadChats() ([]*chat.Chat, error)
+		Flush() error
+		Close() error
+		// Check reports whether the store can still take writes.
+		Check() error
+	}
+
+	// FileStore appends every chat and message as a YAML document to a
+	// single file.
+	//
+	// Each record is handed to the OS as it is written, so a crash or
+	// kill of the server loses nothing already stored. Records are
+	// fsynced every SyncInterval and on Flush and Close: a power loss or
+	// kernel crash can lose up to SyncInterval of history.
+	FileStore struct {
+		sync.Mutex
+		path   string
+		file   *os.File
+		writer *bufio.Writer
+		// unsynced is set when there are writes not yet fsynced.
+		unsynced bool
+		done     chan struct{}
+	}
+
+	record struct {
+		Chat    *chatRecord          `yaml:"chat,omitempty"`
+		Message *message.TextMessage `yaml:"message,omitempty"`
+	}
+
+	chatRecord struct {
+		ID    string      `yaml:"id"`
+		Name  string      `yaml:"name"`
+		Users []user.User `yaml:"users"`
+	}
+)
+
+// Open opens (creating if needed) the file store named fileName in
+// DefaultDataDir.
+func Open(fileName string) (*FileStore, error) {
+	if err := os.MkdirAll(DefaultDataDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(DefaultDataDir, fileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		path:   path,
+		file:   file,
+		writer: bufio.NewWriter(file),
+		done:   make(chan struct{}),
+	}
+
+	go fs.syncEvery(SyncInterval)
+
+	return fs, nil
+}
+
+func (fs *FileStore) SaveChat(c *chat.Chat) error {
+	c.Lock()
+	rec := record{
+		Chat: &chatRecord{
+			ID:    c.ID,
+			Name:  c.Name,
+			Users: c.Users,
+		},
+	}
+	c.Unlock()
+
+	return fs.write(rec)
+}
+
+func (fs *FileStore) AppendMessage(tm message.TextMessage) error {
+	return fs.write(record{Message: &tm})
+}
+
+func (fs *FileStore) write(rec record) error {
+	data, err := yaml.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.file == nil {
+		return fmt.Errorf("store: %s is closed", fs.path)
+	}
+
+	if _, err := fs.writer.WriteString("---\n"); err != nil {
+		return err
+	}
+
+	if _, err := fs.writer.Write(data); err != nil {
+		return err
+	}
+	fs.unsynced = true
+
+	// One write per record: it is in the OS as soon as we return.
+	return fs.writer.Flush()
+}
+
+func (fs *FileStore) syncEvery(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fs.done:
+			return
+		case <-ticker.C:
+			fs.Lock()
+			dirty := fs.unsynced && fs.file != nil
+			fs.Unlock()
+
+			if dirty {
+				if err := fs.Flush(); err != nil {
+					log.Error("store: syncing %s: %v", fs.path, err)
+				}
+			}
+		}
+	}
+}
+
+// LoadChats reads back every chat in the store along with its messages,
+// in the order they were written.
+//
+// A record that cannot be decoded is skipped. If it is the last one, it
+// was torn by a crash in the middle of a write: it is cut off, so that
+// new records are not appended after it.
+func (fs *FileStore) LoadChats() ([]*chat.Chat, error) {
+	if err := fs.Flush(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(fs.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		chats   []*chat.Chat
+		chatIdx = make(map[string]*chat.Chat)
+	)
+
+	for start := 0; start < len(data); {
+		// Every record starts with a "---" line.
+		end := len(data)
+		if i := bytes.Index(data[start+1:], []byte("\n---\n")); i >= 0 {
+			end = start + 1 + i + 1
+		}
+
+		rec, ok := decodeRecord(data[start:end])
+		switch {
+		case !ok && end == len(data):
+			log.Warn("store: %s: dropping a torn record at offset %d", fs.path, start)
+			return chats, fs.truncate(int64(start))
+		case !ok:
+			log.Warn("store: %s: skipping an unreadable record at offset %d", fs.path, start)
+		case rec.Chat != nil:
+			c := chat.New(rec.Chat.ID, rec.Chat.Name, rec.Chat.Users)
+			chatIdx[c.ID] = c
+			chats = append(chats, c)
+		case rec.Message != nil:
+			if c, ok := chatIdx[rec.Message.ChatID]; ok {
+				c.AddMessage(*rec.Message)
+			}
+		}
+
+		start = end
+	}
+
+	return chats, nil
+}
+
+// decodeRecord decodes one record as written by write, which always
+// ends it with a newline.
+func decodeRecord(doc []byte) (record, bool) {
+	var rec record
+	if !bytes.HasSuffix(doc, []byte("\n")) {
+		return rec, false
+	}
+	if err := yaml.Unmarshal(doc, &rec); err != nil {
+		return rec, false
+	}
+
+	return rec, rec.Chat != nil || rec.Message != nil
+}
+
+func (fs *FileStore) truncate(size int64) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.file == nil {
+		return fmt.Errorf("store: %s is closed", fs.path)
+	}
+
+	if err := fs.file.Truncate(size); err != nil {
+		return fmt.Errorf("store: truncating %s: %v", fs.path, err)
+	}
+
+	return fs.file.Sync()
+}
+
+func (fs *FileStore) Flush() error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.file == nil {
+		return nil
+	}
+
+	if err := fs.writer.Flush(); err != nil {
+		return err
+	}
+	if err := fs.file.Sync(); err != nil {
+		return err
+	}
+	fs.unsynced = false
+
+	return nil
+}
+
+func (fs *FileStore) Check() error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.file == nil {
+		return fmt.Errorf("store: %s is closed", fs.path)
+	}
+
+	if _, err := fs.file.Stat(); err != nil {
+		return fmt.Errorf("store: %v", err)
+	}
+
+	return nil
+}
+
+func (fs *FileStore) Close() error {
+	if err := fs.Flush(); err != nil {
+		return err
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.file == nil {
+		return nil
+	}
+
+	close(fs.done)
+	err := fs.file.Close()
+	fs.file = nil
+
+	return err
+}
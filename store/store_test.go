@@ -0,0 +1,176 @@
+package store
+
+import (
+	"os"
+	"sweetspeak/chat"
+	"sweetspeak/message"
+	"sweetspeak/user"
+	"testing"
+	"time"
+)
+
+// openStore opens a store in a fresh data directory.
+func openStore(t *testing.T) *FileStore {
+	t.Helper()
+
+	dataDir := DefaultDataDir
+	DefaultDataDir = t.TempDir()
+	t.Cleanup(func() { DefaultDataDir = dataDir })
+
+	return reopen(t, nil)
+}
+
+// reopen closes fs, if any, and opens the store again.
+func reopen(t *testing.T, fs *FileStore) *FileStore {
+	t.Helper()
+
+	if fs != nil {
+		if err := fs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs, err := Open("chats.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+
+	return fs
+}
+
+func text(chatID string, content string) message.TextMessage {
+	return message.TextMessage{
+		ID:        content,
+		ChatID:    chatID,
+		From:      *user.New("alice", "1"),
+		Timestamp: time.Now(),
+		Content:   content,
+	}
+}
+
+func load(t *testing.T, fs *FileStore) []*chat.Chat {
+	t.Helper()
+
+	chats, err := fs.LoadChats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chats
+}
+
+func contents(c *chat.Chat) []string {
+	var got []string
+	for _, m := range c.Messages {
+		got = append(got, m.Content)
+	}
+	return got
+}
+
+func TestRoundTrip(t *testing.T) {
+	fs := openStore(t)
+
+	users := []user.User{*user.New("alice", "1"), *user.New("bob", "2")}
+	if err := fs.SaveChat(chat.New("chat", "alice and bob", users)); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"one", "two", "three\n---\nfour"} {
+		if err := fs.AppendMessage(text("chat", content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Messages of unknown chats are dropped.
+	if err := fs.AppendMessage(text("nowhere", "lost")); err != nil {
+		t.Fatal(err)
+	}
+
+	chats := load(t, reopen(t, fs))
+	if len(chats) != 1 {
+		t.Fatalf("loaded %d chats", len(chats))
+	}
+
+	c := chats[0]
+	if c.ID != "chat" || c.Name != "alice and bob" || len(c.Users) != 2 {
+		t.Fatalf("loaded chat %s %q with %d users", c.ID, c.Name, len(c.Users))
+	}
+	if got := contents(c); len(got) != 3 || got[0] != "one" || got[2] != "three\n---\nfour" {
+		t.Fatalf("loaded messages %q", got)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	fs := openStore(t)
+
+	if err := fs.SaveChat(chat.New("chat", "general", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.AppendMessage(text("chat", "whole")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := info.Size()
+
+	// A crash halfway through the next record.
+	f, err := os.OpenFile(fs.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("---\nmessage:\n    id: torn\n    chat_"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fs = reopen(t, nil)
+	chats := load(t, fs)
+	if len(chats) != 1 || len(chats[0].Messages) != 1 {
+		t.Fatalf("loaded %d chats, want the one before the torn record", len(chats))
+	}
+
+	if info, err = os.Stat(fs.path); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != good {
+		t.Fatalf("store is %d bytes, want it cut back to %d", info.Size(), good)
+	}
+
+	// Later records load again.
+	if err := fs.AppendMessage(text("chat", "after")); err != nil {
+		t.Fatal(err)
+	}
+	chats = load(t, reopen(t, fs))
+	if got := contents(chats[0]); len(got) != 2 || got[1] != "after" {
+		t.Fatalf("loaded messages %q", got)
+	}
+}
+
+func TestSyncEvery(t *testing.T) {
+	interval := SyncInterval
+	SyncInterval = 10 * time.Millisecond
+	t.Cleanup(func() { SyncInterval = interval })
+
+	fs := openStore(t)
+	if err := fs.AppendMessage(text("chat", "hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fs.Lock()
+		unsynced := fs.unsynced
+		fs.Unlock()
+
+		if !unsynced {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the record was never synced")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,85 @@
+package theme
+
+var (
+	// Dark is the default, for light text on a dark terminal.
+	Dark = Theme{
+		Name:           "dark",
+		Title:          "#FAFAFA",
+		Subtle:         "241",
+		Dim:            "8",
+		Accent:         "69",
+		Unfocused:      "241",
+		Success:        "10",
+		Warning:        "11",
+		Badge:          "161",
+		BadgeText:      "#FAFAFA",
+		Highlight:      "220",
+		HighlightText:  "232",
+		Mention:        "75",
+		Meta:           "243",
+		Rule:           "240",
+		Link:           "39",
+		Code:           "203",
+		CodeBackground: "236",
+		CodeText:       "252",
+		Keyword:        "204",
+		String:         "114",
+		Number:         "215",
+		Comment:        "244",
+	}
+
+	// Light is for dark text on a light terminal.
+	Light = Theme{
+		Name:           "light",
+		Title:          "235",
+		Subtle:         "243",
+		Dim:            "246",
+		Accent:         "26",
+		Unfocused:      "250",
+		Success:        "28",
+		Warning:        "130",
+		Badge:          "161",
+		BadgeText:      "231",
+		Highlight:      "220",
+		HighlightText:  "232",
+		Mention:        "25",
+		Meta:           "244",
+		Rule:           "250",
+		Link:           "26",
+		Code:           "160",
+		CodeBackground: "254",
+		CodeText:       "236",
+		Keyword:        "125",
+		String:         "28",
+		Number:         "130",
+		Comment:        "245",
+	}
+
+	// HighContrast sticks to the 16 basic colors at their brightest, for
+	// low vision and terminals with their own palette.
+	HighContrast = Theme{
+		Name:           "high-contrast",
+		Title:          "15",
+		Subtle:         "15",
+		Dim:            "7",
+		Accent:         "14",
+		Unfocused:      "7",
+		Success:        "10",
+		Warning:        "11",
+		Badge:          "9",
+		BadgeText:      "15",
+		Highlight:      "11",
+		HighlightText:  "0",
+		Mention:        "14",
+		Meta:           "7",
+		Rule:           "7",
+		Link:           "14",
+		Code:           "11",
+		CodeBackground: "0",
+		CodeText:       "15",
+		Keyword:        "13",
+		String:         "10",
+		Number:         "11",
+		Comment:        "7",
+	}
+)
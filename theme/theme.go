@@ -0,0 +1,188 @@
+package theme
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/lipgloss"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// Theme is the palette every style in the TUI is built from. Colors
+	// are anything lipgloss.Color takes: "#rrggbb" or an ANSI 0-255.
+	Theme struct {
+		Name string `yaml:"name"`
+		// Base is the theme a file starts from; the colors it sets
+		// replace the base's. Dark when empty.
+		Base string `yaml:"base,omitempty"`
+
+		// Title is for titles and text that must stand out.
+		Title lipgloss.Color `yaml:"title"`
+		// Subtle is for help, hints and system lines.
+		Subtle lipgloss.Color `yaml:"subtle"`
+		// Dim is for what is waiting, like a pending connection.
+		Dim lipgloss.Color `yaml:"dim"`
+		// Accent marks what has focus.
+		Accent lipgloss.Color `yaml:"accent"`
+		// Unfocused is the border of panels without focus.
+		Unfocused lipgloss.Color `yaml:"unfocused"`
+		Success   lipgloss.Color `yaml:"success"`
+		Warning   lipgloss.Color `yaml:"warning"`
+
+		// Badge and BadgeText are the unread count.
+		Badge     lipgloss.Color `yaml:"badge"`
+		BadgeText lipgloss.Color `yaml:"badge_text"`
+		// Highlight and HighlightText pick out mentions of us and search
+		// matches.
+		Highlight     lipgloss.Color `yaml:"highlight"`
+		HighlightText lipgloss.Color `yaml:"highlight_text"`
+		// Mention is an @mention of someone else.
+		Mention lipgloss.Color `yaml:"mention"`
+
+		// Meta is for message times and search hit details.
+		Meta lipgloss.Color `yaml:"meta"`
+		// Rule is for day separators and code block gutters.
+		Rule lipgloss.Color `yaml:"rule"`
+		Link lipgloss.Color `yaml:"link"`
+
+		Code           lipgloss.Color `yaml:"code"`
+		CodeBackground lipgloss.Color `yaml:"code_background"`
+		CodeText       lipgloss.Color `yaml:"code_text"`
+		Keyword        lipgloss.Color `yaml:"keyword"`
+		String         lipgloss.Color `yaml:"string"`
+		Number         lipgloss.Color `yaml:"number"`
+		Comment        lipgloss.Color `yaml:"comment"`
+	}
+)
+
+var (
+	mu       sync.Mutex
+	themes   = map[string]Theme{}
+	current  = Dark
+	onChange []func(Theme)
+)
+
+func init() {
+	for _, t := range []Theme{Dark, Light, HighContrast} {
+		Register(t)
+	}
+}
+
+// Register makes t available by name, replacing any theme of that name.
+func Register(t Theme) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	themes[strings.ToLower(t.Name)] = t
+}
+
+// Get returns the registered theme called name.
+func Get(name string) (Theme, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	t, ok := themes[strings.ToLower(name)]
+	return t, ok
+}
+
+// Names lists the registered themes.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(themes))
+	for _, t := range themes {
+		names = append(names, t.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Load reads a theme from a YAML file and registers it. A file without
+// a name is named after itself.
+func Load(path string) (Theme, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Theme{}, fmt.Errorf("theme: %v", err)
+	}
+
+	var head struct {
+		Base string `yaml:"base"`
+	}
+	if err := yaml.Unmarshal(data, &head); err != nil {
+		return Theme{}, fmt.Errorf("theme: %s: %v", path, err)
+	}
+
+	t := Dark
+	if head.Base != "" {
+		var ok bool
+		if t, ok = Get(head.Base); !ok {
+			return Theme{}, fmt.Errorf("theme: %s: unknown base theme %q", path, head.Base)
+		}
+	}
+
+	t.Name = ""
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return Theme{}, fmt.Errorf("theme: %s: %v", path, err)
+	}
+	if t.Name == "" {
+		t.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	Register(t)
+
+	return t, nil
+}
+
+// Find returns the theme called nameOrPath, loading it if it names a
+// YAML file.
+func Find(nameOrPath string) (Theme, error) {
+	if t, ok := Get(nameOrPath); ok {
+		return t, nil
+	}
+
+	switch filepath.Ext(nameOrPath) {
+	case ".yaml", ".yml":
+		return Load(nameOrPath)
+	}
+
+	return Theme{}, fmt.Errorf("theme: no theme %q (have %s)", nameOrPath, strings.Join(Names(), ", "))
+}
+
+// Current is the theme in use.
+func Current() Theme {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return current
+}
+
+// Use switches to t, restyling everything that asked to follow the
+// theme. Call it from the UI's update loop, which is what renders.
+func Use(t Theme) {
+	mu.Lock()
+	current = t
+	fns := onChange
+	mu.Unlock()
+
+	for _, fn := range fns {
+		fn(t)
+	}
+}
+
+// OnChange has fn build its styles from the current theme now and
+// again whenever it changes. Packages with styles call it from init.
+func OnChange(fn func(Theme)) {
+	mu.Lock()
+	onChange = append(onChange, fn)
+	t := current
+	mu.Unlock()
+
+	fn(t)
+}
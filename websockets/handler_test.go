@@ -0,0 +1,326 @@
+package websockets
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sweetspeak/message"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+// dial connects a bare gorilla connection to addr, which answers pings
+// only while something reads from it.
+func dial(t *testing.T, addr string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func accept(t *testing.T, accepted <-chan *WebsocketHandler) *WebsocketHandler {
+	t.Helper()
+
+	select {
+	case w := <-accepted:
+		t.Cleanup(w.Close)
+		return w
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection accepted")
+		return nil
+	}
+}
+
+func closed(t *testing.T, w *WebsocketHandler, within time.Duration) {
+	t.Helper()
+
+	select {
+	case <-w.Done():
+	case <-time.After(within):
+		t.Fatalf("connection still open after %s", within)
+	}
+}
+
+// setGlobal sets *v for the duration of the test.
+func setGlobal[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+func TestDocuments(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		frame string
+		want  []string
+	}{
+		{"empty", "", nil},
+		{"one", "a: 1\n", []string{"a: 1\n"}},
+		{"leading separator", "---\na: 1\n", []string{"a: 1\n"}},
+		{"several", "a: 1\n---\nb: 2\n---\nc: 3\n", []string{"a: 1", "b: 2", "c: 3\n"}},
+		{"blank documents", "a: 1\n---\n\n---\nb: 2\n", []string{"a: 1", "b: 2\n"}},
+		{"indented separator", "a: |\n  ---\n  x\n", []string{"a: |\n  ---\n  x\n"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, doc := range documents([]byte(tc.frame)) {
+				got = append(got, string(doc))
+			}
+			if strings.Join(got, "|") != strings.Join(tc.want, "|") || len(got) != len(tc.want) {
+				t.Fatalf("documents(%q) = %q, want %q", tc.frame, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDocumentsRoundTrip(t *testing.T) {
+	// Content that looks like a separator must not split a message.
+	msgs := []message.WSMessage{
+		message.NewNotice(message.AnnouncementNotice, "one"),
+		message.NewNotice(message.AnnouncementNotice, "two\n---\nthree"),
+	}
+
+	frame := msgs[0].String() + "---\n" + msgs[1].String()
+	docs := documents([]byte(frame))
+	if len(docs) != len(msgs) {
+		t.Fatalf("%d documents, want %d", len(docs), len(msgs))
+	}
+
+	for i, doc := range docs {
+		var wsMsg message.WSMessage
+		if err := yaml.Unmarshal(doc, &wsMsg); err != nil {
+			t.Fatal(err)
+		}
+		if wsMsg.MessageID != msgs[i].MessageID {
+			t.Errorf("document %d is message %s, want %s", i, wsMsg.MessageID, msgs[i].MessageID)
+		}
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	setGlobal(t, &OutboundQueueSize, 1)
+	setGlobal(t, &WriteTimeout, 50*time.Millisecond)
+
+	for _, tc := range []struct {
+		policy     OverflowPolicy
+		wantClosed bool
+	}{
+		{OverflowBlock, false},
+		{OverflowDrop, false},
+		{OverflowDisconnect, true},
+	} {
+		t.Run(overflowPolicies[tc.policy], func(t *testing.T) {
+			// Nothing drains the queue.
+			w := New().WithOverflowPolicy(tc.policy)
+			w.active = true
+
+			if err := w.Write(message.NewNotice(message.AnnouncementNotice, "fits")); err != nil {
+				t.Fatalf("first write: %v", err)
+			}
+
+			start := time.Now()
+			err := w.Write(message.NewNotice(message.AnnouncementNotice, "overflows"))
+			if !errors.Is(err, ErrQueueFull) {
+				t.Fatalf("write to a full queue: %v, want ErrQueueFull", err)
+			}
+			if waited := time.Since(start); tc.policy == OverflowBlock && waited < WriteTimeout {
+				t.Errorf("blocked for %s, want WriteTimeout", waited)
+			}
+			if w.IsClosed() != tc.wantClosed {
+				t.Errorf("closed = %t, want %t", w.IsClosed(), tc.wantClosed)
+			}
+		})
+	}
+}
+
+func TestOverflowBlockWaitsForRoom(t *testing.T) {
+	setGlobal(t, &OutboundQueueSize, 1)
+
+	w := New()
+	w.active = true
+	if err := w.Write(message.NewNotice(message.AnnouncementNotice, "fits")); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-w.WriteCh
+	}()
+
+	if err := w.Write(message.NewNotice(message.AnnouncementNotice, "waits")); err != nil {
+		t.Fatalf("write once there is room: %v", err)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	heartbeat := func(w *WebsocketHandler) {
+		w.WithHeartbeat(10*time.Millisecond, 200*time.Millisecond)
+	}
+
+	t.Run("pongs measure latency", func(t *testing.T) {
+		accepted := make(chan *WebsocketHandler, 1)
+		conn := dial(t, serveWith(t, accepted, heartbeat))
+		w := accept(t, accepted)
+
+		// Reading answers the handler's pings.
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for w.Latency() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("no round trip measured")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		// Well past the pong timeout, the connection is still up.
+		time.Sleep(400 * time.Millisecond)
+		if w.IsClosed() {
+			t.Fatal("a live peer was dropped")
+		}
+	})
+
+	t.Run("missing pongs close the connection", func(t *testing.T) {
+		accepted := make(chan *WebsocketHandler, 1)
+		dial(t, serveWith(t, accepted, heartbeat))
+		w := accept(t, accepted)
+
+		// The peer never reads, so it never answers.
+		closed(t, w, 2*time.Second)
+	})
+}
+
+// serveRaw starts a websocket server that hands over the bare
+// connections it accepts, and returns its address.
+func serveRaw(t *testing.T, accepted chan<- *websocket.Conn) string {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestCoalescing(t *testing.T) {
+	setGlobal(t, &MaxFrameSize, 1024)
+
+	accepted := make(chan *websocket.Conn, 1)
+	addr := serveRaw(t, accepted)
+
+	client := New()
+	if err := client.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	conn := <-accepted
+	t.Cleanup(func() { conn.Close() })
+
+	// Queue everything before the write pump starts, so that it is all
+	// waiting for the first flush.
+	const sent = 20
+	for range sent {
+		if err := client.Write(message.NewNotice(message.AnnouncementNotice, strings.Repeat("x", 200))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Start()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frames, received := 0, 0
+	for received < sent {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("after %d messages: %v", received, err)
+		}
+		if len(frame) > MaxFrameSize {
+			t.Fatalf("frame of %d bytes, over MaxFrameSize", len(frame))
+		}
+		frames++
+		received += len(documents(frame))
+	}
+
+	if received != sent {
+		t.Fatalf("received %d messages, sent %d", received, sent)
+	}
+	if frames == 1 || frames == sent {
+		t.Fatalf("%d messages took %d frames, want them coalesced up to MaxFrameSize", sent, frames)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	accepted := make(chan *WebsocketHandler, 1)
+	conn := dial(t, serveWith(t, accepted, func(w *WebsocketHandler) {
+		w.WithReadLimit(100)
+	}))
+	w := accept(t, accepted)
+
+	big := message.NewNotice(message.AnnouncementNotice, strings.Repeat("x", 200))
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte(big.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("read after a message over the limit: %v, want CloseMessageTooBig", err)
+	}
+	closed(t, w, time.Second)
+}
+
+func TestCloseWithCode(t *testing.T) {
+	accepted := make(chan *WebsocketHandler, 1)
+	conn := dial(t, serve(t, accepted))
+	w := accept(t, accepted)
+
+	queued := message.NewNotice(message.KickedNotice, "bye")
+	if err := w.Write(queued); err != nil {
+		t.Fatal(err)
+	}
+	closing := make(chan struct{})
+	go func() {
+		defer close(closing)
+		w.CloseWithCode(websocket.ClosePolicyViolation, "kicked")
+	}()
+	t.Cleanup(func() { <-closing })
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("the queued message was not sent before the close: %v", err)
+	}
+	if docs := documents(frame); len(docs) != 1 || !strings.Contains(string(docs[0]), queued.MessageID) {
+		t.Fatalf("got %q, want the queued message", frame)
+	}
+
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "kicked" {
+		t.Fatalf("read after CloseWithCode: %v", err)
+	}
+	closed(t, w, 2*CloseGracePeriod)
+}
@@ -0,0 +1,17 @@
+package websockets
+
+import (
+	"os"
+	log "sweetspeak/logging"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Keep test logs out of the source tree.
+	log.DefaultLogDir = os.TempDir()
+	log.SetGlobalFile("sweetspeak-websockets-test.log")
+	log.SetConsoleOutput(false)
+	log.SetGlobalLevel(log.ERROR)
+
+	os.Exit(m.Run())
+}
@@ -1,17 +1,76 @@
 package websockets
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	log "sweetspeak/logging"
 	"sweetspeak/message"
+	"sweetspeak/metrics"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"gopkg.in/yaml.v3"
 )
 
 var (
-        CloseErrors = []int{websocket.CloseNormalClosure, websocket.CloseAbnormalClosure}
+	CloseErrors = []int{websocket.CloseNormalClosure, websocket.CloseAbnormalClosure, websocket.CloseGoingAway}
+
+	// Every handler pings its peer each PingInterval and drops the
+	// connection if nothing (pong, ping) is heard within PongTimeout.
+	PingInterval = 20 * time.Second
+	PongTimeout  = 60 * time.Second
+	WriteTimeout = 10 * time.Second
+
+	// OutboundQueueSize bounds the number of messages waiting for the
+	// write pump. Up to MaxCoalesce queued messages are flushed together
+	// as one frame holding a YAML document stream, as long as the frame
+	// stays within MaxFrameSize bytes.
+	OutboundQueueSize = 256
+	MaxCoalesce       = 32
+	// MaxFrameSize is the most the write pump packs into one frame; a
+	// single bigger message still goes out alone. Peers must accept
+	// frames at least this big, see WithReadLimit.
+	MaxFrameSize = 64 * 1024
+
+	// CloseGracePeriod is how long CloseWithCode waits for the peer to
+	// answer our close frame before dropping the connection.
+	CloseGracePeriod = time.Second
+
+	ErrQueueFull = errors.New("websockets: outbound queue full")
+	ErrClosed    = errors.New("websockets: connection closed")
+
+	framesRead       = metrics.NewCounter("sweetspeak_ws_frames_read_total", "Websocket data frames read.")
+	framesWritten    = metrics.NewCounter("sweetspeak_ws_frames_written_total", "Websocket data frames written.")
+	messagesRead     = metrics.NewCounter("sweetspeak_ws_messages_read_total", "Messages decoded from websocket frames.")
+	messagesWritten  = metrics.NewCounter("sweetspeak_ws_messages_written_total", "Messages written to websocket frames.")
+	bytesRead        = metrics.NewCounter("sweetspeak_ws_bytes_read_total", "Websocket payload bytes read.")
+	bytesWritten     = metrics.NewCounter("sweetspeak_ws_bytes_written_total", "Websocket payload bytes written.")
+	outboundDropped  = metrics.NewCounterVec("sweetspeak_ws_outbound_dropped_total", "Outbound messages not delivered because the queue was full, by overflow policy.", "policy")
+	readErrors       = metrics.NewCounter("sweetspeak_ws_read_errors_total", "Websocket reads that failed or could not be decoded.")
+	pingRoundTrip    = metrics.NewHistogram("sweetspeak_ws_ping_rtt_seconds", "Round trip time of websocket heartbeat pings.", metrics.DefaultBuckets)
+	overflowPolicies = map[OverflowPolicy]string{
+		OverflowBlock:      "block",
+		OverflowDrop:       "drop",
+		OverflowDisconnect: "disconnect",
+	}
+)
+
+// OverflowPolicy decides what Write does when the outbound queue of a
+// slow peer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits up to WriteTimeout for room in the queue, then
+	// gives up on the message.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop drops the message immediately.
+	OverflowDrop
+	// OverflowDisconnect closes the connection to the slow peer.
+	OverflowDisconnect
 )
 
 type WebsocketHandler struct {
@@ -20,12 +79,32 @@ type WebsocketHandler struct {
 	WriteCh chan message.WSMessage
 	conn    *websocket.Conn
 	active  bool
+	done    chan struct{}
+
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	latency      time.Duration
+	overflow     OverflowPolicy
+	closeCh      chan closeRequest
+	readLimit    int64
+	// pending is a message taken from the queue that didn't fit in the
+	// last frame; it starts the next one.
+	pending *message.WSMessage
+}
+
+type closeRequest struct {
+	code   int
+	reason string
 }
 
 func New() *WebsocketHandler {
 	w := &WebsocketHandler{
-		ReadCh:  make(chan message.WSMessage),
-		WriteCh: make(chan message.WSMessage),
+		ReadCh:       make(chan message.WSMessage),
+		WriteCh:      make(chan message.WSMessage, OutboundQueueSize),
+		done:         make(chan struct{}),
+		closeCh:      make(chan closeRequest, 1),
+		pingInterval: PingInterval,
+		pongTimeout:  PongTimeout,
 	}
 
 	return w
@@ -36,9 +115,41 @@ func (w *WebsocketHandler) WithConn(conn *websocket.Conn) *WebsocketHandler {
 	return w
 }
 
+// WithHeartbeat overrides the package-wide PingInterval and PongTimeout
+// for this handler. It must be called before Start.
+func (w *WebsocketHandler) WithHeartbeat(pingInterval, pongTimeout time.Duration) *WebsocketHandler {
+	w.pingInterval = pingInterval
+	w.pongTimeout = pongTimeout
+	return w
+}
+
+func (w *WebsocketHandler) WithOverflowPolicy(policy OverflowPolicy) *WebsocketHandler {
+	w.overflow = policy
+	return w
+}
+
+// WithReadLimit caps the size of a single incoming message. A peer that
+// sends a bigger one is disconnected with CloseMessageTooBig. Frames
+// may be bigger, up to MaxFrameSize, when they hold several messages.
+func (w *WebsocketHandler) WithReadLimit(limit int64) *WebsocketHandler {
+	w.readLimit = limit
+	return w
+}
+
 func (w *WebsocketHandler) Start() *WebsocketHandler {
+	if w.readLimit > 0 {
+		w.conn.SetReadLimit(max(w.readLimit, int64(MaxFrameSize)))
+	}
+	w.conn.SetReadDeadline(time.Now().Add(w.pongTimeout))
+	w.conn.SetPongHandler(w.handlePong)
+	w.conn.SetPingHandler(w.handlePing)
+
+	w.Lock()
+	w.active = true
+	w.Unlock()
+
 	go w.ReadPump()
-        w.active = true
+	go w.WritePump()
 	return w
 }
 
@@ -57,6 +168,8 @@ func (w *WebsocketHandler) Connect(addr string) error {
 }
 
 func (w *WebsocketHandler) ReadPump() {
+	defer close(w.ReadCh)
+
 	for !w.IsClosed() {
 		if err := w.read(); err != nil {
 			log.Error("websockets: read: %v", err)
@@ -66,31 +179,299 @@ func (w *WebsocketHandler) ReadPump() {
 
 func (w *WebsocketHandler) read() error {
 	_, msgBytes, err := w.conn.ReadMessage()
-	if websocket.IsCloseError(err, CloseErrors...) { 
+	var closeErr *websocket.CloseError
+	if websocket.IsCloseError(err, CloseErrors...) {
 		log.Warn("websockets: connection closed")
 		w.Close()
 		return nil
+	} else if errors.As(err, &closeErr) {
+		log.Warn("websockets: connection closed by peer (%d: %s)", closeErr.Code, closeErr.Text)
+		w.Close()
+		return nil
 	} else if err != nil {
-		return err
-	}
+		if w.IsClosed() {
+			// We closed the connection ourselves.
+			return nil
+		}
 
-	var wsMsg message.WSMessage
-	err = yaml.Unmarshal(msgBytes, &wsMsg)
-	if err != nil {
+		// Any other read error (including a missed read deadline)
+		// leaves the connection unusable.
+		readErrors.Inc()
+		w.Close()
 		return err
 	}
 
-	w.ReadCh <- wsMsg
+	framesRead.Inc()
+	bytesRead.Add(uint64(len(msgBytes)))
+
+	// A frame may hold several coalesced messages, one YAML document
+	// each, and the size limit applies to each of them.
+	for _, doc := range documents(msgBytes) {
+		if w.readLimit > 0 && int64(len(doc)) > w.readLimit {
+			readErrors.Inc()
+			w.refuse(websocket.CloseMessageTooBig, "message too big")
+			return fmt.Errorf("message of %d bytes over the %d byte limit", len(doc), w.readLimit)
+		}
+
+		var wsMsg message.WSMessage
+		if err := yaml.Unmarshal(doc, &wsMsg); err != nil {
+			readErrors.Inc()
+			return err
+		}
+		messagesRead.Inc()
+
+		select {
+		case w.ReadCh <- wsMsg:
+		case <-w.done:
+			return nil
+		}
+	}
 
 	return nil
 }
 
+// documents splits a frame into the YAML documents flush wrote to it.
+// The encoder indents or quotes any "---" inside a message, so only
+// separators start a line with it.
+func documents(frame []byte) [][]byte {
+	frame = bytes.TrimPrefix(frame, []byte("---\n"))
+
+	var docs [][]byte
+	for _, doc := range bytes.Split(frame, []byte("\n---\n")) {
+		if len(bytes.TrimSpace(doc)) > 0 {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// refuse closes the connection with code without waiting for the write
+// pump; control frames may be written alongside it.
+func (w *WebsocketHandler) refuse(code int, reason string) {
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	if err := w.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(WriteTimeout)); err != nil {
+		log.Debug("websockets: close: %v", err)
+	}
+	w.Close()
+}
+
 func (w *WebsocketHandler) Read() message.WSMessage {
 	return <-w.ReadCh
 }
 
+// Write queues msg for the write pump. It never touches the connection
+// itself, so it is safe to call from any goroutine.
 func (w *WebsocketHandler) Write(msg message.WSMessage) error {
-	return w.conn.WriteMessage(websocket.BinaryMessage, []byte(msg.String()))
+	if w.IsClosed() {
+		return ErrClosed
+	}
+
+	select {
+	case w.WriteCh <- msg:
+		return nil
+	case <-w.done:
+		return ErrClosed
+	default:
+	}
+
+	outboundDropped.WithLabel(overflowPolicies[w.overflow]).Inc()
+
+	switch w.overflow {
+	case OverflowDrop:
+		log.Warn("websockets: outbound queue full, dropping %s", msg.MessageID)
+		return ErrQueueFull
+	case OverflowDisconnect:
+		log.Warn("websockets: outbound queue full, disconnecting slow peer")
+		w.Close()
+		return ErrQueueFull
+	}
+
+	timer := time.NewTimer(WriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case w.WriteCh <- msg:
+		return nil
+	case <-w.done:
+		return ErrClosed
+	case <-timer.C:
+		return ErrQueueFull
+	}
+}
+
+// WritePump is the only goroutine that writes data frames to the
+// connection. It drains the outbound queue, coalescing whatever is
+// waiting into a single frame, and pings the peer every ping interval.
+// The ping payload carries the send time so that the matching pong
+// yields the round trip latency.
+func (w *WebsocketHandler) WritePump() {
+	ticker := time.NewTicker(w.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case msg := <-w.WriteCh:
+			if err := w.flush(msg); err != nil {
+				log.Error("websockets: write: %v", err)
+				w.Close()
+				return
+			}
+		case req := <-w.closeCh:
+			w.closeGracefully(req)
+			return
+		case t := <-ticker.C:
+			payload := []byte(strconv.FormatInt(t.UnixNano(), 10))
+			err := w.conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(WriteTimeout))
+			if err != nil {
+				log.Error("websockets: ping: %v", err)
+				w.Close()
+				return
+			}
+		}
+	}
+}
+
+func (w *WebsocketHandler) flush(first message.WSMessage) error {
+	w.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+
+	writer, err := w.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	written, err := io.WriteString(writer, first.String())
+	if err != nil {
+		return err
+	}
+
+	n := 1
+	for ; n < MaxCoalesce && len(w.WriteCh) > 0; n++ {
+		msg := <-w.WriteCh
+		doc := "---\n" + msg.String()
+		if written+len(doc) > MaxFrameSize {
+			// Keep the frame under the peer's limit; this one starts
+			// the next frame.
+			w.pending = &msg
+			break
+		}
+
+		more, err := io.WriteString(writer, doc)
+		if err != nil {
+			return err
+		}
+		written += more
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	framesWritten.Inc()
+	messagesWritten.Add(uint64(n))
+	bytesWritten.Add(uint64(written))
+
+	if next := w.pending; next != nil {
+		w.pending = nil
+		return w.flush(*next)
+	}
+
+	return nil
+}
+
+// CloseWithCode sends whatever is still queued, then a close frame with
+// the given code and reason, and closes the connection. It returns once
+// the connection is closed or WriteTimeout has passed.
+func (w *WebsocketHandler) CloseWithCode(code int, reason string) {
+	select {
+	case w.closeCh <- closeRequest{code: code, reason: reason}:
+	case <-w.done:
+		return
+	default:
+		// A close is already underway.
+	}
+
+	timer := time.NewTimer(WriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.done:
+	case <-timer.C:
+		w.Close()
+	}
+}
+
+func (w *WebsocketHandler) closeGracefully(req closeRequest) {
+	defer w.Close()
+
+	for len(w.WriteCh) > 0 {
+		if err := w.flush(<-w.WriteCh); err != nil {
+			log.Error("websockets: write on close: %v", err)
+			return
+		}
+	}
+
+	closeMsg := websocket.FormatCloseMessage(req.code, req.reason)
+	err := w.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(WriteTimeout))
+	if err != nil {
+		log.Error("websockets: close: %v", err)
+		return
+	}
+
+	// The read pump closes the handler once the peer's close frame
+	// comes back.
+	timer := time.NewTimer(CloseGracePeriod)
+	defer timer.Stop()
+
+	select {
+	case <-w.done:
+	case <-timer.C:
+	}
+}
+
+func (w *WebsocketHandler) handlePong(appData string) error {
+	w.conn.SetReadDeadline(time.Now().Add(w.pongTimeout))
+
+	sentNano, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil {
+		// Not one of our pings; still proof of life.
+		return nil
+	}
+
+	rtt := time.Since(time.Unix(0, sentNano))
+	pingRoundTrip.Observe(rtt.Seconds())
+
+	w.Lock()
+	w.latency = rtt
+	w.Unlock()
+
+	return nil
+}
+
+func (w *WebsocketHandler) handlePing(appData string) error {
+	w.conn.SetReadDeadline(time.Now().Add(w.pongTimeout))
+
+	err := w.conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(WriteTimeout))
+	if err == websocket.ErrCloseSent {
+		return nil
+	}
+
+	return err
+}
+
+// Done is closed once the connection has been closed.
+func (w *WebsocketHandler) Done() <-chan struct{} {
+	return w.done
+}
+
+// Latency returns the round trip time measured by the most recent
+// ping/pong exchange, or zero if none has completed yet.
+func (w *WebsocketHandler) Latency() time.Duration {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.latency
 }
 
 func (w *WebsocketHandler) IsClosed() bool {
@@ -104,9 +485,17 @@ func (w *WebsocketHandler) Close() {
 	w.Lock()
 	defer w.Unlock()
 
+	select {
+	case <-w.done:
+		// Already closed.
+		return
+	default:
+	}
+
 	w.active = false
-	w.conn.Close()
+	if w.conn != nil {
+		w.conn.Close()
+	}
 
-	close(w.ReadCh)
-	close(w.WriteCh)
+	close(w.done)
 }
@@ -0,0 +1,92 @@
+package websockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// idleConnections is how many connections sit idle in
+// BenchmarkIdleConnections.
+const idleConnections = 500
+
+// serve starts a websocket server whose handlers are sent on accepted,
+// and returns its address.
+func serve(tb testing.TB, accepted chan<- *WebsocketHandler) string {
+	return serveWith(tb, accepted, nil)
+}
+
+// serveWith is serve, with setup applied to every handler before it
+// starts.
+func serveWith(tb testing.TB, accepted chan<- *WebsocketHandler, setup func(w *WebsocketHandler)) string {
+	tb.Helper()
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Errorf("upgrade: %v", err)
+			return
+		}
+
+		handler := New().WithConn(conn)
+		if setup != nil {
+			setup(handler)
+		}
+		accepted <- handler.Start()
+	}))
+	tb.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// BenchmarkIdleConnections reports the CPU time the process burns while
+// both ends of idleConnections connections wait for messages that never
+// come. Blocking reads keep it near zero; polling would take a core per
+// connection.
+func BenchmarkIdleConnections(b *testing.B) {
+	accepted := make(chan *WebsocketHandler, idleConnections)
+	addr := serve(b, accepted)
+
+	handlers := make([]*WebsocketHandler, 0, 2*idleConnections)
+	for range idleConnections {
+		client := New()
+		if err := client.Connect(addr); err != nil {
+			b.Fatalf("connect: %v", err)
+		}
+		handlers = append(handlers, client.Start(), <-accepted)
+	}
+	b.Cleanup(func() {
+		for _, w := range handlers {
+			w.Close()
+		}
+	})
+
+	// Let the handshakes settle before measuring.
+	time.Sleep(100 * time.Millisecond)
+
+	b.ResetTimer()
+	before := cpuTime()
+	for range b.N {
+		time.Sleep(time.Millisecond)
+	}
+	used := cpuTime() - before
+	b.StopTimer()
+
+	b.ReportMetric(float64(used.Nanoseconds())/float64(b.N), "cpu-ns/op")
+	b.ReportMetric(100*float64(used)/float64(b.Elapsed()), "%cpu")
+}
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}